@@ -0,0 +1,250 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+// Some v1alpha1 specs can't be expressed in v1beta1 and the other way around, eg a noProxy string with
+// empty entries, a caConfig setting several CA sources or a v1beta1 workloadSelector.
+// The spec that can't be expressed is kept as JSON in an annotation of the converted ProxyConfig,
+// and restored when it is converted back as long as the other version wasn't changed in between.
+// The status is written by the operator through v1beta1 and isn't kept this way, the status fields v1alpha1 doesn't have,
+// such as the decisions, pending workloads and conflicts, are left out when a ProxyConfig is converted to v1alpha1.
+const (
+	// v1alpha1SpecAnnotation holds the v1alpha1 spec of a ProxyConfig stored as v1beta1
+	v1alpha1SpecAnnotation = "proxy.k8s.kemo.dev/v1alpha1-spec"
+
+	// v1beta1SpecAnnotation holds the v1beta1 spec of a ProxyConfig served as v1alpha1
+	v1beta1SpecAnnotation = "proxy.k8s.kemo.dev/v1beta1-spec"
+
+	// v1beta1StatusAnnotation held the v1beta1 status of a ProxyConfig served as v1alpha1 in earlier versions,
+	// it is removed on conversion
+	v1beta1StatusAnnotation = "proxy.k8s.kemo.dev/v1beta1-status"
+)
+
+var _ conversion.Convertible = &ProxyConfig{}
+
+// ConvertTo converts this ProxyConfig to the v1beta1 hub version
+func (src *ProxyConfig) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.ProxyConfig)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 ProxyConfig, got %T", dstRaw)
+	}
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+	dst.Spec = convertSpecToV1beta1(src.Spec)
+	dst.Status = convertStatusToV1beta1(src.Status)
+
+	// Restore the v1beta1 spec kept when this ProxyConfig was converted from v1beta1
+	if value, ok := popAnnotation(&dst.ObjectMeta.Annotations, v1beta1SpecAnnotation); ok {
+		stashed := v1beta1.ProxyConfigSpec{}
+		if err := json.Unmarshal([]byte(value), &stashed); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", v1beta1SpecAnnotation, err)
+		}
+		if equality.Semantic.DeepEqual(convertSpecFromV1beta1(stashed), src.Spec) {
+			dst.Spec = stashed
+		} else {
+			// The v1alpha1 spec was changed, only restore the fields v1alpha1 doesn't have
+			dst.Spec.WorkloadSelector = stashed.WorkloadSelector
+			dst.Spec.Kinds = stashed.Kinds
+			dst.Spec.InheritFrom = stashed.InheritFrom
+			dst.Spec.Priority = stashed.Priority
+			dst.Spec.Suspend = stashed.Suspend
+			dst.Spec.Containers = stashed.Containers
+			dst.Spec.ConflictPolicy = stashed.ConflictPolicy
+		}
+	}
+
+	popAnnotation(&dst.ObjectMeta.Annotations, v1beta1StatusAnnotation)
+	delete(dst.ObjectMeta.Annotations, v1alpha1SpecAnnotation)
+	if !equality.Semantic.DeepEqual(convertSpecFromV1beta1(dst.Spec), src.Spec) {
+		return stash(&dst.ObjectMeta.Annotations, v1alpha1SpecAnnotation, src.Spec)
+	}
+	return nil
+}
+
+// ConvertFrom converts the v1beta1 hub version to this ProxyConfig
+func (dst *ProxyConfig) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.ProxyConfig)
+	if !ok {
+		return fmt.Errorf("expected a v1beta1 ProxyConfig, got %T", srcRaw)
+	}
+	src.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+	dst.Spec = convertSpecFromV1beta1(src.Spec)
+	dst.Status = convertStatusFromV1beta1(src.Status)
+
+	// Restore the v1alpha1 spec kept when this ProxyConfig was converted from v1alpha1
+	if value, ok := popAnnotation(&dst.ObjectMeta.Annotations, v1alpha1SpecAnnotation); ok {
+		stashed := ProxyConfigSpec{}
+		if err := json.Unmarshal([]byte(value), &stashed); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", v1alpha1SpecAnnotation, err)
+		}
+		if equality.Semantic.DeepEqual(convertSpecToV1beta1(stashed), src.Spec) {
+			dst.Spec = stashed
+		}
+	}
+
+	popAnnotation(&dst.ObjectMeta.Annotations, v1beta1StatusAnnotation)
+	delete(dst.ObjectMeta.Annotations, v1beta1SpecAnnotation)
+	if !equality.Semantic.DeepEqual(convertSpecToV1beta1(dst.Spec), src.Spec) {
+		return stash(&dst.ObjectMeta.Annotations, v1beta1SpecAnnotation, src.Spec)
+	}
+	return nil
+}
+
+// convertSpecToV1beta1 converts a v1alpha1 spec to v1beta1.
+// Of the CA sources set in a caConfig, the first of CABundle, SecretName and Name is kept, as it is the one that was used.
+func convertSpecToV1beta1(src ProxyConfigSpec) v1beta1.ProxyConfigSpec {
+	dst := v1beta1.ProxyConfigSpec{
+		ProxySource:            src.ProxySource,
+		DisableRolloutOnChange: src.DisableRolloutOnChange,
+	}
+
+	if src.Proxy.HTTPProxy != "" || src.Proxy.HTTPSProxy != "" || src.Proxy.NoProxy != "" {
+		dst.Proxy = &v1beta1.Proxy{
+			HTTPProxy:  src.Proxy.HTTPProxy,
+			HTTPSProxy: src.Proxy.HTTPSProxy,
+			NoProxy:    v1beta1.ParseNoProxy(src.Proxy.NoProxy),
+		}
+	}
+
+	caConfig := src.Proxy.CAConfig
+	var source *v1beta1.CASource
+	switch {
+	case caConfig.CABundle != "":
+		source = &v1beta1.CASource{Type: v1beta1.CASourceInline, Inline: caConfig.CABundle}
+	case caConfig.SecretName != "":
+		source = &v1beta1.CASource{Type: v1beta1.CASourceSecret, Secret: &v1beta1.CAKeyReference{Name: caConfig.SecretName, Key: caConfig.Key}}
+	case caConfig.Name != "":
+		source = &v1beta1.CASource{Type: v1beta1.CASourceConfigMap, ConfigMap: &v1beta1.CAKeyReference{Name: caConfig.Name, Key: caConfig.Key}}
+	}
+	if src.InjectCACert || source != nil {
+		dst.CACert = &v1beta1.CACert{Inject: src.InjectCACert, Source: source}
+	}
+	return dst
+}
+
+// convertSpecFromV1beta1 converts a v1beta1 spec to v1alpha1, dropping the workloadSelector, kinds, inheritFrom, priority, suspend, containers
+// and conflictPolicy
+func convertSpecFromV1beta1(src v1beta1.ProxyConfigSpec) ProxyConfigSpec {
+	dst := ProxyConfigSpec{
+		ProxySource:            src.ProxySource,
+		DisableRolloutOnChange: src.DisableRolloutOnChange,
+	}
+
+	if src.Proxy != nil {
+		dst.Proxy.HTTPProxy = src.Proxy.HTTPProxy
+		dst.Proxy.HTTPSProxy = src.Proxy.HTTPSProxy
+		dst.Proxy.NoProxy = v1beta1.FormatNoProxy(src.Proxy.NoProxy)
+	}
+
+	if src.CACert != nil {
+		dst.InjectCACert = src.CACert.Inject
+		if source := src.CACert.Source; source != nil {
+			switch source.Type {
+			case v1beta1.CASourceInline:
+				dst.Proxy.CAConfig.CABundle = source.Inline
+			case v1beta1.CASourceSecret:
+				if source.Secret != nil {
+					dst.Proxy.CAConfig.SecretName = source.Secret.Name
+					dst.Proxy.CAConfig.Key = source.Secret.Key
+				}
+			case v1beta1.CASourceConfigMap:
+				if source.ConfigMap != nil {
+					dst.Proxy.CAConfig.Name = source.ConfigMap.Name
+					dst.Proxy.CAConfig.Key = source.ConfigMap.Key
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func convertStatusToV1beta1(src ProxyConfigStatus) v1beta1.ProxyConfigStatus {
+	dst := v1beta1.ProxyConfigStatus{
+		ObservedGeneration: src.ObservedGeneration,
+		Conditions:         src.Conditions,
+		ProxySource:        src.ProxySource,
+		EffectiveProxy: v1beta1.EffectiveProxy{
+			HTTPProxy:  src.EffectiveProxy.HTTPProxy,
+			HTTPSProxy: src.EffectiveProxy.HTTPSProxy,
+			NoProxy:    v1beta1.ParseNoProxy(src.EffectiveProxy.NoProxy),
+		},
+		InjectedCount: src.InjectedCount,
+	}
+	for _, workloads := range src.Workloads {
+		kind := v1beta1.WorkloadKindStatus{Kind: workloads.Kind, Injected: workloads.Injected}
+		for _, failure := range workloads.Failed {
+			kind.Failed = append(kind.Failed, v1beta1.WorkloadFailure{Name: failure.Name, Reason: failure.Reason})
+		}
+		dst.Workloads = append(dst.Workloads, kind)
+	}
+	return dst
+}
+
+func convertStatusFromV1beta1(src v1beta1.ProxyConfigStatus) ProxyConfigStatus {
+	dst := ProxyConfigStatus{
+		ObservedGeneration: src.ObservedGeneration,
+		Conditions:         src.Conditions,
+		ProxySource:        src.ProxySource,
+		EffectiveProxy: EffectiveProxy{
+			HTTPProxy:  src.EffectiveProxy.HTTPProxy,
+			HTTPSProxy: src.EffectiveProxy.HTTPSProxy,
+			NoProxy:    v1beta1.FormatNoProxy(src.EffectiveProxy.NoProxy),
+		},
+		InjectedCount: src.InjectedCount,
+	}
+	for _, workloads := range src.Workloads {
+		kind := WorkloadKindStatus{Kind: workloads.Kind, Injected: workloads.Injected}
+		for _, failure := range workloads.Failed {
+			kind.Failed = append(kind.Failed, WorkloadFailure{Name: failure.Name, Reason: failure.Reason})
+		}
+		dst.Workloads = append(dst.Workloads, kind)
+	}
+	return dst
+}
+
+// popAnnotation removes an annotation, returning its value
+func popAnnotation(annotations *map[string]string, name string) (string, bool) {
+	value, ok := (*annotations)[name]
+	if ok {
+		delete(*annotations, name)
+		if len(*annotations) == 0 {
+			*annotations = nil
+		}
+	}
+	return value, ok
+}
+
+// stash stores a spec as JSON in an annotation
+func stash(annotations *map[string]string, name string, spec interface{}) error {
+	value, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if *annotations == nil {
+		*annotations = map[string]string{}
+	}
+	(*annotations)[name] = string(value)
+	return nil
+}
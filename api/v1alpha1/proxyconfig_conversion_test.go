@@ -0,0 +1,176 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// newV1beta1ProxyConfig returns a v1beta1 ProxyConfig setting every field of the spec and status
+func newV1beta1ProxyConfig() *v1beta1.ProxyConfig {
+	return &v1beta1.ProxyConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "proxy", Namespace: "default", Annotations: map[string]string{"example.com/owner": "team"}},
+		Spec: v1beta1.ProxyConfigSpec{
+			ProxySource:      "custom",
+			InheritFrom:      &v1beta1.InheritFrom{Kind: v1beta1.InheritFromClusterProxyConfig, Name: "default"},
+			Proxy:            &v1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128", HTTPSProxy: "http://proxy.example.com:3129", NoProxy: []string{".cluster.local", "10.0.0.0/8"}},
+			CACert:           &v1beta1.CACert{Inject: true, Source: &v1beta1.CASource{Type: v1beta1.CASourceConfigMap, ConfigMap: &v1beta1.CAKeyReference{Name: "ca", Key: "ca.crt"}}},
+			WorkloadSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Kinds:            []string{"Deployment"},
+			Containers:       &v1beta1.ContainerFilter{Include: []string{"app"}, InitContainers: true},
+			ConflictPolicy:   v1beta1.ConflictPolicyMerge,
+			Priority:         10,
+			Suspend:          true,
+
+			DisableRolloutOnChange: true,
+		},
+		Status: v1beta1.ProxyConfigStatus{
+			ObservedGeneration: 2,
+			Conditions:         []metav1.Condition{{Type: v1beta1.ConditionReady, Status: metav1.ConditionTrue, ObservedGeneration: 2, LastTransitionTime: metav1.Date(2023, 6, 1, 12, 0, 0, 0, time.Local), Reason: "Injected", Message: "1 workload(s) injected"}},
+			ProxySource:        "custom",
+			InheritedFrom:      "ClusterProxyConfig/default",
+			EffectiveProxy:     v1beta1.EffectiveProxy{HTTPProxy: "http://proxy.example.com:3128", NoProxy: []string{".cluster.local"}},
+			InjectedCount:      1,
+			Workloads: []v1beta1.WorkloadKindStatus{{
+				Kind:             "Deployment",
+				Injected:         []string{"web"},
+				Failed:           []v1beta1.WorkloadFailure{{Name: "api", Reason: "conflict"}},
+				Pending:          []string{"worker"},
+				Decisions:        []v1beta1.WorkloadDecision{{Name: "web", Inject: true, Reason: v1beta1.DecisionWorkloadSelector}},
+				EnvConflicts:     []v1beta1.EnvConflict{{Name: "web", Container: "app", Variable: "NO_PROXY", Source: "env", Resolution: v1beta1.ResolutionMerged}},
+				InjectedCount:    1,
+				FailedCount:      1,
+				PendingCount:     1,
+				DecisionCount:    1,
+				EnvConflictCount: 1,
+			}},
+		},
+	}
+}
+
+// expectAllFieldsSet fails when a field of a struct is left empty, so the fixtures keep up with new fields
+func expectAllFieldsSet(obj interface{}) {
+	value := reflect.ValueOf(obj)
+	for i := 0; i < value.NumField(); i++ {
+		Expect(value.Field(i).IsZero()).To(BeFalse(), "%s.%s is not set", value.Type().Name(), value.Type().Field(i).Name)
+	}
+}
+
+var _ = Describe("ProxyConfig conversion", func() {
+	It("sets every v1beta1 field in the fixture", func() {
+		hub := newV1beta1ProxyConfig()
+		expectAllFieldsSet(hub.Spec)
+		expectAllFieldsSet(hub.Status)
+		expectAllFieldsSet(hub.Status.Workloads[0])
+	})
+
+	It("round trips a v1beta1 ProxyConfig through v1alpha1", func() {
+		hub := newV1beta1ProxyConfig()
+
+		spoke := &ProxyConfig{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		Expect(spoke.Annotations).To(HaveKey(v1beta1SpecAnnotation))
+		Expect(spoke.Annotations).NotTo(HaveKey(v1beta1StatusAnnotation))
+
+		converted := &v1beta1.ProxyConfig{}
+		Expect(spoke.ConvertTo(converted)).To(Succeed())
+		Expect(converted.Spec).To(Equal(hub.Spec))
+		Expect(converted.Annotations).To(Equal(hub.Annotations))
+	})
+
+	It("keeps the v1beta1 fields when the v1alpha1 spec is changed", func() {
+		hub := newV1beta1ProxyConfig()
+
+		spoke := &ProxyConfig{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		spoke.Spec.Proxy.HTTPProxy = "http://other.example.com:3128"
+
+		converted := &v1beta1.ProxyConfig{}
+		Expect(spoke.ConvertTo(converted)).To(Succeed())
+		expected := newV1beta1ProxyConfig().Spec
+		expected.Proxy.HTTPProxy = "http://other.example.com:3128"
+		Expect(converted.Spec).To(Equal(expected))
+	})
+
+	It("only converts the status fields v1alpha1 has", func() {
+		hub := newV1beta1ProxyConfig()
+
+		spoke := &ProxyConfig{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		Expect(spoke.Status.EffectiveProxy.NoProxy).To(Equal(".cluster.local"))
+		Expect(spoke.Status.Workloads[0].Failed).To(Equal([]WorkloadFailure{{Name: "api", Reason: "conflict"}}))
+
+		converted := &v1beta1.ProxyConfig{}
+		Expect(spoke.ConvertTo(converted)).To(Succeed())
+		expected := newV1beta1ProxyConfig().Status
+		expected.InheritedFrom = ""
+		expected.Workloads = []v1beta1.WorkloadKindStatus{{
+			Kind:     "Deployment",
+			Injected: []string{"web"},
+			Failed:   []v1beta1.WorkloadFailure{{Name: "api", Reason: "conflict"}},
+		}}
+		Expect(converted.Status).To(Equal(expected))
+	})
+
+	It("removes the status annotation of earlier versions", func() {
+		hub := newV1beta1ProxyConfig()
+		hub.Annotations[v1beta1StatusAnnotation] = `{"inheritedFrom":"ClusterProxyConfig/default"}`
+
+		spoke := &ProxyConfig{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		Expect(spoke.Annotations).NotTo(HaveKey(v1beta1StatusAnnotation))
+
+		spoke.Annotations[v1beta1StatusAnnotation] = `{"inheritedFrom":"ClusterProxyConfig/default"}`
+		converted := &v1beta1.ProxyConfig{}
+		Expect(spoke.ConvertTo(converted)).To(Succeed())
+		Expect(converted.Annotations).NotTo(HaveKey(v1beta1StatusAnnotation))
+		Expect(converted.Status.InheritedFrom).To(BeEmpty())
+	})
+
+	It("round trips a v1alpha1 ProxyConfig v1beta1 can't express", func() {
+		spoke := &ProxyConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy", Namespace: "default"},
+			Spec: ProxyConfigSpec{
+				ProxySource:  "custom",
+				InjectCACert: true,
+				Proxy: Proxy{
+					HTTPProxy: "http://proxy.example.com:3128",
+					NoProxy:   ".cluster.local",
+					CAConfig:  CAConfig{Name: "ca", SecretName: "ca-secret", Key: "ca.crt"},
+				},
+			},
+		}
+
+		hub := &v1beta1.ProxyConfig{}
+		Expect(spoke.ConvertTo(hub)).To(Succeed())
+		Expect(hub.Annotations).To(HaveKey(v1alpha1SpecAnnotation))
+		Expect(hub.Spec.CACert.Source.Type).To(Equal(v1beta1.CASourceSecret))
+
+		converted := &ProxyConfig{}
+		Expect(converted.ConvertFrom(hub)).To(Succeed())
+		Expect(converted.Spec).To(Equal(spoke.Spec))
+		Expect(converted.Annotations).To(BeEmpty())
+	})
+})
@@ -44,17 +44,29 @@ type ProxyConfigSpec struct {
 	// Proxy defines the proxy configuration to use when ProxySource is set to "custom"
 	// +optional
 	Proxy Proxy `json:"proxy,omitempty"`
+
+	// DisableRolloutOnChange stops the operator from stamping a hash of the proxy configuration and CA certificate
+	// on the pod templates of the workloads. Without it, changes to the proxy Secret or CA certificate only reach
+	// running pods once they are restarted.
+	// +optional
+	DisableRolloutOnChange bool `json:"disableRolloutOnChange,omitempty"`
 }
 
 // Proxy defines the proxy configuration to use when ProxySource is set to "custom"
 type Proxy struct {
 	// HTTPProxy defines the HTTP proxy to use
+	// +kubebuilder:validation:XValidation:rule="self == '' || self.matches('^(http|https|socks5|socks5h)://[^/?#]+/?$')",message="httpProxy must be a URL like http://proxy.example.com:3128"
+	// +kubebuilder:validation:MaxLength=2048
 	// +optional
 	HTTPProxy string `json:"httpProxy,omitempty"`
 	// HTTPSProxy defines the HTTPS proxy to use
+	// +kubebuilder:validation:XValidation:rule="self == '' || self.matches('^(http|https|socks5|socks5h)://[^/?#]+/?$')",message="httpsProxy must be a URL like http://proxy.example.com:3128"
+	// +kubebuilder:validation:MaxLength=2048
 	// +optional
 	HTTPSProxy string `json:"httpsProxy,omitempty"`
 	// NoProxy defines the no proxy configuration to use
+	// +kubebuilder:validation:XValidation:rule="!self.contains(',,') && !self.startsWith(',') && !self.endsWith(',')",message="noProxy must be a comma separated list without empty entries"
+	// +kubebuilder:validation:MaxLength=65536
 	// +optional
 	NoProxy string `json:"noProxy,omitempty"`
 	// CACert defines the CA certificate stored in a ConfigMap to use
@@ -63,23 +75,118 @@ type Proxy struct {
 }
 
 // CAConfig defines the CA configuration to use
+// The CA certificate is read from the first of CABundle, SecretName and Name that is set,
+// in the namespace of the ProxyConfig, and copied into the namespaces of the workloads.
 type CAConfig struct {
 	// Name defines the CA certificate stored in a ConfigMap to use
 	// +optional
 	Name string `json:"name,omitempty"`
-	// Key defines the key of the CA certificate stored in a ConfigMap to use
+	// Key defines the key of the CA certificate stored in a ConfigMap or Secret to use
+	// Defaults to "ca-bundle.crt"
 	// +optional
 	Key string `json:"key,omitempty"`
+	// SecretName defines the CA certificate stored in a Secret to use
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// CABundle defines the PEM encoded CA certificate to use inline
+	// +kubebuilder:validation:XValidation:rule="self == '' || self.contains('-----BEGIN CERTIFICATE-----')",message="caBundle must hold PEM encoded certificates"
+	// +kubebuilder:validation:MaxLength=1048576
+	// +optional
+	CABundle string `json:"caBundle,omitempty"`
 }
 
+// Condition types reported in ProxyConfigStatus.Conditions
+const (
+	// ConditionReady indicates that the proxy configuration was resolved and applied to all targeted workloads
+	ConditionReady = "Ready"
+
+	// ConditionSourceResolved indicates that the proxy configuration could be read from its source
+	ConditionSourceResolved = "SourceResolved"
+
+	// ConditionCACertInjected indicates that the CA certificate was injected into the targeted workloads
+	ConditionCACertInjected = "CACertInjected"
+
+	// ConditionDegraded indicates that one or more workloads could not be listed or injected
+	ConditionDegraded = "Degraded"
+)
+
 // ProxyConfigStatus defines the observed state of ProxyConfig
 type ProxyConfigStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation of the ProxyConfig that was reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the ProxyConfig's state
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ProxySource is the proxy source that was used, after defaulting
+	// +optional
+	ProxySource string `json:"proxySource,omitempty"`
+
+	// EffectiveProxy is the resolved proxy configuration, with any credentials redacted
+	// +optional
+	EffectiveProxy EffectiveProxy `json:"effectiveProxy,omitempty"`
+
+	// InjectedCount is the number of workloads the proxy configuration was injected into
+	// +optional
+	InjectedCount int32 `json:"injectedCount,omitempty"`
+
+	// Workloads is the per-kind inventory of workloads that were injected or failed
+	// +optional
+	Workloads []WorkloadKindStatus `json:"workloads,omitempty"`
+}
+
+// EffectiveProxy defines the resolved proxy configuration reported in the status
+type EffectiveProxy struct {
+	// HTTPProxy is the resolved HTTP proxy
+	// +optional
+	HTTPProxy string `json:"httpProxy,omitempty"`
+
+	// HTTPSProxy is the resolved HTTPS proxy
+	// +optional
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+
+	// NoProxy is the resolved no proxy configuration
+	// +optional
+	NoProxy string `json:"noProxy,omitempty"`
+}
+
+// WorkloadKindStatus defines the injection results for a single workload kind
+type WorkloadKindStatus struct {
+	// Kind is the kind of the workloads, eg "Deployment"
+	Kind string `json:"kind"`
+
+	// Injected lists the names of the workloads that were injected
+	// +optional
+	Injected []string `json:"injected,omitempty"`
+
+	// Failed lists the workloads that could not be injected
+	// +optional
+	Failed []WorkloadFailure `json:"failed,omitempty"`
+}
+
+// WorkloadFailure defines a workload that could not be injected
+type WorkloadFailure struct {
+	// Name is the name of the workload
+	Name string `json:"name"`
+
+	// Reason is a human readable description of the failure
+	Reason string `json:"reason"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.proxySource`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Injected",type=integer,JSONPath=`.status.injectedCount`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // ProxyConfig is the Schema for the proxyconfigs API
 type ProxyConfig struct {
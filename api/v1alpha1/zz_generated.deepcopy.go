@@ -22,6 +22,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -40,6 +41,21 @@ func (in *CAConfig) DeepCopy() *CAConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EffectiveProxy) DeepCopyInto(out *EffectiveProxy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EffectiveProxy.
+func (in *EffectiveProxy) DeepCopy() *EffectiveProxy {
+	if in == nil {
+		return nil
+	}
+	out := new(EffectiveProxy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Proxy) DeepCopyInto(out *Proxy) {
 	*out = *in
@@ -62,7 +78,7 @@ func (in *ProxyConfig) DeepCopyInto(out *ProxyConfig) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyConfig.
@@ -134,6 +150,21 @@ func (in *ProxyConfigSpec) DeepCopy() *ProxyConfigSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProxyConfigStatus) DeepCopyInto(out *ProxyConfigStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.EffectiveProxy = in.EffectiveProxy
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]WorkloadKindStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyConfigStatus.
@@ -145,3 +176,43 @@ func (in *ProxyConfigStatus) DeepCopy() *ProxyConfigStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadFailure) DeepCopyInto(out *WorkloadFailure) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadFailure.
+func (in *WorkloadFailure) DeepCopy() *WorkloadFailure {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadFailure)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadKindStatus) DeepCopyInto(out *WorkloadKindStatus) {
+	*out = *in
+	if in.Injected != nil {
+		in, out := &in.Injected, &out.Injected
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Failed != nil {
+		in, out := &in.Failed, &out.Failed
+		*out = make([]WorkloadFailure, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadKindStatus.
+func (in *WorkloadKindStatus) DeepCopy() *WorkloadKindStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadKindStatus)
+	in.DeepCopyInto(out)
+	return out
+}
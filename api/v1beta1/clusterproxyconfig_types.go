@@ -0,0 +1,130 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterProxyConfigSpec defines the desired state of ClusterProxyConfig
+type ClusterProxyConfigSpec struct {
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// NamespaceSelector selects the namespaces the proxy configuration is distributed to and injected into.
+	// Every namespace is selected when it is not set.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ProxyConfigSpec defines the proxy configuration and the workloads it is injected into in the selected namespaces.
+	// ConfigMaps and Secrets the CA certificate is read from must set their namespace,
+	// and only the OpenShift cluster Proxy can be inherited from.
+	ProxyConfigSpec `json:",inline"`
+}
+
+// ClusterProxyConfigStatus defines the observed state of ClusterProxyConfig
+type ClusterProxyConfigStatus struct {
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation of the ClusterProxyConfig that was reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the ClusterProxyConfig's state
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ProxySource is the proxy source that was used, after defaulting.
+	// With InheritFrom, it is the proxy source of the inherited configuration.
+	// +optional
+	ProxySource string `json:"proxySource,omitempty"`
+
+	// InheritedFrom is the cluster-level proxy configuration that was inherited, ie ClusterProxy
+	// +optional
+	InheritedFrom string `json:"inheritedFrom,omitempty"`
+
+	// EffectiveProxy is the resolved proxy configuration, with any credentials redacted
+	// +optional
+	EffectiveProxy EffectiveProxy `json:"effectiveProxy,omitempty"`
+
+	// NamespaceCount is the number of namespaces selected by the namespaceSelector
+	// +optional
+	NamespaceCount int32 `json:"namespaceCount,omitempty"`
+
+	// InjectedCount is the number of workloads the proxy configuration was injected into, across all namespaces
+	// +optional
+	InjectedCount int32 `json:"injectedCount,omitempty"`
+
+	// FailedCount is the number of workloads that could not be injected, across all namespaces
+	// +optional
+	FailedCount int32 `json:"failedCount,omitempty"`
+
+	// Namespaces is the per-namespace inventory of workloads that were targeted, injected or failed.
+	// Selected namespaces without any targeted workload are left out.
+	// +optional
+	Namespaces []NamespaceStatus `json:"namespaces,omitempty"`
+}
+
+// NamespaceStatus defines the injection results of a ClusterProxyConfig in a single namespace
+type NamespaceStatus struct {
+	// Namespace is the name of the namespace
+	Namespace string `json:"namespace"`
+
+	// InjectedCount is the number of workloads the proxy configuration was injected into in the namespace
+	// +optional
+	InjectedCount int32 `json:"injectedCount,omitempty"`
+
+	// Workloads is the per-kind inventory of workloads that were injected or failed in the namespace
+	// +optional
+	Workloads []WorkloadKindStatus `json:"workloads,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.proxySource`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Namespaces",type=integer,JSONPath=`.status.namespaceCount`
+//+kubebuilder:printcolumn:name="Injected",type=integer,JSONPath=`.status.injectedCount`
+//+kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterProxyConfig is the Schema for the clusterproxyconfigs API.
+// It distributes a proxy configuration to every namespace matching its namespaceSelector.
+type ClusterProxyConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterProxyConfigSpec   `json:"spec,omitempty"`
+	Status ClusterProxyConfigStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterProxyConfigList contains a list of ClusterProxyConfig
+type ClusterProxyConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterProxyConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterProxyConfig{}, &ClusterProxyConfigList{})
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SetupWebhookWithManager registers the ClusterProxyConfig validating webhook with the Manager
+func (r *ClusterProxyConfig) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&clusterProxyConfigValidator{proxyConfigValidator{Client: mgr.GetClient()}}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-proxy-k8s-kemo-dev-v1beta1-clusterproxyconfig,mutating=false,failurePolicy=fail,sideEffects=None,groups=proxy.k8s.kemo.dev,resources=clusterproxyconfigs,verbs=create;update,versions=v1beta1,name=vclusterproxyconfig.kb.io,admissionReviewVersions=v1
+
+// clusterProxyConfigValidator validates ClusterProxyConfigs the same way as ProxyConfigs, along with their namespaceSelector
+type clusterProxyConfigValidator struct {
+	proxyConfigValidator
+}
+
+var _ admission.CustomValidator = &clusterProxyConfigValidator{}
+
+// ValidateCreate implements admission.CustomValidator
+func (v *clusterProxyConfigValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	clusterProxyConfig, ok := obj.(*ClusterProxyConfig)
+	if !ok {
+		return nil, fmt.Errorf("expected a ClusterProxyConfig, got %T", obj)
+	}
+	return v.validate(ctx, clusterProxyConfig)
+}
+
+// ValidateUpdate implements admission.CustomValidator
+func (v *clusterProxyConfigValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	clusterProxyConfig, ok := newObj.(*ClusterProxyConfig)
+	if !ok {
+		return nil, fmt.Errorf("expected a ClusterProxyConfig, got %T", newObj)
+	}
+	// Let the finalizer be removed from ClusterProxyConfigs that are invalid by now
+	if !clusterProxyConfig.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return v.validate(ctx, clusterProxyConfig)
+}
+
+// ValidateDelete implements admission.CustomValidator
+func (v *clusterProxyConfigValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate validates the namespaceSelector and the proxy configuration of a ClusterProxyConfig
+func (v *clusterProxyConfigValidator) validate(ctx context.Context, clusterProxyConfig *ClusterProxyConfig) (admission.Warnings, error) {
+	specPath := field.NewPath("spec")
+	allErrs, warnings := v.validateSpec(ctx, &clusterProxyConfig.Spec.ProxyConfigSpec, "", specPath)
+
+	if clusterProxyConfig.Spec.NamespaceSelector != nil {
+		allErrs = append(allErrs, metav1validation.ValidateLabelSelector(clusterProxyConfig.Spec.NamespaceSelector, metav1validation.LabelSelectorValidationOptions{}, specPath.Child("namespaceSelector"))...)
+	} else {
+		warnings = append(warnings, specPath.Child("namespaceSelector").String()+" is not set, every namespace is selected")
+	}
+
+	if len(allErrs) > 0 {
+		return warnings, errors.NewInvalid(GroupVersion.WithKind("ClusterProxyConfig").GroupKind(), clusterProxyConfig.Name, allErrs)
+	}
+	return warnings, nil
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import "strings"
+
+// Hub marks v1beta1 as the version the other ProxyConfig versions are converted through
+func (*ProxyConfig) Hub() {}
+
+// ParseNoProxy splits a comma separated noProxy list, like the NO_PROXY environmental variable, into its entries.
+// Whitespace around the entries and empty entries are dropped.
+func ParseNoProxy(noProxy string) []string {
+	var entries []string
+	for _, entry := range strings.Split(noProxy, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// FormatNoProxy joins noProxy entries into a comma separated list, like the NO_PROXY environmental variable
+func FormatNoProxy(entries []string) string {
+	return strings.Join(entries, ",")
+}
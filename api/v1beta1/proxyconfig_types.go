@@ -0,0 +1,477 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProxyConfigSpec defines the desired state of ProxyConfig
+type ProxyConfigSpec struct {
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// ProxySource defines the source of the proxy configuration
+	// Options include:
+	// - "openshift" (default): Use the proxy configuration from the OpenShift cluster
+	// - "custom": Use the proxy configuration defined in the ProxyConfig resource
+	// It can't be set together with InheritFrom.
+	// +kubebuilder:validation:Enum=openshift;custom
+	// +optional
+	ProxySource string `json:"proxySource,omitempty"`
+
+	// InheritFrom defines the cluster-level proxy configuration this one is based on.
+	// Proxy and CACert then patch the inherited configuration: the proxy URLs that are set replace the inherited ones,
+	// noProxy entries are appended to the inherited ones, and a CACert replaces the inherited CA certificate settings.
+	// +optional
+	InheritFrom *InheritFrom `json:"inheritFrom,omitempty"`
+
+	// Proxy defines the proxy configuration to use when ProxySource is set to "custom",
+	// or the fields patching the inherited proxy configuration
+	// +optional
+	Proxy *Proxy `json:"proxy,omitempty"`
+
+	// CACert defines whether and from where a CA certificate is injected into the workloads
+	// +optional
+	CACert *CACert `json:"caCert,omitempty"`
+
+	// WorkloadSelector selects the workloads in the namespace the proxy configuration is injected into.
+	// When it is not set, the workloads labeled proxy.k8s.kemo.dev/inject-proxy-env: "true" are selected.
+	// An empty selector selects every workload.
+	// +optional
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+
+	// Kinds limits the injection to these workload kinds, eg Deployment or StatefulSet.
+	// Every supported kind is injected when it is empty.
+	// +optional
+	Kinds []string `json:"kinds,omitempty"`
+
+	// Containers limits the injection to some of the containers of the workloads, by name,
+	// and extends it to their init containers, native sidecars and ephemeral containers.
+	// The istio-proxy, linkerd-proxy and oauth-proxy sidecars are excluded unless they are listed in Include.
+	// +optional
+	Containers *ContainerFilter `json:"containers,omitempty"`
+
+	// ConflictPolicy decides what happens to the proxy environmental variables a container already sets itself,
+	// in its env or through envFrom:
+	// - "Overwrite" (default): replace them with the managed ones
+	// - "Preserve": keep them, and only inject the variables the container doesn't set
+	// - "Merge": keep the proxy URLs, and append the managed noProxy entries to the ones of NO_PROXY and no_proxy
+	// Every conflict is reported with an event on the workload and in the status.
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// Priority decides which ProxyConfig injects a workload selected by several ProxyConfigs in its namespace.
+	// The highest priority wins, ties go to the oldest ProxyConfig and then to the name sorting first.
+	// ClusterProxyConfigs are decided between the same way, after the ProxyConfigs in the namespace.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// Suspend stops the operator from writing the workloads, Secrets and ConfigMaps of this proxy configuration.
+	// It is still resolved, and the workloads with changes held back are reported in the status.
+	// Everything that changed in the meantime is applied once it is unset. Deleting it still cleans up.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// DisableRolloutOnChange stops the operator from stamping a hash of the proxy configuration and CA certificate
+	// on the pod templates of the workloads. Without it, changes to the proxy Secret or CA certificate only reach
+	// running pods once they are restarted.
+	// +optional
+	DisableRolloutOnChange bool `json:"disableRolloutOnChange,omitempty"`
+}
+
+// InheritFromKind is the kind of cluster-level proxy configuration a ProxyConfig inherits from
+// +kubebuilder:validation:Enum=ClusterProxy;ClusterProxyConfig
+type InheritFromKind string
+
+const (
+	// InheritFromClusterProxy inherits the proxy configuration of the OpenShift cluster Proxy
+	InheritFromClusterProxy InheritFromKind = "ClusterProxy"
+
+	// InheritFromClusterProxyConfig inherits the proxy configuration of a ClusterProxyConfig
+	InheritFromClusterProxyConfig InheritFromKind = "ClusterProxyConfig"
+)
+
+// InheritFrom references the cluster-level proxy configuration a ProxyConfig inherits from
+// +kubebuilder:validation:XValidation:rule="self.kind == 'ClusterProxyConfig' ? has(self.name) : !has(self.name)",message="name must be set when kind is ClusterProxyConfig, and only then"
+type InheritFrom struct {
+	// Kind is either ClusterProxy, the OpenShift cluster Proxy, or ClusterProxyConfig
+	Kind InheritFromKind `json:"kind"`
+
+	// Name is the name of the ClusterProxyConfig
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// ConflictPolicy decides what happens to the proxy environmental variables a container already sets itself
+// +kubebuilder:validation:Enum=Overwrite;Preserve;Merge
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverwrite replaces the variables set by the container with the managed ones
+	ConflictPolicyOverwrite ConflictPolicy = "Overwrite"
+
+	// ConflictPolicyPreserve keeps the variables set by the container
+	ConflictPolicyPreserve ConflictPolicy = "Preserve"
+
+	// ConflictPolicyMerge keeps the proxy URLs set by the container, and unions its noProxy entries with the managed ones
+	ConflictPolicyMerge ConflictPolicy = "Merge"
+)
+
+// ContainerFilter selects the containers of a workload the proxy configuration is injected into, by name and type
+type ContainerFilter struct {
+	// Include limits the injection to these containers. Every container but the excluded ones is injected when it is empty.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude lists the containers that are never injected, even when they are listed in Include
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// InitContainers injects the init containers too, except the native sidecars
+	// +optional
+	InitContainers bool `json:"initContainers,omitempty"`
+
+	// NativeSidecars injects the native sidecars too, ie the init containers with restartPolicy Always
+	// +optional
+	NativeSidecars bool `json:"nativeSidecars,omitempty"`
+
+	// EphemeralContainers injects the ephemeral containers added to running Pods, eg by kubectl debug, too.
+	// They are injected by the admission webhook as they are added, and only mount the CA certificate
+	// when the Pod already has its volume.
+	// +optional
+	EphemeralContainers bool `json:"ephemeralContainers,omitempty"`
+}
+
+// Proxy defines the proxy configuration to use when ProxySource is set to "custom"
+type Proxy struct {
+	// HTTPProxy defines the HTTP proxy to use
+	// +kubebuilder:validation:XValidation:rule="self == '' || self.matches('^(http|https|socks5|socks5h)://[^/?#]+/?$')",message="httpProxy must be a URL like http://proxy.example.com:3128"
+	// +kubebuilder:validation:MaxLength=2048
+	// +optional
+	HTTPProxy string `json:"httpProxy,omitempty"`
+	// HTTPSProxy defines the HTTPS proxy to use
+	// +kubebuilder:validation:XValidation:rule="self == '' || self.matches('^(http|https|socks5|socks5h)://[^/?#]+/?$')",message="httpsProxy must be a URL like http://proxy.example.com:3128"
+	// +kubebuilder:validation:MaxLength=2048
+	// +optional
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	// NoProxy lists the domains, IP addresses, CIDRs and wildcards that are reached without the proxy
+	// +kubebuilder:validation:XValidation:rule="self.all(entry, entry.size() != 0)",message="noProxy entries can't be empty"
+	// +kubebuilder:validation:MaxItems=1024
+	// +optional
+	NoProxy []string `json:"noProxy,omitempty"`
+}
+
+// CACert defines the CA certificate injected into the workloads
+type CACert struct {
+	// Inject defines whether to inject the CA certificate into the workloads.
+	// When proxySource is set to "openshift", it will use the cluster-wide additionalTrustBundle defined in
+	//  the proxy.config.openshift.io/cluster resource and provided by the Cluster Network Operator.
+	// When proxySource is set to "custom", it will use the CA certificate read from Source.
+	// +optional
+	Inject bool `json:"inject,omitempty"`
+
+	// Source defines where the CA certificate of the "custom" proxy source is read from
+	// +optional
+	Source *CASource `json:"source,omitempty"`
+}
+
+// CASourceType is the type of a CASource
+// +kubebuilder:validation:Enum=ConfigMap;Secret;Inline
+type CASourceType string
+
+const (
+	// CASourceConfigMap reads the CA certificate from a ConfigMap in the namespace of the ProxyConfig
+	CASourceConfigMap CASourceType = "ConfigMap"
+
+	// CASourceSecret reads the CA certificate from a Secret in the namespace of the ProxyConfig
+	CASourceSecret CASourceType = "Secret"
+
+	// CASourceInline reads the CA certificate from the ProxyConfig itself
+	CASourceInline CASourceType = "Inline"
+)
+
+// CASource defines where a CA certificate is read from. Exactly one of ConfigMap, Secret and Inline is set, matching Type.
+// The CA certificate is copied into the namespaces of the workloads.
+// +union
+// +kubebuilder:validation:XValidation:rule="self.type == 'ConfigMap' ? has(self.configMap) : !has(self.configMap)",message="configMap must be set when type is ConfigMap, and only then"
+// +kubebuilder:validation:XValidation:rule="self.type == 'Secret' ? has(self.secret) : !has(self.secret)",message="secret must be set when type is Secret, and only then"
+// +kubebuilder:validation:XValidation:rule="self.type == 'Inline' ? has(self.inline) : !has(self.inline)",message="inline must be set when type is Inline, and only then"
+type CASource struct {
+	// Type defines which of ConfigMap, Secret and Inline the CA certificate is read from
+	// +unionDiscriminator
+	Type CASourceType `json:"type"`
+
+	// ConfigMap references the key of a ConfigMap holding the CA certificate
+	// +optional
+	ConfigMap *CAKeyReference `json:"configMap,omitempty"`
+
+	// Secret references the key of a Secret holding the CA certificate
+	// +optional
+	Secret *CAKeyReference `json:"secret,omitempty"`
+
+	// Inline defines the PEM encoded CA certificate
+	// +kubebuilder:validation:XValidation:rule="self.contains('-----BEGIN CERTIFICATE-----')",message="inline must hold PEM encoded certificates"
+	// +kubebuilder:validation:MaxLength=1048576
+	// +optional
+	Inline string `json:"inline,omitempty"`
+}
+
+// CAKeyReference references the key of a ConfigMap or Secret holding a CA certificate
+type CAKeyReference struct {
+	// Name is the name of the ConfigMap or Secret
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Key is the key holding the PEM encoded CA certificate
+	// Defaults to "ca-bundle.crt"
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// Namespace is the namespace of the ConfigMap or Secret.
+	// It is required by ClusterProxyConfigs, ProxyConfigs always read it from their own namespace.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Condition types reported in ProxyConfigStatus.Conditions
+const (
+	// ConditionReady indicates that the proxy configuration was resolved and applied to all targeted workloads
+	ConditionReady = "Ready"
+
+	// ConditionSourceResolved indicates that the proxy configuration could be read from its source
+	ConditionSourceResolved = "SourceResolved"
+
+	// ConditionCACertInjected indicates that the CA certificate was injected into the targeted workloads
+	ConditionCACertInjected = "CACertInjected"
+
+	// ConditionDegraded indicates that one or more workloads could not be listed or injected
+	ConditionDegraded = "Degraded"
+
+	// ConditionEnvConflict indicates that injected containers set proxy environmental variables themselves,
+	// resolved according to spec.conflictPolicy
+	ConditionEnvConflict = "EnvConflict"
+
+	// ConditionSuspended indicates that changes to the workloads, Secrets and ConfigMaps are held back by spec.suspend
+	ConditionSuspended = "Suspended"
+
+	// ConditionConflict indicates that workloads selected by the proxy configuration are injected by another one taking precedence
+	ConditionConflict = "Conflict"
+)
+
+// ProxyConfigStatus defines the observed state of ProxyConfig
+type ProxyConfigStatus struct {
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation of the ProxyConfig that was reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the ProxyConfig's state
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ProxySource is the proxy source that was used, after defaulting.
+	// With InheritFrom, it is the proxy source of the inherited configuration.
+	// +optional
+	ProxySource string `json:"proxySource,omitempty"`
+
+	// InheritedFrom is the cluster-level proxy configuration that was inherited, eg ClusterProxy or ClusterProxyConfig/default
+	// +optional
+	InheritedFrom string `json:"inheritedFrom,omitempty"`
+
+	// EffectiveProxy is the resolved proxy configuration, with any credentials redacted.
+	// With InheritFrom, it is the result of patching the inherited configuration.
+	// +optional
+	EffectiveProxy EffectiveProxy `json:"effectiveProxy,omitempty"`
+
+	// InjectedCount is the number of workloads the proxy configuration was injected into
+	// +optional
+	InjectedCount int32 `json:"injectedCount,omitempty"`
+
+	// Workloads is the per-kind inventory of workloads that were injected or failed
+	// +optional
+	Workloads []WorkloadKindStatus `json:"workloads,omitempty"`
+}
+
+// EffectiveProxy defines the resolved proxy configuration reported in the status
+type EffectiveProxy struct {
+	// HTTPProxy is the resolved HTTP proxy
+	// +optional
+	HTTPProxy string `json:"httpProxy,omitempty"`
+
+	// HTTPSProxy is the resolved HTTPS proxy
+	// +optional
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+
+	// NoProxy is the resolved no proxy configuration
+	// +optional
+	NoProxy []string `json:"noProxy,omitempty"`
+}
+
+// WorkloadKindStatus defines the injection results for a single workload kind
+type WorkloadKindStatus struct {
+	// Kind is the kind of the workloads, eg "Deployment"
+	Kind string `json:"kind"`
+
+	// Injected lists the names of the workloads that were injected
+	// +optional
+	Injected []string `json:"injected,omitempty"`
+
+	// Failed lists the workloads that could not be injected
+	// +optional
+	Failed []WorkloadFailure `json:"failed,omitempty"`
+
+	// Pending lists the workloads whose changes are held back while the proxy configuration is suspended
+	// +optional
+	Pending []string `json:"pending,omitempty"`
+
+	// Decisions reports, for every workload the ProxyConfig targets, whether it is injected and why
+	// +optional
+	Decisions []WorkloadDecision `json:"decisions,omitempty"`
+
+	// EnvConflicts lists the proxy environmental variables the injected workloads set themselves, and how they were resolved
+	// +optional
+	EnvConflicts []EnvConflict `json:"envConflicts,omitempty"`
+
+	// The lists above are cut short once they reach a limit, the counts below hold their full length
+
+	// InjectedCount is the number of workloads that were injected
+	// +optional
+	InjectedCount int32 `json:"injectedCount,omitempty"`
+
+	// FailedCount is the number of workloads that could not be injected
+	// +optional
+	FailedCount int32 `json:"failedCount,omitempty"`
+
+	// PendingCount is the number of workloads whose changes are held back
+	// +optional
+	PendingCount int32 `json:"pendingCount,omitempty"`
+
+	// DecisionCount is the number of workloads the ProxyConfig targets
+	// +optional
+	DecisionCount int32 `json:"decisionCount,omitempty"`
+
+	// EnvConflictCount is the number of proxy environmental variables the injected workloads set themselves
+	// +optional
+	EnvConflictCount int32 `json:"envConflictCount,omitempty"`
+}
+
+// Resolutions reported in EnvConflict.Resolution
+const (
+	// ResolutionOverwritten is reported for variables replaced with the managed ones
+	ResolutionOverwritten = "Overwritten"
+
+	// ResolutionPreserved is reported for variables kept as the container sets them
+	ResolutionPreserved = "Preserved"
+
+	// ResolutionMerged is reported for noProxy variables holding the entries of the container and the managed ones
+	ResolutionMerged = "Merged"
+)
+
+// EnvConflict defines a proxy environmental variable a container sets itself, and how the conflict with the managed one was resolved
+type EnvConflict struct {
+	// Name is the name of the workload
+	Name string `json:"name"`
+
+	// Container is the name of the container setting the variable
+	Container string `json:"container"`
+
+	// Variable is the name of the environmental variable, eg NO_PROXY
+	Variable string `json:"variable"`
+
+	// Source is where the container sets the variable: "env", or the ConfigMap or Secret it reads it from with envFrom
+	Source string `json:"source"`
+
+	// Resolution is either Overwritten, Preserved or Merged
+	Resolution string `json:"resolution"`
+}
+
+// Reasons reported in WorkloadDecision.Reason
+const (
+	// DecisionWorkloadLabel is reported for workloads labeled proxy.k8s.kemo.dev/inject-proxy-env: "true"
+	DecisionWorkloadLabel = "WorkloadLabel"
+
+	// DecisionWorkloadSelector is reported for workloads matching the workloadSelector
+	DecisionWorkloadSelector = "WorkloadSelector"
+
+	// DecisionNamespaceOptIn is reported for workloads in a namespace labeled or annotated proxy.k8s.kemo.dev/inject-proxy-env: "true"
+	DecisionNamespaceOptIn = "NamespaceOptIn"
+
+	// DecisionWorkloadOptOut is reported for otherwise targeted workloads labeled proxy.k8s.kemo.dev/inject-proxy-env: "false"
+	DecisionWorkloadOptOut = "WorkloadOptOut"
+
+	// DecisionOverridden is reported for targeted workloads that another ProxyConfig or ClusterProxyConfig taking precedence injects instead
+	DecisionOverridden = "Overridden"
+)
+
+// WorkloadDecision defines whether a workload is injected, and why
+type WorkloadDecision struct {
+	// Name is the name of the workload
+	Name string `json:"name"`
+
+	// Inject is whether the proxy configuration is injected into the workload
+	Inject bool `json:"inject"`
+
+	// Reason is why the workload is injected or not, eg NamespaceOptIn or WorkloadOptOut
+	Reason string `json:"reason"`
+}
+
+// WorkloadFailure defines a workload that could not be injected
+type WorkloadFailure struct {
+	// Name is the name of the workload
+	Name string `json:"name"`
+
+	// Reason is a human readable description of the failure
+	Reason string `json:"reason"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.proxySource`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Injected",type=integer,JSONPath=`.status.injectedCount`
+//+kubebuilder:printcolumn:name="Priority",type=integer,JSONPath=`.spec.priority`,priority=1
+//+kubebuilder:printcolumn:name="Conflict",type=string,JSONPath=`.status.conditions[?(@.type=="Conflict")].status`,priority=1
+//+kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ProxyConfig is the Schema for the proxyconfigs API
+type ProxyConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ProxyConfigSpec   `json:"spec,omitempty"`
+	Status ProxyConfigStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProxyConfigList contains a list of ProxyConfig
+type ProxyConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ProxyConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ProxyConfig{}, &ProxyConfigList{})
+}
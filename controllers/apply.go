@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// ownedPodTemplate returns the parts of an injected pod template listed in an injection record,
+// or nil when the record holds nothing for it.
+// Only these fields are sent with server-side apply, so the operator doesn't take ownership of the rest of the workload.
+func ownedPodTemplate(template *corev1.PodTemplateSpec, record *injectionRecord) (map[string]interface{}, error) {
+	spec := map[string]interface{}{}
+
+	for _, container := range podContainers(&template.Spec) {
+		owned := map[string]interface{}{"name": container.name}
+
+		env := []interface{}{}
+		for i := range *container.env {
+			e := &(*container.env)[i]
+			if !ContainsString(record.Env[container.name], e.Name) {
+				continue
+			}
+			u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(e)
+			if err != nil {
+				return nil, err
+			}
+			env = append(env, u)
+		}
+		if len(env) > 0 {
+			owned["env"] = env
+		}
+
+		volumeMounts := []interface{}{}
+		for i := range *container.volumeMounts {
+			m := &(*container.volumeMounts)[i]
+			if !ContainsString(record.VolumeMounts[container.name], m.Name) {
+				continue
+			}
+			u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(m)
+			if err != nil {
+				return nil, err
+			}
+			volumeMounts = append(volumeMounts, u)
+		}
+		if len(volumeMounts) > 0 {
+			owned["volumeMounts"] = volumeMounts
+		}
+
+		// Containers are listed by the field holding them, eg initContainers
+		if len(owned) > 1 {
+			containers, _ := spec[container.list].([]interface{})
+			spec[container.list] = append(containers, owned)
+		}
+	}
+
+	volumes := []interface{}{}
+	for i := range template.Spec.Volumes {
+		if !ContainsString(record.Volumes, template.Spec.Volumes[i].Name) {
+			continue
+		}
+		v, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template.Spec.Volumes[i])
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	if len(volumes) > 0 {
+		spec["volumes"] = volumes
+	}
+
+	owned := map[string]interface{}{}
+	if len(spec) > 0 {
+		owned["spec"] = spec
+	}
+
+	annotations := map[string]interface{}{}
+	for _, name := range record.Annotations {
+		if value, ok := template.Annotations[name]; ok {
+			annotations[name] = value
+		}
+	}
+	if len(annotations) > 0 {
+		owned["metadata"] = map[string]interface{}{"annotations": annotations}
+	}
+
+	if len(owned) == 0 {
+		return nil, nil
+	}
+	return owned, nil
+}
+
+// applyConfiguration builds the server-side apply configuration of an injected workload,
+// holding only its injection record annotation and the owned parts of its pod templates
+func (r *ProxyConfigReconciler) applyConfiguration(adapter WorkloadAdapter, workload client.Object, templates []*corev1.PodTemplateSpec, record *injectionRecord) (*unstructured.Unstructured, error) {
+	gvk, err := apiutil.GVKForObject(workload, r.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	applyConfig := &unstructured.Unstructured{}
+	applyConfig.SetGroupVersionKind(gvk)
+	applyConfig.SetNamespace(workload.GetNamespace())
+	applyConfig.SetName(workload.GetName())
+	applyConfig.SetAnnotations(map[string]string{PROXY_INJECTED_ANNOTATION: workload.GetAnnotations()[PROXY_INJECTED_ANNOTATION]})
+
+	// The templates are returned for the paths found in the workload, in order
+	live, err := runtime.DefaultUnstructuredConverter.ToUnstructured(workload)
+	if err != nil {
+		return nil, err
+	}
+	i := 0
+	for _, path := range adapter.PodTemplatePaths() {
+		fields := splitFieldPath(path)
+		if _, found, _ := unstructured.NestedMap(live, fields...); !found || i >= len(templates) {
+			continue
+		}
+		owned, err := ownedPodTemplate(templates[i], record)
+		if err != nil {
+			return nil, err
+		}
+		i++
+		if owned == nil {
+			continue
+		}
+		if err = unstructured.SetNestedMap(applyConfig.Object, owned, fields...); err != nil {
+			return nil, err
+		}
+	}
+	return applyConfig, nil
+}
+
+// writeWorkload writes an injected workload to the API server, live being the workload as it was read.
+// Typed workloads are written with server-side apply, so only the injected fields are owned by the operator.
+// Custom resources are patched instead, since their schemas don't mark the container lists as mergeable
+// and an apply would replace them. So are workloads whose environmental variables can't be applied over, see needsUpdate.
+func (r *ProxyConfigReconciler) writeWorkload(ctx context.Context, adapter WorkloadAdapter, live client.Object, workload client.Object, templates []*corev1.PodTemplateSpec, record *injectionRecord) error {
+	if _, ok := workload.(*unstructured.Unstructured); ok {
+		return r.patchWorkload(ctx, live, workload)
+	}
+	update, err := needsUpdate(adapter, live, templates)
+	if err != nil {
+		return err
+	}
+	if update {
+		lggr.Info("Patching "+adapter.Kind()+" instead of applying it, its environmental variables change shape", adapter.Kind()+".Namespace", workload.GetNamespace(), adapter.Kind()+".Name", workload.GetName())
+		return r.patchWorkload(ctx, live, workload)
+	}
+
+	applyConfig, err := r.applyConfiguration(adapter, workload, templates, record)
+	if err != nil {
+		return err
+	}
+	return r.Patch(ctx, applyConfig, client.Apply, client.ForceOwnership, client.FieldOwner(FIELD_MANAGER))
+}
+
+// patchWorkload writes the changes made to a workload since it was read as live, for the writes server-side apply can't make.
+// Typed workloads get a strategic merge patch, which merges the containers, variables, volumes and mounts by name and
+// only holds the entries that changed. Custom resources get a JSON merge patch, which replaces the lists that changed.
+// Both carry the resourceVersion of live, so they fail with a conflict, and are retried, instead of overwriting
+// the changes other field managers made in the meantime.
+func (r *ProxyConfigReconciler) patchWorkload(ctx context.Context, live client.Object, workload client.Object) error {
+	var patch client.Patch
+	if _, ok := workload.(*unstructured.Unstructured); ok {
+		patch = client.MergeFromWithOptions(live, client.MergeFromWithOptimisticLock{})
+	} else {
+		patch = client.StrategicMergeFrom(live, client.MergeFromWithOptimisticLock{})
+	}
+	return r.Patch(ctx, workload, patch, client.FieldOwner(FIELD_MANAGER))
+}
+
+// needsUpdate returns whether the injected pod templates of a workload can't be applied over its live ones.
+// Server-side apply only sets the fields it sends and leaves the fields owned by other managers, so a variable set
+// by the container itself as a literal value and overwritten with a Secret reference would end up with both, which
+// the API server rejects. The same goes for a reference restored to a literal value, or a variable that is removed
+// but also owned by an earlier write. A patch removes the field that no longer applies instead.
+func needsUpdate(adapter WorkloadAdapter, live client.Object, templates []*corev1.PodTemplateSpec) (bool, error) {
+	liveTemplates, err := adapter.GetPodTemplates(live)
+	if err != nil {
+		return false, err
+	}
+	for i := range liveTemplates {
+		if i >= len(templates) {
+			break
+		}
+		desired := map[string]podContainer{}
+		for _, container := range podContainers(&templates[i].Spec) {
+			desired[container.list+"/"+container.name] = container
+		}
+		for _, container := range podContainers(&liveTemplates[i].Spec) {
+			injected, ok := desired[container.list+"/"+container.name]
+			if !ok {
+				continue
+			}
+			for _, e := range *container.env {
+				j := envVarIndex(*injected.env, e.Name)
+				if j < 0 || envVarShape(e) != envVarShape((*injected.env)[j]) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// envVarShape returns which field holds the value of an environmental variable, eg "value" or "secretKeyRef"
+func envVarShape(e corev1.EnvVar) string {
+	switch {
+	case e.ValueFrom == nil:
+		return "value"
+	case e.ValueFrom.SecretKeyRef != nil:
+		return "secretKeyRef"
+	case e.ValueFrom.ConfigMapKeyRef != nil:
+		return "configMapKeyRef"
+	case e.ValueFrom.FieldRef != nil:
+		return "fieldRef"
+	case e.ValueFrom.ResourceFieldRef != nil:
+		return "resourceFieldRef"
+	}
+	return ""
+}
+
+// getWorkload reads a workload again, from the cache when its kind is watched
+func (r *ProxyConfigReconciler) getWorkload(ctx context.Context, adapter WorkloadAdapter, key client.ObjectKey) (client.Object, error) {
+	var reader client.Reader = r.APIReader
+	if r.watchedKinds[adapter.Kind()] {
+		reader = r.Client
+	}
+	workload := adapter.NewObject()
+	if err := reader.Get(ctx, key, workload); err != nil {
+		return nil, err
+	}
+	return workload, nil
+}
+
+// retryOnConflict calls fn with the workload, reading the workload again and backing off whenever fn fails with a conflict
+func (r *ProxyConfigReconciler) retryOnConflict(ctx context.Context, adapter WorkloadAdapter, workload client.Object, fn func(workload client.Object) error) error {
+	key := client.ObjectKeyFromObject(workload)
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if workload == nil {
+			fresh, err := r.getWorkload(ctx, adapter, key)
+			if err != nil {
+				return err
+			}
+			workload = fresh
+		}
+		err := fn(workload)
+		if errors.IsConflict(err) {
+			lggr.Info("Conflict writing "+adapter.Kind()+", retrying", adapter.Kind()+".Namespace", key.Namespace, adapter.Kind()+".Name", key.Name)
+			workload = nil
+		}
+		return err
+	})
+}
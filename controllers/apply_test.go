@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// newTestDeployment returns a Deployment with a single container setting the environmental variables
+func newTestDeployment(name string, env ...corev1.EnvVar) *appsv1.Deployment {
+	labels := map[string]string{"app": name}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{PROXY_INJECTION_LABEL: "true"}},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "registry.example.com/app:latest", Env: env}},
+				},
+			},
+		},
+	}
+}
+
+// testInjectionOptions returns the options injecting an HTTP proxy from the proxy Secret of a test ProxyConfig
+func testInjectionOptions(policy proxyv1beta1.ConflictPolicy) injectionOptions {
+	return injectionOptions{
+		proxySecretName: proxyConfigOwner("test").proxySecretName(),
+		proxy:           proxyv1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128", NoProxy: []string{".cluster.local"}},
+		conflictPolicy:  policy,
+	}
+}
+
+var _ = Describe("Writing injected workloads", func() {
+	owner := proxyConfigOwner("test")
+
+	Context("when a container sets a proxy variable itself", func() {
+		It("updates the workload instead of applying it when the literal value is overwritten", func() {
+			live := newTestDeployment("literal", corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"})
+			workload := live.DeepCopy()
+			templates, _, err := mutateWorkload(DeploymentAdapter, workload, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite), owner)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(needsUpdate(DeploymentAdapter, live, templates)).To(BeTrue())
+		})
+
+		It("applies the workload when the variables keep their shape", func() {
+			live := newTestDeployment("preserved", corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"})
+			workload := live.DeepCopy()
+			templates, _, err := mutateWorkload(DeploymentAdapter, workload, testInjectionOptions(proxyv1beta1.ConflictPolicyPreserve), owner)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(needsUpdate(DeploymentAdapter, live, templates)).To(BeFalse())
+		})
+	})
+
+	Context("with an API server", func() {
+		It("replaces a literal value set by the user with the Secret reference", func() {
+			ctx := context.Background()
+			deployment := newTestDeployment("apply-over-literal", corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"})
+			Expect(k8sClient.Create(ctx, deployment, client.FieldOwner("user"))).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, deployment))).To(Succeed())
+			})
+
+			r := &ProxyConfigReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			_, err := r.injectPodTemplates(ctx, DeploymentAdapter, deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite), owner)
+			Expect(err).NotTo(HaveOccurred())
+
+			injected := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), injected)).To(Succeed())
+			env := injected.Spec.Template.Spec.Containers[0].Env
+			i := envVarIndex(env, "HTTP_PROXY")
+			Expect(i).To(BeNumerically(">=", 0))
+			Expect(env[i].Value).To(BeEmpty())
+			Expect(env[i].ValueFrom).NotTo(BeNil())
+			Expect(env[i].ValueFrom.SecretKeyRef.Name).To(Equal(owner.proxySecretName()))
+
+			// Applying again keeps the injected reference
+			_, err = r.injectPodTemplates(ctx, DeploymentAdapter, injected, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite), owner)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("doesn't overwrite the changes made since the workload was read", func() {
+			ctx := context.Background()
+			deployment := newTestDeployment("patch-conflict", corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"})
+			Expect(k8sClient.Create(ctx, deployment, client.FieldOwner("user"))).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, deployment))).To(Succeed())
+			})
+
+			// Another field manager scales the Deployment after the operator read it
+			scaled := deployment.DeepCopy()
+			replicas := int32(3)
+			scaled.Spec.Replicas = &replicas
+			Expect(k8sClient.Update(ctx, scaled, client.FieldOwner("user"))).To(Succeed())
+
+			r := &ProxyConfigReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			_, err := r.injectPodTemplates(ctx, DeploymentAdapter, deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite), owner)
+			Expect(errors.IsConflict(err)).To(BeTrue(), "expected a conflict, got %v", err)
+
+			current := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), current)).To(Succeed())
+			Expect(*current.Spec.Replicas).To(Equal(replicas))
+		})
+
+		It("patches custom resources, keeping the entries of their own", func() {
+			ctx := context.Background()
+			deployment := newTestDeployment("patch-unstructured", corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"})
+			deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{Name: "sidecar", Image: "registry.example.com/sidecar:latest"})
+			Expect(k8sClient.Create(ctx, deployment, client.FieldOwner("user"))).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, deployment))).To(Succeed())
+			})
+
+			// Deployments read as unstructured objects stand in for a custom resource from the workload config
+			adapter := NewUnstructuredAdapter(GenericWorkload{Group: "apps", Version: "v1", Kind: "Deployment", PodTemplatePaths: []string{"spec.template"}})
+			workload := &unstructured.Unstructured{}
+			workload.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), workload)).To(Succeed())
+
+			r := &ProxyConfigReconciler{Client: k8sClient, APIReader: k8sClient, Scheme: scheme.Scheme}
+			opts := testInjectionOptions("")
+			opts.containers = containerFilter{include: []string{"app"}}
+			_, err := r.injectPodTemplates(ctx, adapter, workload, opts, owner)
+			Expect(err).NotTo(HaveOccurred())
+
+			injected := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), injected)).To(Succeed())
+			containers := injected.Spec.Template.Spec.Containers
+			Expect(containers).To(HaveLen(2))
+			Expect(envVarIndex(containers[0].Env, "LOG_LEVEL")).To(BeNumerically(">=", 0))
+			Expect(envVarIndex(containers[0].Env, "HTTP_PROXY")).To(BeNumerically(">=", 0))
+			Expect(containers[1].Env).To(BeEmpty())
+
+			Expect(r.stripWorkload(ctx, adapter, workload)).To(Succeed())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), injected)).To(Succeed())
+			Expect(injected.Spec.Template.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}))
+			Expect(injected.Annotations).NotTo(HaveKey(PROXY_INJECTED_ANNOTATION))
+		})
+	})
+})
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// caCertOptions defines how the CA certificate ConfigMap is mounted into a workload
+type caCertOptions struct {
+	configMapName string
+	configMapKey  string
+	mountPath     string
+}
+
+// workloadCACertOptions returns the CA certificate options of a workload, taking its overrides into account.
+// It returns nil when the workload opted out of the CA certificate injection.
+func workloadCACertOptions(workload client.Object, overrides workloadOverrides, owner configOwner) *caCertOptions {
+	if workload.GetLabels()[PROXY_CA_CERT_INJECTION_LABEL] == "false" {
+		return nil
+	}
+	return &caCertOptions{
+		configMapName: SetDefaultString(owner.caCertConfigMapName(), overrides.caCertConfigMapName),
+		configMapKey:  SetDefaultString(PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY, overrides.caCertConfigMapKey),
+		mountPath:     SetDefaultString(PROXY_CA_CERT_MOUNT_PATH, overrides.caCertMountPath),
+	}
+}
+
+// caCertVolume returns the ConfigMap volume holding the CA certificate
+func caCertVolume(caCert *caCertOptions) corev1.Volume {
+	return corev1.Volume{
+		Name: PROXY_CA_CERT_VOLUME_NAME,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: caCert.configMapName},
+				Items: []corev1.KeyToPath{
+					{Key: caCert.configMapKey, Path: PROXY_CA_CERT_FILE_NAME},
+				},
+			},
+		},
+	}
+}
+
+// caCertVolumeMount returns the mount of the CA certificate volume
+func caCertVolumeMount(caCert *caCertOptions) corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      PROXY_CA_CERT_VOLUME_NAME,
+		MountPath: caCert.mountPath,
+		ReadOnly:  true,
+	}
+}
+
+func createOrUpdateVolume(volumes []corev1.Volume, volume corev1.Volume) []corev1.Volume {
+	// Loop through the volumes
+	// If the volume exists, update it
+	// If the volume doesn't exist, append it
+
+	for i, v := range volumes {
+		if v.Name == volume.Name {
+			volumes[i] = volume
+			return volumes
+		}
+	}
+	return append(volumes, volume)
+}
+
+func createOrUpdateVolumeMount(volumeMounts []corev1.VolumeMount, volumeMount corev1.VolumeMount) ([]corev1.VolumeMount, error) {
+	// Loop through the volumeMounts
+	// If the volumeMount exists, update it
+	// If another volume is already mounted at the same path, fail rather than producing an invalid pod
+
+	for i, m := range volumeMounts {
+		if m.Name == volumeMount.Name {
+			volumeMounts[i] = volumeMount
+			return volumeMounts, nil
+		}
+	}
+	for _, m := range volumeMounts {
+		if m.MountPath == volumeMount.MountPath {
+			return volumeMounts, fmt.Errorf("volume %s is already mounted at %s", m.Name, m.MountPath)
+		}
+	}
+	return append(volumeMounts, volumeMount), nil
+}
+
+// injectCACert mounts the CA certificate volume into a container
+func injectCACert(container podContainer, caCert *caCertOptions, record *injectionRecord) error {
+	volumeMounts, err := createOrUpdateVolumeMount(*container.volumeMounts, caCertVolumeMount(caCert))
+	if err != nil {
+		return fmt.Errorf("container %s: %w", container.name, err)
+	}
+	*container.volumeMounts = volumeMounts
+	record.addVolumeMount(container.name, PROXY_CA_CERT_VOLUME_NAME)
+	return nil
+}
+
+// ensureCACertConfigMap makes sure the CA certificate ConfigMap mounted into a workload exists in its namespace
+func (r *ProxyConfigReconciler) ensureCACertConfigMap(ctx context.Context, namespace string, caCert *caCertOptions, resolved resolvedProxyConfig, owner configOwner) error {
+	if resolved.caSource == "openshift" {
+		return createOpenShiftCACertConfigMap(r.Client, ctx, lggr, caCert.configMapName, namespace, owner)
+	}
+	return createCustomCACertConfigMap(r.Client, ctx, lggr, caCert.configMapName, namespace, caCert.configMapKey, resolved.caBundle, owner)
+}
+
+// createCustomCACertConfigMap creates or updates a ConfigMap holding a copy of the CA certificate of the "custom" proxy source.
+// An existing ConfigMap is only updated when it was created for the owner, a notOwnedError is returned otherwise.
+func createCustomCACertConfigMap(cl client.Client, ctx context.Context, log logr.Logger, configMapName string, configMapNamespace string, configMapKey string, caBundle string, owner configOwner) error {
+	existing := corev1.ConfigMap{}
+
+	// Check to see if the ConfigMap already exists
+	err := cl.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: configMapNamespace}, &existing)
+	if errors.IsNotFound(err) {
+		// ConfigMap doesn't exist, create it
+		cm := corev1.ConfigMap{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "ConfigMap",
+				APIVersion: "v1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      configMapName,
+				Namespace: configMapNamespace,
+				Labels:    owner.ownerLabels(),
+			},
+			Data: map[string]string{
+				configMapKey: caBundle,
+			},
+		}
+		if err = cl.Create(ctx, &cm); err != nil {
+			log.Error(err, "Failed to create ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+			return err
+		}
+		log.Info("Created ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return nil
+	} else if err != nil {
+		log.Error(err, "Failed to get ConfigMap", "ConfigMap.Namespace", configMapNamespace, "ConfigMap.Name", configMapName)
+		return err
+	}
+
+	// ConfigMap already exists, eg one named by the ca-cert-configmap-name annotation of a workload
+	if !isOwnedBy(&existing, owner) {
+		return &notOwnedError{kind: "ConfigMap", obj: &existing, owner: owner}
+	}
+	// Check to see if it needs to be updated
+	if existing.Data[configMapKey] == caBundle && existing.Labels[TRUSTED_CA_BUNDLE_LABEL] != "true" {
+		log.Info("ConfigMap already exists and is up to date", "ConfigMap.Namespace", existing.Namespace, "ConfigMap.Name", existing.Name)
+		return nil
+	}
+	if existing.Data == nil {
+		existing.Data = map[string]string{}
+	}
+	existing.Data[configMapKey] = caBundle
+	// The Cluster Network Operator would overwrite the copied CA certificate. The label was set by the operator,
+	// when the ConfigMap was created for the "openshift" proxy source.
+	delete(existing.Labels, TRUSTED_CA_BUNDLE_LABEL)
+
+	if err = cl.Update(ctx, &existing); err != nil {
+		log.Error(err, "Failed to update ConfigMap", "ConfigMap.Namespace", existing.Namespace, "ConfigMap.Name", existing.Name)
+		return err
+	}
+	log.Info("Reconciled ConfigMap", "ConfigMap.Namespace", existing.Namespace, "ConfigMap.Name", existing.Name)
+	return nil
+}
@@ -0,0 +1,734 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// injectionRecord tracks exactly what the operator added to the pod templates of a workload,
+// so it can be removed again when the workload opts out or its ProxyConfig is deleted.
+// It is stored as JSON in the PROXY_INJECTED_ANNOTATION of the workload.
+type injectionRecord struct {
+	// ProxyConfig is the name of the ProxyConfig that injected the workload
+	ProxyConfig string `json:"proxyConfig"`
+	// ClusterProxyConfig is the name of the ClusterProxyConfig that injected the workload, instead of a ProxyConfig
+	ClusterProxyConfig string `json:"clusterProxyConfig,omitempty"`
+	// Env maps container names to the environmental variables added to them
+	Env map[string][]string `json:"env,omitempty"`
+	// Volumes lists the volumes added to the pod templates
+	Volumes []string `json:"volumes,omitempty"`
+	// VolumeMounts maps container names to the volumes mounted into them
+	VolumeMounts map[string][]string `json:"volumeMounts,omitempty"`
+	// Annotations lists the annotations added to the pod templates
+	Annotations []string `json:"annotations,omitempty"`
+	// Originals maps container names to the environmental variables they set themselves, that were overwritten
+	// or that the managed noProxy entries were merged into. They are restored instead of removed.
+	Originals map[string]map[string]corev1.EnvVar `json:"originals,omitempty"`
+
+	// ConflictsHash is a hash of the proxy environmental variables the containers set themselves,
+	// so the events reporting them are only recorded again once they change
+	ConflictsHash string `json:"conflictsHash,omitempty"`
+	// OverridesHash is a hash of the invalid override values and deprecated override labels of the workload,
+	// so they are only reported again once they change
+	OverridesHash string `json:"overridesHash,omitempty"`
+
+	// conflicts lists the proxy environmental variables the containers set themselves, it isn't stored
+	conflicts []proxyv1beta1.EnvConflict
+	// conflictsChanged is set when the conflicts differ from the ones of the previous record
+	conflictsChanged bool
+	// overridesChanged is set when the invalid overrides and deprecated labels differ from the ones of the previous record
+	overridesChanged bool
+}
+
+func newInjectionRecord(owner configOwner) *injectionRecord {
+	record := &injectionRecord{Env: map[string][]string{}, VolumeMounts: map[string][]string{}}
+	if owner.clusterScoped {
+		record.ClusterProxyConfig = owner.name
+	} else {
+		record.ProxyConfig = owner.name
+	}
+	return record
+}
+
+// owner returns the ProxyConfig or ClusterProxyConfig that injected the workload
+func (r *injectionRecord) owner() configOwner {
+	if r.ClusterProxyConfig != "" {
+		return clusterProxyConfigOwner(r.ClusterProxyConfig)
+	}
+	return proxyConfigOwner(r.ProxyConfig)
+}
+
+func (r *injectionRecord) addEnv(container string, name string) {
+	if !ContainsString(r.Env[container], name) {
+		r.Env[container] = append(r.Env[container], name)
+	}
+}
+
+// hasEnv returns whether an environmental variable was added to a container, the record may be nil
+func (r *injectionRecord) hasEnv(container string, name string) bool {
+	return r != nil && ContainsString(r.Env[container], name)
+}
+
+// addOriginal records an environmental variable as a container set it, before it was overwritten or merged into
+func (r *injectionRecord) addOriginal(container string, envVar corev1.EnvVar) {
+	if r.Originals == nil {
+		r.Originals = map[string]map[string]corev1.EnvVar{}
+	}
+	if r.Originals[container] == nil {
+		r.Originals[container] = map[string]corev1.EnvVar{}
+	}
+	r.Originals[container][envVar.Name] = envVar
+}
+
+// original returns an environmental variable as a container set it, before it was overwritten or merged into.
+// The record may be nil.
+func (r *injectionRecord) original(container string, name string) (corev1.EnvVar, bool) {
+	if r == nil {
+		return corev1.EnvVar{}, false
+	}
+	envVar, ok := r.Originals[container][name]
+	return envVar, ok
+}
+
+// addEnvConflict records a proxy environmental variable a container sets itself, once
+func (r *injectionRecord) addEnvConflict(conflict proxyv1beta1.EnvConflict) {
+	for _, c := range r.conflicts {
+		if c == conflict {
+			return
+		}
+	}
+	r.conflicts = append(r.conflicts, conflict)
+}
+
+// hashConflicts sets the ConflictsHash from the recorded conflicts, and whether they changed since a previous record
+func (r *injectionRecord) hashConflicts(previous *injectionRecord) {
+	r.ConflictsHash = ""
+	if len(r.conflicts) > 0 {
+		r.ConflictsHash = recordHash(r.conflicts)
+	}
+	r.conflictsChanged = previous == nil || previous.ConflictsHash != r.ConflictsHash
+}
+
+// hashOverrides sets the OverridesHash from the invalid override values and deprecated override labels of a workload,
+// and whether they changed since a previous record
+func (r *injectionRecord) hashOverrides(overrides workloadOverrides, previous *injectionRecord) {
+	r.OverridesHash = ""
+	if len(overrides.invalid) > 0 || len(overrides.deprecated) > 0 {
+		r.OverridesHash = recordHash([][]string{overrides.invalid, overrides.deprecated})
+	}
+	r.overridesChanged = previous == nil || previous.OverridesHash != r.OverridesHash
+}
+
+// recordHash returns a short hash of the JSON form of a value
+func recordHash(v interface{}) string {
+	data, _ := json.Marshal(v)
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])[:16]
+}
+
+func (r *injectionRecord) addVolume(name string) {
+	if !ContainsString(r.Volumes, name) {
+		r.Volumes = append(r.Volumes, name)
+	}
+}
+
+func (r *injectionRecord) addAnnotation(name string) {
+	if !ContainsString(r.Annotations, name) {
+		r.Annotations = append(r.Annotations, name)
+	}
+}
+
+func (r *injectionRecord) addVolumeMount(container string, name string) {
+	if !ContainsString(r.VolumeMounts[container], name) {
+		r.VolumeMounts[container] = append(r.VolumeMounts[container], name)
+	}
+}
+
+// subtract returns the entries of the record that are not part of other
+func (r *injectionRecord) subtract(other *injectionRecord) *injectionRecord {
+	stale := newInjectionRecord(r.owner())
+	for container, names := range r.Env {
+		for _, name := range names {
+			if !ContainsString(other.Env[container], name) {
+				stale.addEnv(container, name)
+				if original, ok := r.original(container, name); ok {
+					stale.addOriginal(container, original)
+				}
+			}
+		}
+	}
+	for _, name := range r.Volumes {
+		if !ContainsString(other.Volumes, name) {
+			stale.addVolume(name)
+		}
+	}
+	for container, names := range r.VolumeMounts {
+		for _, name := range names {
+			if !ContainsString(other.VolumeMounts[container], name) {
+				stale.addVolumeMount(container, name)
+			}
+		}
+	}
+	for _, name := range r.Annotations {
+		if !ContainsString(other.Annotations, name) {
+			stale.addAnnotation(name)
+		}
+	}
+	return stale
+}
+
+// readInjectionRecord returns the injection record of a workload, or nil when it was not injected
+func readInjectionRecord(workload client.Object) (*injectionRecord, error) {
+	value, ok := workload.GetAnnotations()[PROXY_INJECTED_ANNOTATION]
+	if !ok {
+		return nil, nil
+	}
+	record := newInjectionRecord(configOwner{})
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", PROXY_INJECTED_ANNOTATION, err)
+	}
+	return record, nil
+}
+
+// writeInjectionRecord stores the injection record in the annotations of a workload
+func writeInjectionRecord(workload client.Object, record *injectionRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	annotations := workload.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[PROXY_INJECTED_ANNOTATION] = string(value)
+	workload.SetAnnotations(annotations)
+	return nil
+}
+
+// removeInjectionRecord removes the injection record from the annotations of a workload
+func removeInjectionRecord(workload client.Object) {
+	annotations := workload.GetAnnotations()
+	delete(annotations, PROXY_INJECTED_ANNOTATION)
+	workload.SetAnnotations(annotations)
+}
+
+// stripPodTemplate removes the entries of an injection record from a pod template
+func stripPodTemplate(template *corev1.PodTemplateSpec, record *injectionRecord) {
+	for _, name := range record.Annotations {
+		delete(template.Annotations, name)
+	}
+
+	podSpec := &template.Spec
+	for _, container := range podContainers(podSpec) {
+		env := []corev1.EnvVar{}
+		for _, e := range *container.env {
+			if original, ok := record.original(container.name, e.Name); ok {
+				// Restore the variable as the container set it
+				env = append(env, original)
+			} else if !ContainsString(record.Env[container.name], e.Name) {
+				env = append(env, e)
+			}
+		}
+		*container.env = env
+
+		volumeMounts := []corev1.VolumeMount{}
+		for _, m := range *container.volumeMounts {
+			if !ContainsString(record.VolumeMounts[container.name], m.Name) {
+				volumeMounts = append(volumeMounts, m)
+			}
+		}
+		*container.volumeMounts = volumeMounts
+	}
+
+	volumes := []corev1.Volume{}
+	for _, v := range podSpec.Volumes {
+		if !ContainsString(record.Volumes, v.Name) {
+			volumes = append(volumes, v)
+		}
+	}
+	podSpec.Volumes = volumes
+}
+
+// stripWorkload removes everything the operator injected into a workload, along with its injection record.
+// The workload is patched rather than applied, so entries injected before server-side apply was used are removed too,
+// and the variables the containers set themselves can be restored over the Secret references, see patchWorkload.
+func (r *ProxyConfigReconciler) stripWorkload(ctx context.Context, adapter WorkloadAdapter, workload client.Object) error {
+	kind := adapter.Kind()
+
+	err := r.retryOnConflict(ctx, adapter, workload, func(workload client.Object) error {
+		record, err := readInjectionRecord(workload)
+		if err != nil || record == nil {
+			return err
+		}
+
+		live := workload.DeepCopyObject().(client.Object)
+		templates, err := adapter.GetPodTemplates(workload)
+		if err != nil {
+			return err
+		}
+		for _, template := range templates {
+			stripPodTemplate(template, record)
+		}
+		if err = adapter.SetPodTemplates(workload, templates); err != nil {
+			return err
+		}
+		removeInjectionRecord(workload)
+		return r.patchWorkload(ctx, live, workload)
+	})
+	if err != nil {
+		lggr.Error(err, "Failed to remove the proxy configuration from "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+		return err
+	}
+	lggr.Info("Removed the proxy configuration from "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+	return nil
+}
+
+// stripOptedOutWorkloads removes the proxy configuration from the workloads in a namespace, or in every namespace when it is empty,
+// that an owner injected but no longer selects, eg after the injection label was removed or set to "false",
+// or the kind was dropped from its kinds. It returns the workloads that were stripped, or would have been with dryRun.
+func (r *ProxyConfigReconciler) stripOptedOutWorkloads(ctx context.Context, adapter WorkloadAdapter, namespace string, owner configOwner, selects func(workload client.Object) (bool, error), dryRun bool) ([]client.Object, error) {
+	workloads, err := r.listInjectedWorkloads(ctx, adapter, namespace, owner)
+	if err != nil {
+		return nil, err
+	}
+	stripped := []client.Object{}
+	for _, workload := range workloads {
+		inject, err := selects(workload)
+		if err != nil {
+			return stripped, err
+		}
+		if inject {
+			continue
+		}
+		if !dryRun {
+			if err = r.stripWorkload(ctx, adapter, workload); err != nil {
+				return stripped, err
+			}
+		}
+		stripped = append(stripped, workload)
+	}
+	return stripped, nil
+}
+
+// cleanupOwner removes the proxy configuration from every workload an owner injected, and deletes the Secrets and ConfigMaps
+// it created, in a namespace or in every namespace when it is empty
+func (r *ProxyConfigReconciler) cleanupOwner(ctx context.Context, namespace string, owner configOwner) error {
+	for _, adapter := range r.Workloads.Adapters() {
+		workloads, err := r.listInjectedWorkloads(ctx, adapter, namespace, owner)
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, workload := range workloads {
+			if err = r.stripWorkload(ctx, adapter, workload); err != nil {
+				return err
+			}
+		}
+	}
+	return r.deleteOwnedObjects(ctx, owner, func(obj client.Object) bool {
+		return namespace == "" || obj.GetNamespace() == namespace
+	})
+}
+
+// deleteWorkloadProxySecret deletes the proxy Secret created for a workload that no longer overrides the proxy configuration, if any
+func (r *ProxyConfigReconciler) deleteWorkloadProxySecret(ctx context.Context, namespace string, name string, owner configOwner) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !isOwnedBy(secret, owner) {
+		return nil
+	}
+	if err := r.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		lggr.Error(err, "Failed to delete Secret", "Secret.Namespace", namespace, "Secret.Name", name)
+		return err
+	}
+	lggr.Info("Deleted Secret", "Secret.Namespace", namespace, "Secret.Name", name)
+	return nil
+}
+
+// deleteOwnedObjects deletes the Secrets and ConfigMaps created for an owner that match a filter
+func (r *ProxyConfigReconciler) deleteOwnedObjects(ctx context.Context, owner configOwner, filter func(obj client.Object) bool) error {
+	ownedBy := client.MatchingLabels(owner.ownerLabels())
+
+	secretList := &corev1.SecretList{}
+	if err := r.List(ctx, secretList, ownedBy); err != nil {
+		return err
+	}
+	for i := range secretList.Items {
+		if !filter(&secretList.Items[i]) {
+			continue
+		}
+		if err := r.Delete(ctx, &secretList.Items[i]); err != nil && !errors.IsNotFound(err) {
+			lggr.Error(err, "Failed to delete Secret", "Secret.Namespace", secretList.Items[i].Namespace, "Secret.Name", secretList.Items[i].Name)
+			return err
+		}
+		lggr.Info("Deleted Secret", "Secret.Namespace", secretList.Items[i].Namespace, "Secret.Name", secretList.Items[i].Name)
+	}
+
+	configMapList := &corev1.ConfigMapList{}
+	if err := r.List(ctx, configMapList, ownedBy); err != nil {
+		return err
+	}
+	for i := range configMapList.Items {
+		if !filter(&configMapList.Items[i]) {
+			continue
+		}
+		if err := r.Delete(ctx, &configMapList.Items[i]); err != nil && !errors.IsNotFound(err) {
+			lggr.Error(err, "Failed to delete ConfigMap", "ConfigMap.Namespace", configMapList.Items[i].Namespace, "ConfigMap.Name", configMapList.Items[i].Name)
+			return err
+		}
+		lggr.Info("Deleted ConfigMap", "ConfigMap.Namespace", configMapList.Items[i].Namespace, "ConfigMap.Name", configMapList.Items[i].Name)
+	}
+	return nil
+}
+
+// isLegacyProxySecret returns whether a Secret is the proxy Secret shared by all workloads of a namespace, as created
+// before every ProxyConfig got its own. It carries no labels or owner references, and only the proxy keys.
+func isLegacyProxySecret(secret *corev1.Secret) bool {
+	if secret.Name != PROXY_INJECTION_SECRET_DEFAULT_NAME || len(secret.Labels) > 0 || len(secret.OwnerReferences) > 0 || len(secret.Data) != 3 {
+		return false
+	}
+	for _, key := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		if _, ok := secret.Data[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isLegacyInjectedEnvVar returns whether an environmental variable reads the legacy shared proxy Secret, ie it was
+// injected before every ProxyConfig got its own Secret and is replaced instead of treated as set by the container
+func isLegacyInjectedEnvVar(envVar corev1.EnvVar) bool {
+	return envVar.ValueFrom != nil && envVar.ValueFrom.SecretKeyRef != nil && envVar.ValueFrom.SecretKeyRef.Name == PROXY_INJECTION_SECRET_DEFAULT_NAME
+}
+
+// podSpecReadsSecret returns whether a pod spec reads a Secret in its environmental variables or volumes
+func podSpecReadsSecret(spec *corev1.PodSpec, name string) bool {
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == name {
+			return true
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range containers {
+		for _, envVar := range container.Env {
+			if envVar.ValueFrom != nil && envVar.ValueFrom.SecretKeyRef != nil && envVar.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// secretReaders returns the Pods, Jobs and workloads in the namespace of a Secret whose pod templates read it.
+// They are listed from the API server, since Pods and Jobs aren't cached.
+func (r *ProxyConfigReconciler) secretReaders(ctx context.Context, secret *corev1.Secret) ([]client.Object, error) {
+	readers := []client.Object{}
+	reader := &pagedReader{r.APIReader}
+	for _, adapter := range append([]WorkloadAdapter{PodAdapter, JobAdapter}, r.Workloads.Adapters()...) {
+		workloads, err := adapter.List(ctx, reader, client.InNamespace(secret.Namespace))
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if readers, err = appendSecretReaders(readers, adapter, workloads, secret.Name); err != nil {
+			return nil, err
+		}
+	}
+	return readers, nil
+}
+
+// appendSecretReaders appends the workloads of a kind whose pod templates read a Secret to readers
+func appendSecretReaders(readers []client.Object, adapter WorkloadAdapter, workloads []client.Object, secretName string) ([]client.Object, error) {
+	for _, workload := range workloads {
+		templates, err := adapter.GetPodTemplates(workload)
+		if err != nil {
+			return nil, err
+		}
+		for _, template := range templates {
+			if podSpecReadsSecret(&template.Spec, secretName) {
+				readers = append(readers, workload)
+				break
+			}
+		}
+	}
+	return readers, nil
+}
+
+// readsLegacyProxySecret returns whether the containers of a workload read the legacy shared proxy Secret through the
+// environmental variables the operator injected before every ProxyConfig got its own Secret
+func readsLegacyProxySecret(adapter WorkloadAdapter, workload client.Object) bool {
+	templates, err := adapter.GetPodTemplates(workload)
+	if err != nil {
+		return false
+	}
+	for _, template := range templates {
+		for _, container := range podContainers(&template.Spec) {
+			for _, envVar := range *container.env {
+				if isLegacyInjectedEnvVar(envVar) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// markLegacyProxySecret annotates the legacy shared proxy Secret of a namespace as migrated by an owner, once a workload
+// the operator injected from it was migrated, which proves the operator created it
+func (r *ProxyConfigReconciler) markLegacyProxySecret(ctx context.Context, namespace string, owner configOwner) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME, Namespace: namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !isLegacyProxySecret(secret) || secret.Annotations[PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION] != "" {
+		return nil
+	}
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION] = owner.String()
+	lggr.Info("Marking the legacy proxy Secret as migrated", "Secret.Namespace", namespace, "Secret.Name", secret.Name)
+	return r.Patch(ctx, secret, patch)
+}
+
+// deleteLegacyProxySecret deletes the legacy shared proxy Secret of a namespace once no workload or Pod reads it anymore.
+// Only a Secret marked as migrated is deleted, one the operator can't tell it created is kept and reported with an event.
+// The workloads and Pods are only listed while the Secret exists, ie until every workload was migrated.
+func (r *ProxyConfigReconciler) deleteLegacyProxySecret(ctx context.Context, namespace string) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME, Namespace: namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !isLegacyProxySecret(secret) {
+		return nil
+	}
+	if secret.Annotations[PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION] == "" {
+		if r.Recorder != nil {
+			r.Recorder.Event(secret, corev1.EventTypeNormal, EVENT_REASON_LEGACY_SECRET_KEPT,
+				"Kept the legacy proxy Secret, no workload was migrated from it by the operator, delete it once nothing reads it")
+		}
+		return nil
+	}
+	readers, err := r.secretReaders(ctx, secret)
+	if err != nil || len(readers) > 0 {
+		return err
+	}
+
+	if err := r.Delete(ctx, secret, client.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion}); err != nil && !errors.IsNotFound(err) {
+		lggr.Error(err, "Failed to delete the legacy proxy Secret", "Secret.Namespace", namespace, "Secret.Name", secret.Name)
+		return err
+	}
+	lggr.Info("Deleted the legacy proxy Secret, no workload reads it anymore", "Secret.Namespace", namespace, "Secret.Name", secret.Name)
+	return nil
+}
+
+// adoptionTarget is the workload a proxy Secret is created for at admission, before the workload exists and can own it
+type adoptionTarget struct {
+	kind string
+	// name is empty when the workload is created with a generateName
+	name         string
+	generateName string
+}
+
+// record labels and annotates a proxy Secret with the workload that adopts it
+func (t *adoptionTarget) record(secret *corev1.Secret) {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[PROXY_ADOPTION_KIND_LABEL] = t.kind
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	if t.name != "" {
+		secret.Annotations[PROXY_ADOPTION_NAME_ANNOTATION] = t.name
+	} else {
+		secret.Annotations[PROXY_ADOPTION_GENERATE_NAME_ANNOTATION] = t.generateName
+	}
+}
+
+// clearAdoptionTarget removes the workload that adopts a proxy Secret from it
+func clearAdoptionTarget(secret *corev1.Secret) {
+	delete(secret.Labels, PROXY_ADOPTION_KIND_LABEL)
+	delete(secret.Annotations, PROXY_ADOPTION_NAME_ANNOTATION)
+	delete(secret.Annotations, PROXY_ADOPTION_GENERATE_NAME_ANNOTATION)
+}
+
+// adoptWorkloadProxySecrets sets the ownerReferences of the proxy Secrets created for single workloads at admission,
+// when the workloads didn't exist yet, so they are garbage collected along with the Pods, Jobs and workloads reading them.
+// Only the Secrets carrying PROXY_ADOPTION_KIND_LABEL are looked at, and only the workload each was created for is read.
+func (r *ProxyConfigReconciler) adoptWorkloadProxySecrets(ctx context.Context, namespace string, owner configOwner) error {
+	secretList := &corev1.SecretList{}
+	if err := r.List(ctx, secretList, client.InNamespace(namespace), client.MatchingLabels(owner.ownerLabels()), client.HasLabels{PROXY_ADOPTION_KIND_LABEL}); err != nil {
+		return err
+	}
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if len(secret.OwnerReferences) > 0 {
+			// Adopted by the workload once it was reconciled
+			if err := r.adoptWorkloadProxySecret(ctx, secret, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		readers, err := r.adoptionReaders(ctx, secret)
+		if err != nil {
+			return err
+		}
+		if err := r.adoptWorkloadProxySecret(ctx, secret, readers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateWorkloadProxySecrets adopts the proxy Secrets created at admission before they recorded the workload they were
+// created for, looking through every Pod, Job and workload of the namespaces. It only runs once per ProxyConfig or
+// ClusterProxyConfig, which is annotated with PROXY_SECRETS_MIGRATED_ANNOTATION afterwards.
+func (r *ProxyConfigReconciler) migrateWorkloadProxySecrets(ctx context.Context, obj client.Object, namespaces []string, owner configOwner) error {
+	if obj.GetAnnotations()[PROXY_SECRETS_MIGRATED_ANNOTATION] != "" {
+		return nil
+	}
+	for _, namespace := range namespaces {
+		secretList := &corev1.SecretList{}
+		if err := r.List(ctx, secretList, client.InNamespace(namespace), client.MatchingLabels(owner.ownerLabels())); err != nil {
+			return err
+		}
+		for i := range secretList.Items {
+			secret := &secretList.Items[i]
+			// The proxy Secret shared by the workloads of the owner isn't created for a single one
+			if len(secret.OwnerReferences) > 0 || secret.Name == owner.proxySecretName() || secret.Labels[PROXY_ADOPTION_KIND_LABEL] != "" {
+				continue
+			}
+			readers, err := r.secretReaders(ctx, secret)
+			if err != nil {
+				return err
+			}
+			if err := r.adoptWorkloadProxySecret(ctx, secret, readers); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The annotation is patched on a copy, the status of the object may already be changed
+	migrated := obj.DeepCopyObject().(client.Object)
+	patch := client.MergeFrom(migrated.DeepCopyObject().(client.Object))
+	annotations := migrated.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[PROXY_SECRETS_MIGRATED_ANNOTATION] = "true"
+	migrated.SetAnnotations(annotations)
+	if err := r.Patch(ctx, migrated, patch); err != nil {
+		return err
+	}
+	obj.SetAnnotations(annotations)
+	obj.SetResourceVersion(migrated.GetResourceVersion())
+	lggr.Info("Migrated the proxy Secrets created at admission of " + owner.String())
+	return nil
+}
+
+// adoptionReaders returns the workload a proxy Secret was created for at admission, when it exists and its pod templates
+// read the Secret. The name of a workload created with a generateName wasn't known at admission, the workloads of its kind
+// whose name starts with it are returned instead.
+func (r *ProxyConfigReconciler) adoptionReaders(ctx context.Context, secret *corev1.Secret) ([]client.Object, error) {
+	kind := secret.Labels[PROXY_ADOPTION_KIND_LABEL]
+	adapter, ok := r.Workloads.Get(kind)
+	for _, admitted := range []WorkloadAdapter{PodAdapter, JobAdapter} {
+		if admitted.Kind() == kind {
+			adapter, ok = admitted, true
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	workloads := []client.Object{}
+	if name := secret.Annotations[PROXY_ADOPTION_NAME_ANNOTATION]; name != "" {
+		workload := adapter.NewObject()
+		err := r.APIReader.Get(ctx, types.NamespacedName{Name: name, Namespace: secret.Namespace}, workload)
+		if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, workload)
+	} else if generateName := secret.Annotations[PROXY_ADOPTION_GENERATE_NAME_ANNOTATION]; generateName != "" {
+		listed, err := adapter.List(ctx, &pagedReader{r.APIReader}, client.InNamespace(secret.Namespace))
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, workload := range listed {
+			if strings.HasPrefix(workload.GetName(), generateName) {
+				workloads = append(workloads, workload)
+			}
+		}
+	}
+	return appendSecretReaders([]client.Object{}, adapter, workloads, secret.Name)
+}
+
+// adoptWorkloadProxySecret sets the ownerReferences of a proxy Secret created at admission to the workloads reading it.
+// Pods and Jobs with a controller are left out, the Secret is read through their controller.
+// A Secret nothing reads once WORKLOAD_SECRET_ADOPTION_GRACE_PERIOD is over, eg of a rejected Pod, is deleted.
+// A Secret that already has ownerReferences only drops the workload it records.
+func (r *ProxyConfigReconciler) adoptWorkloadProxySecret(ctx context.Context, secret *corev1.Secret, readers []client.Object) error {
+	ownerReferences := secret.OwnerReferences
+	if len(ownerReferences) == 0 {
+		for _, workload := range readers {
+			if metav1.GetControllerOf(workload) != nil {
+				continue
+			}
+			gvk, err := apiutil.GVKForObject(workload, r.Scheme)
+			if err != nil {
+				return err
+			}
+			ownerReferences = append(ownerReferences, metav1.OwnerReference{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind, Name: workload.GetName(), UID: workload.GetUID()})
+		}
+	}
+
+	if len(ownerReferences) == 0 {
+		if len(readers) > 0 || time.Since(secret.CreationTimestamp.Time) < WORKLOAD_SECRET_ADOPTION_GRACE_PERIOD {
+			return nil
+		}
+		if err := r.Delete(ctx, secret, client.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion}); err != nil && !errors.IsNotFound(err) {
+			lggr.Error(err, "Failed to delete Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+			return err
+		}
+		lggr.Info("Deleted Secret, no workload reads it", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		return nil
+	}
+
+	secret.OwnerReferences = ownerReferences
+	clearAdoptionTarget(secret)
+	if err := r.Update(ctx, secret); err != nil {
+		lggr.Error(err, "Failed to adopt Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+		return err
+	}
+	lggr.Info("Adopted Secret created at admission", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+	return nil
+}
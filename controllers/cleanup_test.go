@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// newInjectedTemplate returns a pod template holding both entries of its own and entries the test ProxyConfig injected,
+// along with the injection record listing the injected ones
+func newInjectedTemplate() (*corev1.PodTemplateSpec, *injectionRecord) {
+	template := &newTestDeployment("strip",
+		corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"},
+		corev1.EnvVar{Name: "HTTP_PROXY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxyConfigOwner("test").proxySecretName()}, Key: "http_proxy"}}},
+	).Spec.Template
+	template.Annotations = map[string]string{"team": "payments", PROXY_CONFIG_HASH_ANNOTATION: "0123456789abcdef"}
+	template.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "trusted-ca"}}
+	template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}, {Name: "trusted-ca", MountPath: "/etc/pki/ca-trust/extracted/pem"}}
+
+	record := newInjectionRecord(proxyConfigOwner("test"))
+	record.addEnv("app", "HTTP_PROXY")
+	record.addVolume("trusted-ca")
+	record.addVolumeMount("app", "trusted-ca")
+	record.addAnnotation(PROXY_CONFIG_HASH_ANNOTATION)
+	return template, record
+}
+
+var _ = Describe("Removing the injected configuration", func() {
+	It("removes the entries listed in the injection record and keeps the rest", func() {
+		template, record := newInjectedTemplate()
+		stripPodTemplate(template, record)
+
+		Expect(template.Annotations).To(Equal(map[string]string{"team": "payments"}))
+		Expect(template.Spec.Volumes).To(Equal([]corev1.Volume{{Name: "data"}}))
+		Expect(template.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "data", MountPath: "/data"}}))
+		Expect(template.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}))
+	})
+
+	It("restores the variables the container set itself instead of removing them", func() {
+		own := corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"}
+		template, record := newInjectedTemplate()
+		record.addOriginal("app", own)
+		stripPodTemplate(template, record)
+
+		Expect(template.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}, own}))
+	})
+
+	It("only lists the entries that are no longer injected as stale", func() {
+		own := corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"}
+		_, previous := newInjectedTemplate()
+		previous.addEnv("app", "NO_PROXY")
+		previous.addOriginal("app", own)
+
+		_, current := newInjectedTemplate()
+		current.Volumes = nil
+		current.VolumeMounts = map[string][]string{}
+		current.Env = map[string][]string{"app": {"NO_PROXY"}}
+
+		stale := previous.subtract(current)
+		Expect(stale.Env).To(Equal(map[string][]string{"app": {"HTTP_PROXY"}}))
+		Expect(stale.Volumes).To(Equal([]string{"trusted-ca"}))
+		Expect(stale.VolumeMounts).To(Equal(map[string][]string{"app": {"trusted-ca"}}))
+		Expect(stale.Annotations).To(BeEmpty())
+		original, ok := stale.original("app", "HTTP_PROXY")
+		Expect(ok).To(BeTrue())
+		Expect(original).To(Equal(own))
+	})
+
+	Context("with an API server", func() {
+		It("restores the workload as it was before the injection", func() {
+			ctx := context.Background()
+			own := corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"}
+			deployment := newTestDeployment("strip-workload", own)
+			Expect(k8sClient.Create(ctx, deployment, client.FieldOwner("user"))).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, deployment))).To(Succeed())
+			})
+
+			r := &ProxyConfigReconciler{Client: k8sClient, APIReader: k8sClient, Scheme: scheme.Scheme}
+			_, err := r.injectPodTemplates(ctx, DeploymentAdapter, deployment, testInjectionOptions(""), proxyConfigOwner("test"))
+			Expect(err).NotTo(HaveOccurred())
+
+			injected := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), injected)).To(Succeed())
+			Expect(r.stripWorkload(ctx, DeploymentAdapter, injected)).To(Succeed())
+
+			stripped := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), stripped)).To(Succeed())
+			Expect(stripped.Annotations).NotTo(HaveKey(PROXY_INJECTED_ANNOTATION))
+			Expect(stripped.Spec.Template.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{own}))
+		})
+	})
+
+	Context("with the legacy shared proxy Secret", func() {
+		ctx := context.Background()
+		// Namespaces can't be deleted by envtest, every spec uses a namespace of its own
+		var namespaces int
+		legacyEnvVar := corev1.EnvVar{Name: "HTTP_PROXY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME}, Key: "http_proxy"}}}
+
+		// createLegacySecret creates a namespace holding the legacy shared proxy Secret, as earlier versions created it
+		createLegacySecret := func() string {
+			namespaces++
+			namespace := fmt.Sprintf("legacy-%d", namespaces)
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).To(Succeed())
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME, Namespace: namespace},
+				Data:       map[string][]byte{"http_proxy": []byte("http://proxy.example.com:3128"), "https_proxy": nil, "no_proxy": nil},
+			})).To(Succeed())
+			return namespace
+		}
+		getLegacySecret := func(namespace string) (*corev1.Secret, error) {
+			secret := &corev1.Secret{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME, Namespace: namespace}, secret)
+			return secret, err
+		}
+
+		It("keeps a legacy Secret no workload was migrated from, with an event", func() {
+			namespace := createLegacySecret()
+			recorder := record.NewFakeRecorder(10)
+			r := &ProxyConfigReconciler{Client: k8sClient, APIReader: k8sClient, Scheme: scheme.Scheme, Workloads: NewWorkloadRegistry(), Recorder: recorder}
+
+			Expect(r.deleteLegacyProxySecret(ctx, namespace)).To(Succeed())
+			_, err := getLegacySecret(namespace)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring(EVENT_REASON_LEGACY_SECRET_KEPT)))
+		})
+
+		// createLegacyReader creates a Deployment the operator injected from the legacy Secret, and a reconciler injecting it
+		createLegacyReader := func(namespace string) (*appsv1.Deployment, *ProxyConfigReconciler) {
+			deployment := newTestDeployment("legacy", legacyEnvVar)
+			deployment.Namespace = namespace
+			Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+			workloads := NewWorkloadRegistry()
+			workloads.Register(DeploymentAdapter)
+			return deployment, &ProxyConfigReconciler{Client: k8sClient, APIReader: k8sClient, Scheme: scheme.Scheme, Workloads: workloads, Recorder: record.NewFakeRecorder(10)}
+		}
+
+		It("marks the legacy Secret when migrating a workload injected from it, and deletes it once nothing reads it", func() {
+			namespace := createLegacySecret()
+			deployment, r := createLegacyReader(namespace)
+
+			proxy := proxyv1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128"}
+			_, err := r.injectWorkload(ctx, DeploymentAdapter, deployment, &proxyv1beta1.ProxyConfigSpec{ProxySource: "custom", Proxy: &proxy}, proxyConfigOwner("test"), resolvedProxyConfig{source: "custom", proxy: proxy})
+			Expect(err).NotTo(HaveOccurred())
+			secret, err := getLegacySecret(namespace)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Annotations).To(HaveKeyWithValue(PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION, proxyConfigOwner("test").String()))
+
+			Expect(r.deleteLegacyProxySecret(ctx, namespace)).To(Succeed())
+			_, err = getLegacySecret(namespace)
+			Expect(errors.IsNotFound(err)).To(BeTrue(), "expected the legacy Secret to be deleted, got %v", err)
+		})
+
+		It("keeps a marked legacy Secret while a workload still reads it", func() {
+			namespace := createLegacySecret()
+			_, r := createLegacyReader(namespace)
+
+			Expect(r.markLegacyProxySecret(ctx, namespace, proxyConfigOwner("test"))).To(Succeed())
+			Expect(r.deleteLegacyProxySecret(ctx, namespace)).To(Succeed())
+			_, err := getLegacySecret(namespace)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("with proxy Secrets created at admission", func() {
+		ctx := context.Background()
+		owner := proxyConfigOwner("test")
+		var namespaces int
+
+		// createNamespace creates a namespace of its own for a spec, and a reconciler reading from the API server
+		createNamespace := func() (string, *ProxyConfigReconciler) {
+			namespaces++
+			namespace := fmt.Sprintf("admission-%d", namespaces)
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).To(Succeed())
+			return namespace, &ProxyConfigReconciler{Client: k8sClient, APIReader: k8sClient, Scheme: scheme.Scheme, Workloads: NewWorkloadRegistry()}
+		}
+		// createReader creates a Pod reading a Secret
+		createReader := func(namespace string, pod *corev1.Pod, secretName string) *corev1.Pod {
+			pod.Namespace = namespace
+			pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "app", Env: []corev1.EnvVar{
+				{Name: "HTTP_PROXY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: secretName}, Key: "http_proxy"}}},
+			}}}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			return pod
+		}
+		getSecret := func(namespace string, name string) *corev1.Secret {
+			secret := &corev1.Secret{}
+			ExpectWithOffset(1, k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, secret)).To(Succeed())
+			return secret
+		}
+		proxy := proxyv1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128"}
+
+		It("adopts a Secret by the Pod it was created for", func() {
+			namespace, r := createNamespace()
+			Expect(createProxySecret(k8sClient, ctx, lggr, "bare-secret", namespace, proxy, owner, nil, &adoptionTarget{kind: "Pod", name: "bare"})).To(Succeed())
+			Expect(getSecret(namespace, "bare-secret").Labels).To(HaveKeyWithValue(PROXY_ADOPTION_KIND_LABEL, "Pod"))
+			pod := createReader(namespace, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bare"}}, "bare-secret")
+
+			Expect(r.adoptWorkloadProxySecrets(ctx, namespace, owner)).To(Succeed())
+			secret := getSecret(namespace, "bare-secret")
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+			Expect(secret.OwnerReferences[0].UID).To(Equal(pod.UID))
+			Expect(secret.Labels).NotTo(HaveKey(PROXY_ADOPTION_KIND_LABEL))
+			Expect(secret.Annotations).NotTo(HaveKey(PROXY_ADOPTION_NAME_ANNOTATION))
+		})
+
+		It("adopts a Secret by the Pods created with the generateName it was created for", func() {
+			namespace, r := createNamespace()
+			Expect(createProxySecret(k8sClient, ctx, lggr, "generated-secret", namespace, proxy, owner, nil, &adoptionTarget{kind: "Pod", generateName: "generated-"})).To(Succeed())
+			pod := createReader(namespace, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "generated-"}}, "generated-secret")
+			createReader(namespace, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other"}}, "generated-secret")
+
+			Expect(r.adoptWorkloadProxySecrets(ctx, namespace, owner)).To(Succeed())
+			secret := getSecret(namespace, "generated-secret")
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+			Expect(secret.OwnerReferences[0].UID).To(Equal(pod.UID))
+		})
+
+		It("keeps a Secret whose Pod doesn't exist yet during the grace period", func() {
+			namespace, r := createNamespace()
+			Expect(createProxySecret(k8sClient, ctx, lggr, "pending-secret", namespace, proxy, owner, nil, &adoptionTarget{kind: "Pod", name: "pending"})).To(Succeed())
+
+			Expect(r.adoptWorkloadProxySecrets(ctx, namespace, owner)).To(Succeed())
+			secret := getSecret(namespace, "pending-secret")
+			Expect(secret.OwnerReferences).To(BeEmpty())
+			Expect(secret.Labels).To(HaveKeyWithValue(PROXY_ADOPTION_KIND_LABEL, "Pod"))
+		})
+
+		It("adopts the Secrets created before they recorded their workload once", func() {
+			namespace, r := createNamespace()
+			proxyConfig := newTestProxyConfig(owner.name)
+			proxyConfig.Namespace = namespace
+			Expect(k8sClient.Create(ctx, proxyConfig)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, proxyConfig))).To(Succeed())
+			})
+			Expect(createProxySecret(k8sClient, ctx, lggr, "earlier-secret", namespace, proxy, owner, nil, nil)).To(Succeed())
+			pod := createReader(namespace, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "earlier"}}, "earlier-secret")
+
+			Expect(r.migrateWorkloadProxySecrets(ctx, proxyConfig, []string{namespace}, owner)).To(Succeed())
+			Expect(getSecret(namespace, "earlier-secret").OwnerReferences[0].UID).To(Equal(pod.UID))
+			migrated := &proxyv1beta1.ProxyConfig{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(proxyConfig), migrated)).To(Succeed())
+			Expect(migrated.Annotations).To(HaveKey(PROXY_SECRETS_MIGRATED_ANNOTATION))
+			Expect(proxyConfig.ResourceVersion).To(Equal(migrated.ResourceVersion))
+
+			Expect(createProxySecret(k8sClient, ctx, lggr, "later-secret", namespace, proxy, owner, nil, nil)).To(Succeed())
+			createReader(namespace, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "later"}}, "later-secret")
+			Expect(r.migrateWorkloadProxySecrets(ctx, proxyConfig, []string{namespace}, owner)).To(Succeed())
+			Expect(getSecret(namespace, "later-secret").OwnerReferences).To(BeEmpty())
+		})
+	})
+})
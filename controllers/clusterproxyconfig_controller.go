@@ -0,0 +1,480 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// ClusterProxyConfigReconciler reconciles a ClusterProxyConfig object.
+// It shares the workload registry, watched kinds and injection logic of the ProxyConfig reconciler,
+// which has to be set up with the Manager first.
+type ClusterProxyConfigReconciler struct {
+	*ProxyConfigReconciler
+}
+
+//+kubebuilder:rbac:groups=proxy.k8s.kemo.dev,resources=clusterproxyconfigs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=proxy.k8s.kemo.dev,resources=clusterproxyconfigs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=proxy.k8s.kemo.dev,resources=clusterproxyconfigs/finalizers,verbs=update
+
+// Reconcile distributes the proxy Secret and CA certificate ConfigMap of a ClusterProxyConfig into the namespaces it selects,
+// and injects the workloads it selects in them. Workloads injected by a ProxyConfig in their namespace are left to it.
+func (r *ClusterProxyConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	clusterProxyConfig := &proxyv1beta1.ClusterProxyConfig{}
+	err := r.Get(ctx, req.NamespacedName, clusterProxyConfig)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			lggr.Info("clusterProxyConfig resource not found on the cluster.", "ClusterProxyConfig.Name", req.Name)
+			return ctrl.Result{}, nil
+		}
+		lggr.Error(err, "Failed to get clusterProxyConfig")
+		return ctrl.Result{}, err
+	}
+	owner := clusterProxyConfigOwner(clusterProxyConfig.Name)
+
+	// Check to see if the clusterProxyConfig is being deleted, and remove what it injected in every namespace before letting it go
+	if !clusterProxyConfig.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(clusterProxyConfig, PROXY_CONFIG_FINALIZER) {
+			return ctrl.Result{}, nil
+		}
+		if err = r.cleanupOwner(ctx, "", owner); err != nil {
+			lggr.Error(err, "Failed to clean up clusterProxyConfig", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(clusterProxyConfig, PROXY_CONFIG_FINALIZER)
+		if err = r.Update(ctx, clusterProxyConfig); err != nil {
+			lggr.Error(err, "Failed to remove the clusterProxyConfig finalizer", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+		lggr.Info("clusterProxyConfig cleaned up", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+		return ctrl.Result{}, nil
+	}
+
+	// Add the finalizer so the workloads are cleaned up when the clusterProxyConfig is deleted
+	if controllerutil.AddFinalizer(clusterProxyConfig, PROXY_CONFIG_FINALIZER) {
+		if err = r.Update(ctx, clusterProxyConfig); err != nil {
+			lggr.Error(err, "Failed to add the clusterProxyConfig finalizer", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	spec := &clusterProxyConfig.Spec.ProxyConfigSpec
+	proxySource := SetDefaultString(DEFAULT_PROXY_SOURCE, spec.ProxySource)
+	lggr.Info("clusterProxyConfig found in '" + clusterProxyConfig.Name + "', proxySource: " + proxySource)
+
+	// Resolve the proxy configuration from its source
+	resolved, err := r.resolveProxySource(ctx, *spec)
+	setSourceResolvedCondition(&clusterProxyConfig.Status.Conditions, clusterProxyConfig.Generation, resolved, err, "ClusterProxyConfig")
+	if err != nil {
+		return r.sourceFailed(ctx, clusterProxyConfig, resolved)
+	}
+	resolved.envFrom = envFromCache{}
+
+	// Read the CA certificate of the custom proxy source, from the namespace it references
+	caErr := r.resolveCACert(ctx, spec, "", &resolved)
+	if caErr != nil {
+		lggr.Error(caErr, "Failed to read the CA certificate of the custom proxy source")
+	}
+
+	clusterProxyConfig.Status.ProxySource = SetDefaultString(proxySource, resolved.source)
+	clusterProxyConfig.Status.InheritedFrom = resolved.inheritedFrom
+	clusterProxyConfig.Status.EffectiveProxy = effectiveProxy(resolved.proxy)
+
+	selector, err := workloadSelector(*spec)
+	if err != nil {
+		lggr.Error(err, "Invalid workloadSelector", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+		return r.listFailed(ctx, clusterProxyConfig, "workloads", err)
+	}
+	namespaces, err := r.selectedNamespaces(ctx, clusterProxyConfig)
+	if err != nil {
+		lggr.Error(err, "Failed to list the Namespaces selected by clusterProxyConfig "+clusterProxyConfig.Name)
+		return r.listFailed(ctx, clusterProxyConfig, "namespaces", err)
+	}
+	precedence, err := r.newPrecedence(ctx)
+	if err != nil {
+		lggr.Error(err, "Failed to list the ProxyConfigs and ClusterProxyConfigs")
+		return r.listFailed(ctx, clusterProxyConfig, "ProxyConfigs", err)
+	}
+
+	// decide returns whether the clusterProxyConfig injects a workload, the reason reported in its status,
+	// and the proxy configuration injecting it instead when another one takes precedence
+	decide := func(kind string, workload client.Object) (bool, string, *configOwner) {
+		namespace, ok := namespaces[workload.GetNamespace()]
+		if !ok {
+			return false, "", nil
+		}
+		inject, reason := injectionDecision(*spec, selector, kind, workload, namespaceOptedIn(namespace))
+		if !inject {
+			return false, reason, nil
+		}
+		if winner := precedence.selected(kind, workload, namespace); winner != nil && *winner != owner {
+			return false, proxyv1beta1.DecisionOverridden, winner
+		}
+		return true, reason, nil
+	}
+
+	// While suspended, nothing is written but the changes that would be are reported
+	suspended := spec.Suspend
+	if suspended {
+		lggr.Info("clusterProxyConfig is suspended, holding back changes to its namespaces and workloads", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+	}
+
+	// Delete the Secrets and ConfigMaps distributed to namespaces that are no longer selected
+	if !suspended {
+		if err = r.deleteOwnedObjects(ctx, owner, func(obj client.Object) bool {
+			_, ok := namespaces[obj.GetNamespace()]
+			return !ok
+		}); err != nil {
+			lggr.Error(err, "Failed to delete the Secrets and ConfigMaps of clusterProxyConfig "+clusterProxyConfig.Name+" from unselected Namespaces")
+			return ctrl.Result{}, err
+		}
+	}
+
+	names := []string{}
+	for name := range namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Distribute the proxy Secret and CA certificate ConfigMap into every selected namespace
+	inventories := map[string]*workloadInventory{}
+	unselectedPending := 0
+	distributionFailed := 0
+	for _, name := range names {
+		inventories[name] = newWorkloadInventory()
+		if suspended {
+			continue
+		}
+		if err = r.distribute(ctx, name, owner, resolved); err != nil {
+			distributionFailed++
+		}
+	}
+
+	for _, adapter := range r.Workloads.Adapters() {
+		kind := adapter.Kind()
+
+		// Remove the proxy configuration from the workloads that are no longer selected, in any namespace
+		stripped, err := r.stripOptedOutWorkloads(ctx, adapter, "", owner, func(workload client.Object) (bool, error) {
+			inject, _, _ := decide(kind, workload)
+			return inject, nil
+		}, suspended)
+		if suspended {
+			for _, workload := range stripped {
+				if inventory, ok := inventories[workload.GetNamespace()]; ok {
+					inventory.recordPending(kind, workload.GetName())
+				} else {
+					// Workloads in namespaces that are no longer selected are only counted
+					unselectedPending++
+				}
+			}
+		}
+		if meta.IsNoMatchError(err) {
+			lggr.Info(kind + "s are not served by this cluster, skipping them")
+			continue
+		} else if err != nil {
+			lggr.Error(err, "Failed to remove the proxy configuration from opted out "+kind+"s")
+			return ctrl.Result{}, err
+		}
+		if !targetsKind(*spec, kind) {
+			continue
+		}
+
+		workloads, err := r.listCandidateWorkloads(ctx, adapter, namespaces, selector)
+		if err != nil {
+			lggr.Error(err, "Failed to list "+kind+"s")
+			return r.listFailed(ctx, clusterProxyConfig, kind+"s", err)
+		}
+		lggr.Info("Found " + strconv.Itoa(len(workloads)) + " " + kind + "s in the selected namespaces")
+
+		for _, workload := range workloads {
+			inventory := inventories[workload.GetNamespace()]
+			inject, reason, winner := decide(kind, workload)
+			if winner != nil {
+				inventory.recordConflict(kind, workload, *winner)
+				continue
+			}
+			if reason != "" {
+				inventory.recordDecision(kind, workload.GetName(), inject, reason)
+			}
+			if !inject {
+				continue
+			}
+			if suspended {
+				r.recordSuspendedInjection(ctx, inventory, adapter, workload, spec, owner, resolved)
+				continue
+			}
+			conflicts, err := r.injectWorkload(ctx, adapter, workload, spec, owner, resolved)
+			if err != nil {
+				inventory.recordFailure(kind, workload.GetName(), err)
+			} else {
+				inventory.recordInjected(kind, workload.GetName())
+				inventory.recordEnvConflicts(kind, conflicts)
+			}
+		}
+	}
+
+	// The proxy Secrets of single Pods and Jobs created at admission are garbage collected along with them once they exist
+	if !suspended {
+		for _, name := range names {
+			if err = r.adoptWorkloadProxySecrets(ctx, name, owner); err != nil {
+				lggr.Error(err, "Failed to adopt the proxy Secrets created at admission in "+name)
+			}
+		}
+		if err = r.migrateWorkloadProxySecrets(ctx, clusterProxyConfig, names, owner); err != nil {
+			lggr.Error(err, "Failed to migrate the proxy Secrets created at admission of "+owner.String())
+		}
+	}
+
+	// Aggregate the per-namespace results of the reconciliation
+	status := &clusterProxyConfig.Status
+	status.NamespaceCount = int32(len(names))
+	status.InjectedCount = 0
+	status.FailedCount = 0
+	status.Namespaces = []proxyv1beta1.NamespaceStatus{}
+	conflicts := []string{}
+	envConflicts := 0
+	pending := unselectedPending
+	for _, name := range names {
+		inventory := inventories[name]
+		status.InjectedCount += inventory.injected
+		status.FailedCount += int32(inventory.failed())
+		conflicts = append(conflicts, inventory.conflicts...)
+		envConflicts += inventory.envConflicts
+		pending += inventory.pending
+		if inventory.empty() {
+			continue
+		}
+		status.Namespaces = append(status.Namespaces, proxyv1beta1.NamespaceStatus{
+			Namespace:     name,
+			InjectedCount: inventory.injected,
+			Workloads:     inventory.statuses(),
+		})
+	}
+
+	setResultConditions(&status.Conditions, clusterProxyConfig.Generation, caErr, resolved.injectCACert, status.InjectedCount, int(status.FailedCount))
+	setConflictCondition(&status.Conditions, clusterProxyConfig.Generation, conflicts)
+	setSuspendedCondition(&status.Conditions, clusterProxyConfig.Generation, suspended, pending)
+	setEnvConflictCondition(&status.Conditions, clusterProxyConfig.Generation, spec.ConflictPolicy, envConflicts)
+	if distributionFailed > 0 {
+		setClusterCondition(clusterProxyConfig, proxyv1beta1.ConditionDegraded, metav1.ConditionTrue, REASON_DISTRIBUTION_FAILED, "The proxy Secret or CA certificate ConfigMap could not be created in "+strconv.Itoa(distributionFailed)+" namespace(s)")
+		setClusterCondition(clusterProxyConfig, proxyv1beta1.ConditionReady, metav1.ConditionFalse, REASON_DISTRIBUTION_FAILED, "The proxy configuration could not be distributed to every namespace")
+	}
+
+	if err = r.updateStatus(ctx, clusterProxyConfig); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// sourceFailed reports a proxy source that could not be resolved in the ClusterProxyConfig status, and retries later.
+// Nothing is distributed or injected meanwhile, the empty proxy configuration would replace the proxy Secret in every
+// selected namespace and remove the proxy from every workload.
+func (r *ClusterProxyConfigReconciler) sourceFailed(ctx context.Context, clusterProxyConfig *proxyv1beta1.ClusterProxyConfig, resolved resolvedProxyConfig) (ctrl.Result, error) {
+	clusterProxyConfig.Status.InheritedFrom = resolved.inheritedFrom
+	reason := meta.FindStatusCondition(clusterProxyConfig.Status.Conditions, proxyv1beta1.ConditionSourceResolved).Reason
+	setClusterCondition(clusterProxyConfig, proxyv1beta1.ConditionReady, metav1.ConditionFalse, reason, "The proxy configuration could not be resolved, the namespaces and workloads are left as they are")
+	if err := r.updateStatus(ctx, clusterProxyConfig); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	lggr.Info("Running reconciler again in " + strconv.Itoa(scanningInterval) + "s")
+	return ctrl.Result{RequeueAfter: time.Second * time.Duration(scanningInterval)}, nil
+}
+
+// selectedNamespaces returns the namespaces a ClusterProxyConfig selects by name, leaving out terminating namespaces
+func (r *ClusterProxyConfigReconciler) selectedNamespaces(ctx context.Context, clusterProxyConfig *proxyv1beta1.ClusterProxyConfig) (map[string]*corev1.Namespace, error) {
+	listOpts := []client.ListOption{}
+	if clusterProxyConfig.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(clusterProxyConfig.Spec.NamespaceSelector)
+		if err != nil {
+			return nil, err
+		}
+		listOpts = append(listOpts, client.MatchingLabelsSelector{Selector: selector})
+	}
+	namespaceList := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaceList, listOpts...); err != nil {
+		return nil, err
+	}
+
+	namespaces := map[string]*corev1.Namespace{}
+	for i := range namespaceList.Items {
+		namespace := &namespaceList.Items[i]
+		if namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		namespaces[namespace.Name] = namespace
+	}
+	return namespaces, nil
+}
+
+// distribute creates the proxy Secret, and the CA certificate ConfigMap when the CA certificate is injected, in a namespace
+func (r *ClusterProxyConfigReconciler) distribute(ctx context.Context, namespace string, owner configOwner, resolved resolvedProxyConfig) error {
+	if err := createProxySecret(r.Client, ctx, lggr, owner.proxySecretName(), namespace, resolved.proxy, owner, nil, nil); err != nil {
+		lggr.Error(err, "Failed to distribute the proxy Secret of "+owner.String(), "Namespace", namespace)
+		return err
+	}
+	if !resolved.injectCACert {
+		return nil
+	}
+	caCert := &caCertOptions{configMapName: owner.caCertConfigMapName(), configMapKey: PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY}
+	if err := r.ensureCACertConfigMap(ctx, namespace, caCert, resolved, owner); err != nil {
+		lggr.Error(err, "Failed to distribute the CA certificate ConfigMap of "+owner.String(), "Namespace", namespace)
+		return err
+	}
+	return nil
+}
+
+// listCandidateWorkloads lists the workloads of a kind matching the workloadSelector in the selected namespaces,
+// along with every workload in the selected namespaces that opted in
+func (r *ClusterProxyConfigReconciler) listCandidateWorkloads(ctx context.Context, adapter WorkloadAdapter, namespaces map[string]*corev1.Namespace, selector labels.Selector) ([]client.Object, error) {
+	candidates := []client.Object{}
+	selected, err := r.listSelectedWorkloads(ctx, adapter, "", selector)
+	if err != nil {
+		return nil, err
+	}
+	for _, workload := range selected {
+		if namespace, ok := namespaces[workload.GetNamespace()]; ok && !namespaceOptedIn(namespace) {
+			candidates = append(candidates, workload)
+		}
+	}
+
+	for name, namespace := range namespaces {
+		if !namespaceOptedIn(namespace) {
+			continue
+		}
+		workloads, err := r.listSelectedWorkloads(ctx, adapter, name, labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, workloads...)
+	}
+	return candidates, nil
+}
+
+// precedence decides which ProxyConfig or ClusterProxyConfig injects a workload.
+// A ProxyConfig in the namespace of the workload comes first, then the ClusterProxyConfig with the highest priority.
+type precedence struct {
+	proxyConfigs        map[string][]proxyv1beta1.ProxyConfig
+	clusterProxyConfigs []proxyv1beta1.ClusterProxyConfig
+}
+
+// newPrecedence reads the ProxyConfigs and ClusterProxyConfigs the precedence is decided between
+func (r *ClusterProxyConfigReconciler) newPrecedence(ctx context.Context) (*precedence, error) {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList); err != nil {
+		return nil, err
+	}
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList); err != nil {
+		return nil, err
+	}
+
+	p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{}, clusterProxyConfigs: clusterProxyConfigList.Items}
+	for _, proxyConfig := range proxyConfigList.Items {
+		p.proxyConfigs[proxyConfig.Namespace] = append(p.proxyConfigs[proxyConfig.Namespace], proxyConfig)
+	}
+	return p, nil
+}
+
+// selected returns the ProxyConfig or ClusterProxyConfig injecting a workload, or nil when there is none
+func (p *precedence) selected(kind string, workload client.Object, namespace *corev1.Namespace) *configOwner {
+	if proxyConfig := selectProxyConfig(p.proxyConfigs[namespace.Name], kind, workload, namespaceOptedIn(namespace)); proxyConfig != nil {
+		owner := proxyConfigOwner(proxyConfig.Name)
+		return &owner
+	}
+	if clusterProxyConfig := selectClusterProxyConfig(p.clusterProxyConfigs, kind, workload, namespace); clusterProxyConfig != nil {
+		owner := clusterProxyConfigOwner(clusterProxyConfig.Name)
+		return &owner
+	}
+	return nil
+}
+
+// listFailed reports a listing failure in the ClusterProxyConfig status and returns the error to requeue the request
+func (r *ClusterProxyConfigReconciler) listFailed(ctx context.Context, clusterProxyConfig *proxyv1beta1.ClusterProxyConfig, kind string, err error) (ctrl.Result, error) {
+	setClusterCondition(clusterProxyConfig, proxyv1beta1.ConditionDegraded, metav1.ConditionTrue, REASON_LIST_FAILED, "Failed to list "+kind+": "+err.Error())
+	setClusterCondition(clusterProxyConfig, proxyv1beta1.ConditionReady, metav1.ConditionFalse, REASON_LIST_FAILED, "Failed to list "+kind)
+	_ = r.updateStatus(ctx, clusterProxyConfig)
+	return ctrl.Result{}, err
+}
+
+// updateStatus writes the status subresource of the ClusterProxyConfig
+func (r *ClusterProxyConfigReconciler) updateStatus(ctx context.Context, clusterProxyConfig *proxyv1beta1.ClusterProxyConfig) error {
+	clusterProxyConfig.Status.ObservedGeneration = clusterProxyConfig.Generation
+	if err := r.Status().Update(ctx, clusterProxyConfig); err != nil {
+		lggr.Error(err, "Failed to update clusterProxyConfig status", "ClusterProxyConfig.Name", clusterProxyConfig.Name)
+		return err
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Besides the ClusterProxyConfigs themselves, the namespaces, ProxyConfigs, workloads, the OpenShift cluster Proxy and the
+// CA ConfigMaps and Secrets are watched, the same way the ProxyConfig controller does.
+func (r *ClusterProxyConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.ProxyConfigReconciler == nil || r.watchedKinds == nil {
+		return fmt.Errorf("the ProxyConfig reconciler has to be set up before the ClusterProxyConfig reconciler")
+	}
+
+	if err := setupClusterProxyConfigIndexes(context.Background(), mgr); err != nil {
+		return err
+	}
+	workloadPredicates := builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{}))
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{MaxConcurrentReconciles: SetDefaultInt(1, r.MaxConcurrentReconciles)}).
+		For(&proxyv1beta1.ClusterProxyConfig{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.mapConfigMapToClusterProxyConfigs), builder.OnlyMetadata).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapSecretToClusterProxyConfigs), builder.OnlyMetadata).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.mapToClusterProxyConfigs),
+			builder.WithPredicates(predicate.Or(predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Watches(&proxyv1beta1.ProxyConfig{}, handler.EnqueueRequestsFromMapFunc(r.mapToClusterProxyConfigs),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+
+	for _, adapter := range r.Workloads.Adapters() {
+		if !r.watchedKinds[adapter.Kind()] {
+			continue
+		}
+		b = b.Watches(adapter.NewObject(), handler.EnqueueRequestsFromMapFunc(r.mapWorkloadToClusterProxyConfigs), workloadPredicates)
+	}
+
+	if isKindAvailable(mgr, configv1.GroupVersion.WithKind("Proxy")) {
+		b = b.Watches(&configv1.Proxy{}, handler.EnqueueRequestsFromMapFunc(r.mapClusterProxyToClusterProxyConfigs))
+	}
+
+	return b.Complete(r)
+}
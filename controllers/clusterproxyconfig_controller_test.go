@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// newTestClusterReconciler returns a ClusterProxyConfigReconciler injecting Deployments through a client of the API server.
+// No kind is watched, so the workloads are listed from the API server rather than the cache indexes.
+func newTestClusterReconciler(c client.Client) *ClusterProxyConfigReconciler {
+	workloads := NewWorkloadRegistry()
+	workloads.Register(DeploymentAdapter)
+	return &ClusterProxyConfigReconciler{ProxyConfigReconciler: &ProxyConfigReconciler{
+		Client: c, APIReader: c, Scheme: scheme.Scheme, Workloads: workloads, Recorder: record.NewFakeRecorder(100),
+	}}
+}
+
+// reconcileClusterProxyConfig reconciles a ClusterProxyConfig and returns it as it is afterwards, nil once it is gone
+func reconcileClusterProxyConfig(r *ClusterProxyConfigReconciler, name string) *proxyv1beta1.ClusterProxyConfig {
+	ctx := context.Background()
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	clusterProxyConfig := &proxyv1beta1.ClusterProxyConfig{}
+	err = k8sClient.Get(ctx, types.NamespacedName{Name: name}, clusterProxyConfig)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return clusterProxyConfig
+}
+
+// injectedBy returns the ProxyConfig or ClusterProxyConfig that injected a Deployment, or an empty string
+func injectedBy(namespace string, name string) string {
+	deployment := &appsv1.Deployment{}
+	ExpectWithOffset(1, k8sClient.Get(context.Background(), types.NamespacedName{Name: name, Namespace: namespace}, deployment)).To(Succeed())
+	record, err := readInjectionRecord(deployment)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	if record == nil {
+		return ""
+	}
+	return record.owner().String()
+}
+
+// hasSecret returns whether a Secret exists
+func hasSecret(namespace string, name string) bool {
+	err := k8sClient.Get(context.Background(), types.NamespacedName{Name: name, Namespace: namespace}, &corev1.Secret{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return true
+}
+
+var _ = Describe("Reconciling ClusterProxyConfigs", func() {
+	ctx := context.Background()
+	// Namespaces can't be deleted by envtest, every spec uses namespaces of its own
+	var suffix int
+	BeforeEach(func() {
+		suffix++
+	})
+
+	// createNamespace creates a namespace holding a Deployment carrying the injection label, labeled with its name as team
+	createNamespace := func(name string) string {
+		name = fmt.Sprintf("%s-%d", name, suffix)
+		Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"team": name}}})).To(Succeed())
+		deployment := newTestDeployment("web")
+		deployment.Namespace = name
+		Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+		return name
+	}
+
+	// createClusterProxyConfig creates a ClusterProxyConfig, removing it along with its finalizer once the spec is over
+	createClusterProxyConfig := func(name string, update func(*proxyv1beta1.ClusterProxyConfig)) *proxyv1beta1.ClusterProxyConfig {
+		clusterProxyConfig := newTestClusterProxyConfig(fmt.Sprintf("%s-%d", name, suffix))
+		if update != nil {
+			update(clusterProxyConfig)
+		}
+		Expect(k8sClient.Create(ctx, clusterProxyConfig)).To(Succeed())
+		DeferCleanup(func() {
+			current := &proxyv1beta1.ClusterProxyConfig{}
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(clusterProxyConfig), current); errors.IsNotFound(err) {
+				return
+			}
+			current.Finalizers = nil
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, current))).To(Succeed())
+		})
+		return clusterProxyConfig
+	}
+
+	selecting := func(team string) func(*proxyv1beta1.ClusterProxyConfig) {
+		return func(clusterProxyConfig *proxyv1beta1.ClusterProxyConfig) {
+			clusterProxyConfig.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": team}}
+		}
+	}
+
+	It("distributes the proxy Secret to the selected namespaces and injects their workloads", func() {
+		payments := createNamespace("payments")
+		search := createNamespace("search")
+		clusterProxyConfig := createClusterProxyConfig("distribute", selecting(payments))
+		owner := clusterProxyConfigOwner(clusterProxyConfig.Name)
+
+		reconciled := reconcileClusterProxyConfig(newTestClusterReconciler(k8sClient), clusterProxyConfig.Name)
+		Expect(hasSecret(payments, owner.proxySecretName())).To(BeTrue())
+		Expect(hasSecret(search, owner.proxySecretName())).To(BeFalse())
+		Expect(injectedBy(payments, "web")).To(Equal(owner.String()))
+		Expect(injectedBy(search, "web")).To(BeEmpty())
+
+		Expect(reconciled.Finalizers).To(ContainElement(PROXY_CONFIG_FINALIZER))
+		Expect(reconciled.Status.NamespaceCount).To(Equal(int32(1)))
+		Expect(reconciled.Status.InjectedCount).To(Equal(int32(1)))
+		Expect(meta.IsStatusConditionTrue(reconciled.Status.Conditions, proxyv1beta1.ConditionReady)).To(BeTrue())
+	})
+
+	It("removes the proxy configuration from the namespaces that are no longer selected", func() {
+		payments := createNamespace("payments")
+		clusterProxyConfig := createClusterProxyConfig("unselect", selecting(payments))
+		owner := clusterProxyConfigOwner(clusterProxyConfig.Name)
+		r := newTestClusterReconciler(k8sClient)
+		reconcileClusterProxyConfig(r, clusterProxyConfig.Name)
+		Expect(injectedBy(payments, "web")).To(Equal(owner.String()))
+
+		namespace := &corev1.Namespace{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: payments}, namespace)).To(Succeed())
+		namespace.Labels["team"] = "billing"
+		Expect(k8sClient.Update(ctx, namespace)).To(Succeed())
+
+		reconciled := reconcileClusterProxyConfig(r, clusterProxyConfig.Name)
+		Expect(hasSecret(payments, owner.proxySecretName())).To(BeFalse())
+		Expect(injectedBy(payments, "web")).To(BeEmpty())
+		Expect(reconciled.Status.NamespaceCount).To(BeZero())
+	})
+
+	It("cleans up every namespace before letting a deleted ClusterProxyConfig go", func() {
+		payments := createNamespace("payments")
+		clusterProxyConfig := createClusterProxyConfig("delete", selecting(payments))
+		owner := clusterProxyConfigOwner(clusterProxyConfig.Name)
+		r := newTestClusterReconciler(k8sClient)
+		reconcileClusterProxyConfig(r, clusterProxyConfig.Name)
+		Expect(injectedBy(payments, "web")).To(Equal(owner.String()))
+
+		Expect(k8sClient.Delete(ctx, clusterProxyConfig)).To(Succeed())
+		Expect(reconcileClusterProxyConfig(r, clusterProxyConfig.Name)).To(BeNil())
+		Expect(hasSecret(payments, owner.proxySecretName())).To(BeFalse())
+		Expect(injectedBy(payments, "web")).To(BeEmpty())
+	})
+
+	It("reports the namespaces the proxy Secret couldn't be distributed to", func() {
+		payments := createNamespace("payments")
+		clusterProxyConfig := createClusterProxyConfig("distribution-failed", selecting(payments))
+		c, err := client.NewWithWatch(cfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+		failing := interceptor.NewClient(c, interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				if _, ok := obj.(*corev1.Secret); ok && obj.GetNamespace() == payments {
+					return fmt.Errorf("quota exceeded")
+				}
+				return c.Create(ctx, obj, opts...)
+			},
+		})
+
+		reconciled := reconcileClusterProxyConfig(newTestClusterReconciler(failing), clusterProxyConfig.Name)
+		degraded := meta.FindStatusCondition(reconciled.Status.Conditions, proxyv1beta1.ConditionDegraded)
+		Expect(degraded).NotTo(BeNil())
+		Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+		Expect(degraded.Reason).To(Equal(REASON_DISTRIBUTION_FAILED))
+		ready := meta.FindStatusCondition(reconciled.Status.Conditions, proxyv1beta1.ConditionReady)
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal(REASON_DISTRIBUTION_FAILED))
+	})
+
+	Context("when another proxy configuration takes precedence", func() {
+		It("leaves the workloads to the ProxyConfig in their namespace", func() {
+			payments := createNamespace("payments")
+			proxyConfig := newTestProxyConfig("local")
+			proxyConfig.Namespace = payments
+			Expect(k8sClient.Create(ctx, proxyConfig)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, proxyConfig))).To(Succeed())
+			})
+			clusterProxyConfig := createClusterProxyConfig("overridden", selecting(payments))
+
+			reconciled := reconcileClusterProxyConfig(newTestClusterReconciler(k8sClient), clusterProxyConfig.Name)
+			Expect(injectedBy(payments, "web")).To(BeEmpty())
+			Expect(meta.IsStatusConditionTrue(reconciled.Status.Conditions, proxyv1beta1.ConditionConflict)).To(BeTrue())
+			Expect(reconciled.Status.Namespaces).To(HaveLen(1))
+			Expect(reconciled.Status.Namespaces[0].Workloads[0].Decisions).To(ContainElement(proxyv1beta1.WorkloadDecision{Name: "web", Inject: false, Reason: proxyv1beta1.DecisionOverridden}))
+		})
+
+		It("leaves the workloads to the ClusterProxyConfig with the highest priority", func() {
+			payments := createNamespace("payments")
+			low := createClusterProxyConfig("low", selecting(payments))
+			high := createClusterProxyConfig("high", func(clusterProxyConfig *proxyv1beta1.ClusterProxyConfig) {
+				selecting(payments)(clusterProxyConfig)
+				clusterProxyConfig.Spec.Priority = 10
+			})
+			r := newTestClusterReconciler(k8sClient)
+
+			reconcileClusterProxyConfig(r, low.Name)
+			Expect(injectedBy(payments, "web")).To(BeEmpty())
+			reconcileClusterProxyConfig(r, high.Name)
+			Expect(injectedBy(payments, "web")).To(Equal(clusterProxyConfigOwner(high.Name).String()))
+		})
+	})
+})
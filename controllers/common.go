@@ -2,10 +2,12 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/go-logr/logr"
-	proxyv1alpha1 "github.com/kenmoini/proxy-config-operator/api/v1alpha1"
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -19,19 +21,54 @@ import (
 //	}
 //}
 
-func createProxySecret(cl client.Client, ctx context.Context, log logr.Logger, secretName string, secretNamespace string, proxyConfig proxyv1alpha1.Proxy) error {
+// notOwnedError is returned when a Secret or ConfigMap the operator would write already exists,
+// but wasn't created for the ProxyConfig or ClusterProxyConfig writing it
+type notOwnedError struct {
+	kind  string
+	obj   metav1.Object
+	owner configOwner
+}
+
+func (e *notOwnedError) Error() string {
+	return fmt.Sprintf("%s %s/%s already exists and is not managed by %s, refusing to overwrite it", e.kind, e.obj.GetNamespace(), e.obj.GetName(), e.owner.String())
+}
+
+// isOwnedBy returns whether a Secret or ConfigMap carries the labels of an owner, ie the operator created it for the owner
+func isOwnedBy(obj metav1.Object, owner configOwner) bool {
+	for key, value := range owner.ownerLabels() {
+		if obj.GetLabels()[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// createProxySecret creates or updates the Secret holding a proxy configuration.
+// The ownerReferences are set when given, eg on the Secret of a single workload so it is garbage collected along with it.
+// A Secret created for a workload that doesn't exist yet records it instead, see adoptWorkloadProxySecrets.
+// An existing Secret is only updated when it was created for the owner, a notOwnedError is returned otherwise.
+func createProxySecret(cl client.Client, ctx context.Context, log logr.Logger, secretName string, secretNamespace string, proxyConfig proxyv1beta1.Proxy, owner configOwner, ownerReferences []metav1.OwnerReference, adoptBy *adoptionTarget) error {
 	secretCheck := corev1.Secret{}
+	noProxy := proxyv1beta1.FormatNoProxy(proxyConfig.NoProxy)
 
 	// Check to see if the secret already exists
 	err := cl.Get(ctx, types.NamespacedName{Name: secretName, Namespace: secretNamespace}, &secretCheck)
 	if err == nil {
-		// Secret already exists
+		// Secret already exists, eg one of the workload named by the proxy-secret-name annotation
+		if !isOwnedBy(&secretCheck, owner) {
+			return &notOwnedError{kind: "Secret", obj: &secretCheck, owner: owner}
+		}
 		// Check to see if it needs to be updated
-		if string(secretCheck.Data["http_proxy"]) != proxyConfig.HTTPProxy || string(secretCheck.Data["https_proxy"]) != proxyConfig.HTTPSProxy || string(secretCheck.Data["no_proxy"]) != proxyConfig.NoProxy {
+		ownerReferencesChanged := ownerReferences != nil && (!equality.Semantic.DeepEqual(secretCheck.OwnerReferences, ownerReferences) || secretCheck.Labels[PROXY_ADOPTION_KIND_LABEL] != "")
+		if string(secretCheck.Data["http_proxy"]) != proxyConfig.HTTPProxy || string(secretCheck.Data["https_proxy"]) != proxyConfig.HTTPSProxy || string(secretCheck.Data["no_proxy"]) != noProxy || ownerReferencesChanged {
 			secretCheck.Data = map[string][]byte{
 				"http_proxy":  []byte(proxyConfig.HTTPProxy),
 				"https_proxy": []byte(proxyConfig.HTTPSProxy),
-				"no_proxy":    []byte(proxyConfig.NoProxy),
+				"no_proxy":    []byte(noProxy),
+			}
+			if ownerReferences != nil {
+				secretCheck.OwnerReferences = ownerReferences
+				clearAdoptionTarget(&secretCheck)
 			}
 			err = cl.Update(ctx, &secretCheck)
 			if err != nil {
@@ -53,16 +90,21 @@ func createProxySecret(cl client.Client, ctx context.Context, log logr.Logger, s
 				APIVersion: "v1",
 			},
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      secretName,
-				Namespace: secretNamespace,
+				Name:            secretName,
+				Namespace:       secretNamespace,
+				Labels:          owner.ownerLabels(),
+				OwnerReferences: ownerReferences,
 			},
 			Data: map[string][]byte{
 				"http_proxy":  []byte(proxyConfig.HTTPProxy),
 				"https_proxy": []byte(proxyConfig.HTTPSProxy),
-				"no_proxy":    []byte(proxyConfig.NoProxy),
+				"no_proxy":    []byte(noProxy),
 			},
 		}
 
+		if adoptBy != nil {
+			adoptBy.record(&secret)
+		}
 		err := cl.Create(ctx, &secret)
 		if err != nil {
 			log.Error(err, "Failed to create Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
@@ -75,13 +117,13 @@ func createProxySecret(cl client.Client, ctx context.Context, log logr.Logger, s
 	return nil
 }
 
-func createWorkloadProxySecret(proxySecretName string, namespace string, proxyObj proxyv1alpha1.Proxy, workloadType string, cl client.Client, ctx context.Context, log logr.Logger) error {
+func createWorkloadProxySecret(proxySecretName string, namespace string, proxyObj proxyv1beta1.Proxy, owner configOwner, ownerReferences []metav1.OwnerReference, adoptBy *adoptionTarget, workloadType string, cl client.Client, ctx context.Context, log logr.Logger) error {
 	// Set the Proxy Secret Name
 	//proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, pod.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
 	//proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, secretNameLabelOverride)
 
 	// Create the Proxy Secret
-	err := createProxySecret(cl, ctx, lggr, proxySecretName, namespace, proxyObj)
+	err := createProxySecret(cl, ctx, lggr, proxySecretName, namespace, proxyObj, owner, ownerReferences, adoptBy)
 	if err != nil {
 		lggr.Error(err, "Failed to create Proxy Secret for "+workloadType+" in "+namespace+" Secret Name "+proxySecretName)
 		return err
@@ -107,22 +149,103 @@ func createOrUpdateEnvironmentVariable(envVars []corev1.EnvVar, envVarKey string
 	return envVars
 }
 
-func createWorkloadEnvVariables(currentEnvVars []corev1.EnvVar, proxySecretName string, proxyObj proxyv1alpha1.Proxy) []corev1.EnvVar {
+// proxyEnvVars returns the proxy environmental variables of a proxy configuration, read from its proxy Secret
+func proxyEnvVars(proxySecretName string, proxyObj proxyv1beta1.Proxy) []corev1.EnvVar {
+	fromSecret := func(name string, key string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: key}}}
+	}
 
-	// Add the proxy environmental variables
+	envVars := []corev1.EnvVar{}
 	if proxyObj.HTTPProxy != "" {
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "HTTP_PROXY", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "http_proxy"}})
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "http_proxy", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "http_proxy"}})
+		envVars = append(envVars, fromSecret("HTTP_PROXY", "http_proxy"), fromSecret("http_proxy", "http_proxy"))
 	}
 	if proxyObj.HTTPSProxy != "" {
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "HTTPS_PROXY", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "https_proxy"}})
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "https_proxy", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "https_proxy"}})
+		envVars = append(envVars, fromSecret("HTTPS_PROXY", "https_proxy"), fromSecret("https_proxy", "https_proxy"))
+	}
+	if len(proxyObj.NoProxy) > 0 {
+		envVars = append(envVars, fromSecret("NO_PROXY", "no_proxy"), fromSecret("no_proxy", "no_proxy"))
+	}
+	return envVars
+}
+
+// injectionOptions defines what is injected into the pod spec of a workload
+type injectionOptions struct {
+	proxySecretName string
+	proxy           proxyv1beta1.Proxy
+	// caCert is nil when no CA certificate is injected
+	caCert *caCertOptions
+	// containers decides which containers are injected
+	containers containerFilter
+	// conflictPolicy decides what happens to the proxy environmental variables a container sets itself
+	conflictPolicy proxyv1beta1.ConflictPolicy
+	// envFrom reads the variables provided by the envFrom sources of the containers, they are ignored when it is nil
+	envFrom envFromLookup
+	// contentHash is stamped on the pod templates to roll out the workload when it changes, unless empty
+	contentHash string
+	// overrides are the overrides read from the workload, their invalid values and deprecated labels are reported
+	// when they change
+	overrides workloadOverrides
+}
+
+// stampContentHash sets the content hash annotation on a pod template
+func stampContentHash(template *corev1.PodTemplateSpec, contentHash string, record *injectionRecord) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[PROXY_CONFIG_HASH_ANNOTATION] = contentHash
+	record.addAnnotation(PROXY_CONFIG_HASH_ANNOTATION)
+}
+
+// podContainer points at the name, environmental variables and volume mounts of a container of a pod spec,
+// whichever list holds it, so every type of container is injected and cleaned up the same way
+type podContainer struct {
+	// list is the field of the pod spec holding the container, eg "initContainers"
+	list          string
+	name          string
+	nativeSidecar bool
+	env           *[]corev1.EnvVar
+	envFrom       []corev1.EnvFromSource
+	volumeMounts  *[]corev1.VolumeMount
+}
+
+// podContainers returns every container of a pod spec: the containers, the init containers and native sidecars,
+// and the ephemeral containers
+func podContainers(podSpec *corev1.PodSpec) []podContainer {
+	containers := []podContainer{}
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		containers = append(containers, podContainer{list: "containers", name: c.Name, env: &c.Env, envFrom: c.EnvFrom, volumeMounts: &c.VolumeMounts})
 	}
-	if proxyObj.NoProxy != "" {
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "NO_PROXY", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "no_proxy"}})
-		currentEnvVars = createOrUpdateEnvironmentVariable(currentEnvVars, "no_proxy", corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: proxySecretName}, Key: "no_proxy"}})
+	for i := range podSpec.InitContainers {
+		c := &podSpec.InitContainers[i]
+		// Native sidecars are init containers that keep running along with the containers
+		nativeSidecar := c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways
+		containers = append(containers, podContainer{list: "initContainers", name: c.Name, nativeSidecar: nativeSidecar, env: &c.Env, envFrom: c.EnvFrom, volumeMounts: &c.VolumeMounts})
 	}
+	for i := range podSpec.EphemeralContainers {
+		c := &podSpec.EphemeralContainers[i]
+		containers = append(containers, podContainer{list: "ephemeralContainers", name: c.Name, env: &c.Env, envFrom: c.EnvFrom, volumeMounts: &c.VolumeMounts})
+	}
+	return containers
+}
 
-	return currentEnvVars
+// injectPodSpec injects the proxy environmental variables, and the CA certificate when requested, into the containers of a pod spec
+// selected by the container filter. Everything that is injected is added to the injection record, the previous one
+// tells the variables injected before apart from the ones the containers set themselves.
+func injectPodSpec(podSpec *corev1.PodSpec, opts injectionOptions, previous *injectionRecord, record *injectionRecord) error {
+	containers := opts.containers.selectContainers(podSpec)
+	for _, container := range containers {
+		injectContainerEnv(container, opts, previous, record)
+	}
 
+	if opts.caCert != nil && len(containers) > 0 {
+		podSpec.Volumes = createOrUpdateVolume(podSpec.Volumes, caCertVolume(opts.caCert))
+		record.addVolume(PROXY_CA_CERT_VOLUME_NAME)
+		for _, container := range containers {
+			if err := injectCACert(container, opts.caCert, record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
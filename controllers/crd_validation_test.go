@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	proxyv1alpha1 "github.com/kenmoini/proxy-config-operator/api/v1alpha1"
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// testCACert is a PEM block, the CRDs only check that the CA certificates look like PEM, the webhook parses them
+const testCACert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+// newCustomProxyConfig returns a v1beta1 ProxyConfig with a custom proxy configuration
+func newCustomProxyConfig(name string, proxy proxyv1beta1.Proxy) *proxyv1beta1.ProxyConfig {
+	return &proxyv1beta1.ProxyConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       proxyv1beta1.ProxyConfigSpec{ProxySource: "custom", Proxy: &proxy},
+	}
+}
+
+// expectCreated creates an object and deletes it again once the spec is over
+func expectCreated(ctx context.Context, obj client.Object) {
+	ExpectWithOffset(1, k8sClient.Create(ctx, obj)).To(Succeed())
+	DeferCleanup(func() {
+		Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, obj))).To(Succeed())
+	})
+}
+
+// expectInvalid fails unless creating an object is rejected as invalid with a message
+func expectInvalid(ctx context.Context, obj client.Object, message string) {
+	err := k8sClient.Create(ctx, obj)
+	ExpectWithOffset(1, errors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+	ExpectWithOffset(1, err.Error()).To(ContainSubstring(message))
+}
+
+var _ = Describe("Validating ProxyConfigs with the CRD schemas", func() {
+	ctx := context.Background()
+
+	Context("with the v1beta1 schema", func() {
+		It("accepts a valid proxy configuration", func() {
+			proxyConfig := newCustomProxyConfig("valid", proxyv1beta1.Proxy{
+				HTTPProxy:  "http://proxy.example.com:3128",
+				HTTPSProxy: "https://proxy.example.com:3129/",
+				NoProxy:    []string{".cluster.local", "10.0.0.0/8"},
+			})
+			proxyConfig.Spec.CACert = &proxyv1beta1.CACert{Inject: true, Source: &proxyv1beta1.CASource{Type: proxyv1beta1.CASourceInline, Inline: testCACert}}
+			expectCreated(ctx, proxyConfig)
+		})
+
+		It("accepts empty proxy URLs", func() {
+			expectCreated(ctx, newCustomProxyConfig("empty", proxyv1beta1.Proxy{NoProxy: []string{"localhost"}}))
+		})
+
+		It("rejects a proxy URL without a scheme", func() {
+			expectInvalid(ctx, newCustomProxyConfig("no-scheme", proxyv1beta1.Proxy{HTTPProxy: "proxy.example.com:3128"}), "httpProxy must be a URL")
+		})
+
+		It("rejects a proxy URL with a path", func() {
+			expectInvalid(ctx, newCustomProxyConfig("path", proxyv1beta1.Proxy{HTTPSProxy: "http://proxy.example.com:3128/path"}), "httpsProxy must be a URL")
+		})
+
+		It("rejects a proxy URL that is too long", func() {
+			long := "http://" + strings.Repeat("a", 2048) + ".example.com:3128"
+			expectInvalid(ctx, newCustomProxyConfig("long", proxyv1beta1.Proxy{HTTPProxy: long}), "Too long")
+		})
+
+		It("rejects empty noProxy entries", func() {
+			expectInvalid(ctx, newCustomProxyConfig("empty-entry", proxyv1beta1.Proxy{NoProxy: []string{"localhost", ""}}), "noProxy entries can't be empty")
+		})
+
+		It("rejects too many noProxy entries", func() {
+			noProxy := make([]string, 1025)
+			for i := range noProxy {
+				noProxy[i] = "host.example.com"
+			}
+			expectInvalid(ctx, newCustomProxyConfig("many-entries", proxyv1beta1.Proxy{NoProxy: noProxy}), "Too many")
+		})
+
+		It("rejects an inline CA certificate that isn't PEM", func() {
+			proxyConfig := newCustomProxyConfig("not-pem", proxyv1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128"})
+			proxyConfig.Spec.CACert = &proxyv1beta1.CACert{Inject: true, Source: &proxyv1beta1.CASource{Type: proxyv1beta1.CASourceInline, Inline: "not a certificate"}}
+			expectInvalid(ctx, proxyConfig, "inline must hold PEM encoded certificates")
+		})
+
+		It("validates the proxy configuration of ClusterProxyConfigs too", func() {
+			clusterProxyConfig := &proxyv1beta1.ClusterProxyConfig{ObjectMeta: metav1.ObjectMeta{Name: "no-scheme"}}
+			clusterProxyConfig.Spec.ProxySource = "custom"
+			clusterProxyConfig.Spec.Proxy = &proxyv1beta1.Proxy{HTTPProxy: "proxy.example.com:3128"}
+			expectInvalid(ctx, clusterProxyConfig, "httpProxy must be a URL")
+		})
+	})
+
+	// Valid v1alpha1 objects are converted to v1beta1 by the conversion webhook, that isn't running here
+	Context("with the v1alpha1 schema", func() {
+		newV1alpha1ProxyConfig := func(name string, proxy proxyv1alpha1.Proxy) *proxyv1alpha1.ProxyConfig {
+			return &proxyv1alpha1.ProxyConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       proxyv1alpha1.ProxyConfigSpec{ProxySource: "custom", Proxy: proxy},
+			}
+		}
+
+		It("rejects a noProxy list with empty entries", func() {
+			expectInvalid(ctx, newV1alpha1ProxyConfig("empty-entry-v1alpha1", proxyv1alpha1.Proxy{NoProxy: "localhost,,.cluster.local"}), "noProxy must be a comma separated list")
+		})
+
+		It("rejects a caBundle that isn't PEM", func() {
+			expectInvalid(ctx, newV1alpha1ProxyConfig("not-pem-v1alpha1", proxyv1alpha1.Proxy{CAConfig: proxyv1alpha1.CAConfig{CABundle: "not a certificate"}}), "caBundle must hold PEM encoded certificates")
+		})
+	})
+})
@@ -3,6 +3,7 @@ package controllers
 import (
 	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -13,12 +14,23 @@ const (
 	// +optional
 	PROXY_INJECTION_LABEL = "proxy.k8s.kemo.dev/inject-proxy-env"
 
-	// PROXY_INJECTION_SECRET_LABEL is the label used to determine which Secret to use for the proxy configuration
-	// Defaults to "proxy-config" which it will generate and maintain
+	// PROXY_SECRET_NAME_ANNOTATION is the annotation used to determine which Secret to use for the proxy configuration
+	// Defaults to "proxy-config-<ProxyConfig name>" which it will generate and maintain
+	// +optional
+	PROXY_SECRET_NAME_ANNOTATION = "proxy.k8s.kemo.dev/proxy-secret-name"
+
+	// PROXY_INJECTION_SECRET_LABEL is the deprecated label form of PROXY_SECRET_NAME_ANNOTATION, read when the annotation is not set
+	// Deprecated: use PROXY_SECRET_NAME_ANNOTATION
 	// +optional
 	PROXY_INJECTION_SECRET_LABEL = "proxy.k8s.kemo.dev/proxy-secret-name"
 
-	// PROXY_INJECTION_SECRET_DEFAULT_NAME is the default name of the Secret to use for the proxy configuration
+	// PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION is the annotation set on the legacy shared proxy Secret of a namespace once the operator
+	// migrated a workload it injected from it to the Secret of a ProxyConfig, holding that ProxyConfig.
+	// Only the legacy Secrets carrying it are deleted once nothing reads them.
+	PROXY_LEGACY_SECRET_MIGRATED_ANNOTATION = "proxy.k8s.kemo.dev/migrated-to"
+
+	// PROXY_INJECTION_SECRET_DEFAULT_NAME is the default name of the Secret to use for the proxy configuration,
+	// suffixed with the name of the ProxyConfig so several ProxyConfigs in a namespace don't share it
 	// Defaults to "proxy-config"
 	// +optional
 	PROXY_INJECTION_SECRET_DEFAULT_NAME = "proxy-config"
@@ -29,17 +41,28 @@ const (
 	// +optional
 	PROXY_CA_CERT_INJECTION_LABEL = "proxy.k8s.kemo.dev/inject-ca-cert"
 
-	// PROXY_CA_CERT_CONFIGMAP_LABEL is the label used to determine which ConfigMap to use for the CA certificate
-	// Defaults to "proxy-ca-cert" which it will generate and maintain
+	// PROXY_CA_CERT_CONFIGMAP_ANNOTATION is the annotation used to determine which ConfigMap to use for the CA certificate
+	// Defaults to "proxy-ca-cert-<ProxyConfig name>" which it will generate and maintain
+	// +optional
+	PROXY_CA_CERT_CONFIGMAP_ANNOTATION = "proxy.k8s.kemo.dev/ca-cert-configmap-name"
+
+	// PROXY_CA_CERT_CONFIGMAP_LABEL is the deprecated label form of PROXY_CA_CERT_CONFIGMAP_ANNOTATION, read when the annotation is not set
+	// Deprecated: use PROXY_CA_CERT_CONFIGMAP_ANNOTATION
 	// +optional
 	PROXY_CA_CERT_CONFIGMAP_LABEL = "proxy.k8s.kemo.dev/ca-cert-configmap-name"
 
-	// PROXY_CA_CERT_CONFIGMAP_KEY_LABEL is the label used to determine which key of the ConfigMap to use for the CA certificate
+	// PROXY_CA_CERT_CONFIGMAP_KEY_ANNOTATION is the annotation used to determine which key of the ConfigMap to use for the CA certificate
 	// Defaults to "ca-bundle.crt" which it will generate and maintain
 	// +optional
+	PROXY_CA_CERT_CONFIGMAP_KEY_ANNOTATION = "proxy.k8s.kemo.dev/ca-cert-configmap-key"
+
+	// PROXY_CA_CERT_CONFIGMAP_KEY_LABEL is the deprecated label form of PROXY_CA_CERT_CONFIGMAP_KEY_ANNOTATION, read when the annotation is not set
+	// Deprecated: use PROXY_CA_CERT_CONFIGMAP_KEY_ANNOTATION
+	// +optional
 	PROXY_CA_CERT_CONFIGMAP_KEY_LABEL = "proxy.k8s.kemo.dev/ca-cert-configmap-key"
 
-	// PROXY_CA_CERT_CONFIGMAP_DEFAULT_NAME is the default name of the ConfigMap to use for the CA certificate
+	// PROXY_CA_CERT_CONFIGMAP_DEFAULT_NAME is the default name of the ConfigMap to use for the CA certificate,
+	// suffixed with the name of the ProxyConfig
 	// Defaults to "proxy-ca-cert"
 	// +optional
 	PROXY_CA_CERT_CONFIGMAP_DEFAULT_NAME = "proxy-ca-cert"
@@ -49,9 +72,15 @@ const (
 	// +optional
 	PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY = "ca-bundle.crt"
 
-	// PROXY_CA_CERT_MOUNT_PATH_LABEL is the label used to determine which mount path to use for the CA certificate
+	// PROXY_CA_CERT_MOUNT_PATH_ANNOTATION is the annotation used to determine which mount path to use for the CA certificate
 	// Defaults to "/etc/pki/ca-trust/extracted/pem"
 	// +optional
+	PROXY_CA_CERT_MOUNT_PATH_ANNOTATION = "proxy.k8s.kemo.dev/ca-cert-mount-path"
+
+	// PROXY_CA_CERT_MOUNT_PATH_LABEL is the deprecated label form of PROXY_CA_CERT_MOUNT_PATH_ANNOTATION, read when the annotation is not set.
+	// Most mount paths are not valid label values.
+	// Deprecated: use PROXY_CA_CERT_MOUNT_PATH_ANNOTATION
+	// +optional
 	PROXY_CA_CERT_MOUNT_PATH_LABEL = "proxy.k8s.kemo.dev/ca-cert-mount-path"
 
 	// PROXY_CA_CERT_MOUNT_PATH is the default mount path to use for the CA certificate
@@ -59,9 +88,141 @@ const (
 	// +optional
 	PROXY_CA_CERT_MOUNT_PATH = "/etc/pki/ca-trust/extracted/pem"
 
+	// PROXY_CA_CERT_VOLUME_NAME is the name of the volume used to mount the CA certificate ConfigMap
+	PROXY_CA_CERT_VOLUME_NAME = "proxy-ca-cert"
+
+	// PROXY_CA_CERT_FILE_NAME is the file name the CA certificate is mounted as in the mount path
+	PROXY_CA_CERT_FILE_NAME = "tls-ca-bundle.pem"
+
+	// PROXY_INJECTED_ANNOTATION is the annotation recording what the operator injected into a workload
+	// It is used to remove exactly those entries when the workload opts out or the ProxyConfig is deleted
+	PROXY_INJECTED_ANNOTATION = "proxy.k8s.kemo.dev/injected"
+
+	// PROXY_CONFIG_OWNER_LABEL is the label set on the Secrets and ConfigMaps the operator creates,
+	// holding the name of the ProxyConfig they were created for
+	PROXY_CONFIG_OWNER_LABEL = "proxy.k8s.kemo.dev/proxy-config"
+
+	// PROXY_CLUSTER_CONFIG_OWNER_LABEL is the label set on the Secrets and ConfigMaps the operator creates,
+	// holding the name of the ClusterProxyConfig they were created for
+	PROXY_CLUSTER_CONFIG_OWNER_LABEL = "proxy.k8s.kemo.dev/cluster-proxy-config"
+
+	// CLUSTER_PROXY_SECRET_NAME_PREFIX prefixes the name of a ClusterProxyConfig to name the proxy Secret it distributes,
+	// so it doesn't collide with the Secrets of the ProxyConfigs in the same namespace
+	CLUSTER_PROXY_SECRET_NAME_PREFIX = "cluster-proxy-config-"
+
+	// CLUSTER_PROXY_CA_CERT_CONFIGMAP_NAME_PREFIX prefixes the name of a ClusterProxyConfig to name the CA certificate ConfigMap it distributes
+	CLUSTER_PROXY_CA_CERT_CONFIGMAP_NAME_PREFIX = "cluster-proxy-ca-cert-"
+
+	// PROXY_HTTP_PROXY_ANNOTATION is the annotation replacing the HTTP proxy of the proxy configuration for a single workload
+	// +optional
+	PROXY_HTTP_PROXY_ANNOTATION = "proxy.k8s.kemo.dev/http-proxy"
+
+	// PROXY_HTTPS_PROXY_ANNOTATION is the annotation replacing the HTTPS proxy of the proxy configuration for a single workload
+	// +optional
+	PROXY_HTTPS_PROXY_ANNOTATION = "proxy.k8s.kemo.dev/https-proxy"
+
+	// PROXY_NO_PROXY_ANNOTATION is the annotation holding comma separated noProxy entries appended to the proxy configuration for a single workload
+	// +optional
+	PROXY_NO_PROXY_ANNOTATION = "proxy.k8s.kemo.dev/no-proxy"
+
+	// PROXY_INCLUDE_CONTAINERS_ANNOTATION is the annotation holding the comma separated names of the containers of a single workload
+	// the proxy configuration is injected into, replacing the include list of the proxy configuration
+	// +optional
+	PROXY_INCLUDE_CONTAINERS_ANNOTATION = "proxy.k8s.kemo.dev/include-containers"
+
+	// PROXY_EXCLUDE_CONTAINERS_ANNOTATION is the annotation holding the comma separated names of the containers of a single workload
+	// that are not injected, on top of the exclude list of the proxy configuration
+	// +optional
+	PROXY_EXCLUDE_CONTAINERS_ANNOTATION = "proxy.k8s.kemo.dev/exclude-containers"
+
+	// EVENT_REASON_INVALID_OVERRIDE is the reason of the events recorded on workloads with an invalid override annotation or label
+	EVENT_REASON_INVALID_OVERRIDE = "InvalidOverride"
+
+	// EVENT_REASON_NOT_OWNED is the reason of the events recorded on workloads referencing a Secret or ConfigMap
+	// that exists but wasn't created by the operator
+	EVENT_REASON_NOT_OWNED = "ProxyObjectNotOwned"
+
+	// EVENT_REASON_ENV_CONFLICT is the reason of the events recorded on workloads whose containers set proxy environmental variables themselves
+	EVENT_REASON_ENV_CONFLICT = "ProxyEnvConflict"
+
+	// EVENT_REASON_LEGACY_SECRET_KEPT is the reason of the events recorded on a legacy shared proxy Secret nothing reads anymore,
+	// which is kept since the operator didn't migrate a workload from it
+	EVENT_REASON_LEGACY_SECRET_KEPT = "LegacyProxySecretKept"
+
+	// PROXY_CONFIG_HASH_ANNOTATION is the pod template annotation holding a hash of the injected proxy configuration and CA certificate.
+	// Changing it triggers a rollout of the workload, picking up the new values.
+	PROXY_CONFIG_HASH_ANNOTATION = "proxy.k8s.kemo.dev/config-hash"
+
+	// PROXY_INJECTION_WEBHOOK_PATH is the path the mutating admission webhook injecting Pods, Jobs and workloads is served at
+	PROXY_INJECTION_WEBHOOK_PATH = "/mutate-proxy-injection"
+
+	// WEBHOOK_CERT_SECRET_NAME is the name of the Secret the webhook certificates are provisioned in, in the namespace of the manager
+	WEBHOOK_CERT_SECRET_NAME = "proxy-config-operator-webhook-server-cert"
+
+	// WEBHOOK_SERVICE_NAME is the default name of the Service in front of the webhook server, as prefixed by config/default
+	WEBHOOK_SERVICE_NAME = "proxy-config-operator-webhook-service"
+
+	// MUTATING_WEBHOOK_CONFIGURATION_NAME is the default name of the MutatingWebhookConfiguration of the operator, as prefixed by config/default
+	MUTATING_WEBHOOK_CONFIGURATION_NAME = "proxy-config-operator-mutating-webhook-configuration"
+
+	// VALIDATING_WEBHOOK_CONFIGURATION_NAME is the default name of the ValidatingWebhookConfiguration of the operator, as prefixed by config/default
+	VALIDATING_WEBHOOK_CONFIGURATION_NAME = "proxy-config-operator-validating-webhook-configuration"
+
+	// PROXY_CONFIG_CRD_NAME is the name of the ProxyConfig CustomResourceDefinition
+	PROXY_CONFIG_CRD_NAME = "proxyconfigs.proxy.k8s.kemo.dev"
+
+	// FIELD_MANAGER is the field manager the operator writes workloads with, owning only the fields it injects
+	FIELD_MANAGER = "proxy-config-operator"
+
+	// PROXY_WEBHOOK_NAMESPACE_LABEL is the label set on the namespaces a ProxyConfig or ClusterProxyConfig applies to,
+	// the proxy injection webhook is only sent the objects of the namespaces carrying it
+	PROXY_WEBHOOK_NAMESPACE_LABEL = "proxy.k8s.kemo.dev/webhook"
+
+	// PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE is the value of PROXY_WEBHOOK_NAMESPACE_LABEL
+	PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE = "enabled"
+
+	// PROXY_CONFIG_FINALIZER is the finalizer used to clean up the workloads before a ProxyConfig or ClusterProxyConfig is deleted
+	PROXY_CONFIG_FINALIZER = "proxy.k8s.kemo.dev/finalizer"
+
+	// TRUSTED_CA_BUNDLE_LABEL is the label the Cluster Network Operator watches for to inject the trusted CA bundle into a ConfigMap
+	TRUSTED_CA_BUNDLE_LABEL = "config.openshift.io/inject-trusted-cabundle"
+
+	// WORKLOAD_SECRET_ADOPTION_GRACE_PERIOD is how long the proxy Secret created for a workload at admission is kept
+	// while nothing reads it, giving the admitted object time to be created
+	WORKLOAD_SECRET_ADOPTION_GRACE_PERIOD = 10 * time.Minute
+
+	// PROXY_ADOPTION_KIND_LABEL is the label holding the kind of the workload a proxy Secret was created for at admission,
+	// before the workload existed and could own it. It is removed once the workload adopted the Secret.
+	PROXY_ADOPTION_KIND_LABEL = "proxy.k8s.kemo.dev/adopt-kind"
+
+	// PROXY_ADOPTION_NAME_ANNOTATION is the annotation holding the name of the workload a proxy Secret was created for at admission
+	PROXY_ADOPTION_NAME_ANNOTATION = "proxy.k8s.kemo.dev/adopt-name"
+
+	// PROXY_ADOPTION_GENERATE_NAME_ANNOTATION is the annotation holding the generateName of the workload a proxy Secret
+	// was created for at admission, when its name wasn't known yet
+	PROXY_ADOPTION_GENERATE_NAME_ANNOTATION = "proxy.k8s.kemo.dev/adopt-generate-name"
+
+	// PROXY_SECRETS_MIGRATED_ANNOTATION is set on a ProxyConfig or ClusterProxyConfig once the proxy Secrets created at
+	// admission before they were labeled with PROXY_ADOPTION_KIND_LABEL were adopted, so they are only looked for once
+	PROXY_SECRETS_MIGRATED_ANNOTATION = "proxy.k8s.kemo.dev/admission-secrets-migrated"
+
+	// STATUS_MAX_LISTED_WORKLOADS is the number of workloads listed per kind in each list of the workload status,
+	// the others are only counted so the status stays well below the size limit of an object
+	STATUS_MAX_LISTED_WORKLOADS = 50
+
+	// CONDITION_MAX_LISTED_CONFLICTS is the number of overridden workloads named in the message of the Conflict condition
+	CONDITION_MAX_LISTED_CONFLICTS = 10
+
+	// OPENSHIFT_CONFIG_NAMESPACE is the namespace holding the ConfigMap referenced by the trustedCA of the cluster Proxy
+	OPENSHIFT_CONFIG_NAMESPACE = "openshift-config"
+
 	DEFAULT_PROXY_SOURCE = "openshift"
 )
 
+// DEFAULT_EXCLUDED_CONTAINERS are the well-known sidecars that are not injected unless they are explicitly included,
+// they reach the network on behalf of the other containers or must not be proxied themselves
+var DEFAULT_EXCLUDED_CONTAINERS = []string{"istio-proxy", "linkerd-proxy", "oauth-proxy"}
+
 // OpenShiftProxy returns the namespaced name "cluster" in the
 // default namespace.
 func OpenShiftProxy() types.NamespacedName {
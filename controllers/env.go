@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// envFromLookup returns the variables an envFrom source of a container provides, by name, along with the source
+// they are read from, eg "ConfigMap app-env"
+type envFromLookup func(source corev1.EnvFromSource) (map[string]string, string)
+
+// envFromCache memoizes the ConfigMaps and Secrets read as envFrom sources, by namespace, kind and name,
+// so the ones shared by several workloads are read once per reconciliation
+type envFromCache map[envFromKey]envFromData
+
+type envFromKey struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+// envFromData is the data of an envFrom source, and the source it is read from, which is empty when it can't be read
+type envFromData struct {
+	data   map[string]string
+	source string
+}
+
+// readEnvFrom returns the lookup of the envFrom sources of the containers in a namespace, memoized in a cache unless it is nil.
+// Sources that can't be read are ignored, like the kubelet does for optional ones.
+func (r *ProxyConfigReconciler) readEnvFrom(ctx context.Context, namespace string, cache envFromCache) envFromLookup {
+	return func(source corev1.EnvFromSource) (map[string]string, string) {
+		var key envFromKey
+		switch {
+		case source.ConfigMapRef != nil:
+			key = envFromKey{namespace: namespace, kind: "ConfigMap", name: source.ConfigMapRef.Name}
+		case source.SecretRef != nil:
+			key = envFromKey{namespace: namespace, kind: "Secret", name: source.SecretRef.Name}
+		default:
+			return map[string]string{}, ""
+		}
+
+		read, ok := cache[key]
+		if !ok {
+			read = r.readEnvFromSource(ctx, key)
+			if cache != nil {
+				cache[key] = read
+			}
+		}
+		values := map[string]string{}
+		for name, value := range read.data {
+			values[source.Prefix+name] = value
+		}
+		return values, read.source
+	}
+}
+
+// readEnvFromSource reads the data of the ConfigMap or Secret of an envFrom source
+func (r *ProxyConfigReconciler) readEnvFromSource(ctx context.Context, key envFromKey) envFromData {
+	read := envFromData{data: map[string]string{}}
+	if key.kind == "ConfigMap" {
+		configMap := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Name: key.name, Namespace: key.namespace}, configMap); err != nil {
+			lggr.Info("Ignoring envFrom ConfigMap "+key.name+": "+err.Error(), "Namespace", key.namespace)
+			return read
+		}
+		for name, value := range configMap.Data {
+			read.data[name] = value
+		}
+	} else {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Name: key.name, Namespace: key.namespace}, secret); err != nil {
+			lggr.Info("Ignoring envFrom Secret "+key.name+": "+err.Error(), "Namespace", key.namespace)
+			return read
+		}
+		for name, value := range secret.Data {
+			read.data[name] = string(value)
+		}
+	}
+	read.source = key.kind + " " + key.name
+	return read
+}
+
+// envFromValue is the value of a variable provided by an envFrom source, and where it is read from
+type envFromValue struct {
+	value  string
+	source string
+}
+
+// envFromProvider returns the variable of a name the envFrom sources of a container provide, if any
+type envFromProvider func(name string) (envFromValue, bool)
+
+// envFromValues returns the provider of the variables the envFrom sources of a container provide.
+// The sources are only read once a variable is looked up, ie one the container doesn't set in env.
+// Later sources take precedence, like they do in the container.
+func envFromValues(container podContainer, lookup envFromLookup) envFromProvider {
+	var provided map[string]envFromValue
+	return func(name string) (envFromValue, bool) {
+		if provided == nil {
+			provided = map[string]envFromValue{}
+			if lookup != nil {
+				for _, source := range container.envFrom {
+					values, from := lookup(source)
+					for name, value := range values {
+						provided[name] = envFromValue{value: value, source: from}
+					}
+				}
+			}
+		}
+		value, ok := provided[name]
+		return value, ok
+	}
+}
+
+// isNoProxyVar returns whether an environmental variable holds noProxy entries
+func isNoProxyVar(name string) bool {
+	return name == "NO_PROXY" || name == "no_proxy"
+}
+
+// injectContainerEnv injects the proxy environmental variables into a container,
+// resolving the conflicts with the ones it sets itself according to the conflict policy
+func injectContainerEnv(container podContainer, opts injectionOptions, previous *injectionRecord, record *injectionRecord) {
+	provided := envFromValues(container, opts.envFrom)
+	for _, envVar := range proxyEnvVars(opts.proxySecretName, opts.proxy) {
+		injectEnvVar(container, envVar, opts, provided, previous, record)
+	}
+}
+
+// injectEnvVar sets a proxy environmental variable in a container. When the container sets the variable itself,
+// in its env or through envFrom, the conflict policy decides whether it is overwritten, preserved or merged with,
+// and the conflict is added to the injection record.
+// Variables set in env that are overwritten or merged into are kept in the record, so they can be restored.
+func injectEnvVar(container podContainer, envVar corev1.EnvVar, opts injectionOptions, provided envFromProvider, previous *injectionRecord, record *injectionRecord) {
+	name := envVar.Name
+
+	// Find the variable as the container sets it, if it does, telling it apart from the one injected before
+	var own *corev1.EnvVar
+	source := ""
+	existing := envVarIndex(*container.env, name)
+	if original, ok := previous.original(container.name, name); ok {
+		own, source = &original, "env"
+	} else if existing >= 0 && !previous.hasEnv(container.name, name) && !isLegacyInjectedEnvVar((*container.env)[existing]) {
+		e := (*container.env)[existing]
+		own, source = &e, "env"
+	} else if p, ok := provided(name); ok {
+		// Variables set in env take precedence over envFrom, including the injected ones
+		own, source = &corev1.EnvVar{Name: name, Value: p.value}, p.source
+	}
+
+	if source == "" {
+		*container.env = createOrUpdateEnvironmentVariable(*container.env, name, *envVar.ValueFrom)
+		record.addEnv(container.name, name)
+		return
+	}
+
+	resolution := proxyv1beta1.ResolutionOverwritten
+	switch policy := proxyv1beta1.ConflictPolicy(SetDefaultString(string(proxyv1beta1.ConflictPolicyOverwrite), string(opts.conflictPolicy))); {
+	case policy == proxyv1beta1.ConflictPolicyMerge && isNoProxyVar(name) && own.ValueFrom == nil:
+		merged := mergeProxy(proxyv1beta1.Proxy{NoProxy: proxyv1beta1.ParseNoProxy(own.Value)}, opts.proxy)
+		*container.env = setEnvVarValue(*container.env, name, proxyv1beta1.FormatNoProxy(merged.NoProxy))
+		record.addEnv(container.name, name)
+		if source == "env" {
+			record.addOriginal(container.name, *own)
+		}
+		resolution = proxyv1beta1.ResolutionMerged
+	case policy == proxyv1beta1.ConflictPolicyPreserve || policy == proxyv1beta1.ConflictPolicyMerge:
+		// A variable overwritten or merged into before is restored, and kept in the record so it isn't removed along with what was injected
+		if original, ok := previous.original(container.name, name); ok {
+			*container.env = setEnvVar(*container.env, original)
+			record.addEnv(container.name, name)
+			record.addOriginal(container.name, original)
+		}
+		resolution = proxyv1beta1.ResolutionPreserved
+	default:
+		*container.env = createOrUpdateEnvironmentVariable(*container.env, name, *envVar.ValueFrom)
+		record.addEnv(container.name, name)
+		if source == "env" {
+			record.addOriginal(container.name, *own)
+		}
+	}
+	record.addEnvConflict(proxyv1beta1.EnvConflict{Container: container.name, Variable: name, Source: source, Resolution: resolution})
+}
+
+// envVarIndex returns the index of an environmental variable in a list, or -1 when it isn't there
+func envVarIndex(envVars []corev1.EnvVar, name string) int {
+	for i := range envVars {
+		if envVars[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// setEnvVarValue sets an environmental variable to a literal value, adding it when it isn't there
+func setEnvVarValue(envVars []corev1.EnvVar, name string, value string) []corev1.EnvVar {
+	return setEnvVar(envVars, corev1.EnvVar{Name: name, Value: value})
+}
+
+// setEnvVar sets an environmental variable, adding it when it isn't there
+func setEnvVar(envVars []corev1.EnvVar, envVar corev1.EnvVar) []corev1.EnvVar {
+	if i := envVarIndex(envVars, envVar.Name); i >= 0 {
+		envVars[i] = envVar
+		return envVars
+	}
+	return append(envVars, envVar)
+}
+
+// reportEnvConflicts records an event on a workload for every proxy environmental variable its containers set themselves
+func (r *ProxyConfigReconciler) reportEnvConflicts(workload client.Object, conflicts []proxyv1beta1.EnvConflict, owner configOwner) {
+	if r.Recorder == nil {
+		return
+	}
+	for _, conflict := range conflicts {
+		r.Recorder.Event(workload, corev1.EventTypeWarning, EVENT_REASON_ENV_CONFLICT,
+			conflict.Variable+" of container "+conflict.Container+" is set by "+conflict.Source+", "+strings.ToLower(conflict.Resolution)+" by the conflictPolicy of "+owner.String())
+	}
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// injectTestDeployment injects a test Deployment in place, and returns the variables of its container and its injection record
+func injectTestDeployment(deployment *appsv1.Deployment, opts injectionOptions) ([]corev1.EnvVar, *injectionRecord) {
+	_, record, err := mutateWorkload(DeploymentAdapter, deployment, opts, proxyConfigOwner("test"))
+	Expect(err).NotTo(HaveOccurred())
+	return deployment.Spec.Template.Spec.Containers[0].Env, record
+}
+
+// stripTestDeployment removes what was injected into a test Deployment, and returns the variables of its container
+func stripTestDeployment(deployment *appsv1.Deployment) []corev1.EnvVar {
+	record, err := readInjectionRecord(deployment)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(record).NotTo(BeNil())
+	stripPodTemplate(&deployment.Spec.Template, record)
+	return deployment.Spec.Template.Spec.Containers[0].Env
+}
+
+// envVarNamed returns the environmental variable of a name, failing when it isn't set
+func envVarNamed(env []corev1.EnvVar, name string) corev1.EnvVar {
+	i := envVarIndex(env, name)
+	ExpectWithOffset(1, i).To(BeNumerically(">=", 0), "%s is not set", name)
+	return env[i]
+}
+
+// expectInjected fails unless an environmental variable reads the proxy Secret of the test ProxyConfig
+func expectInjected(envVar corev1.EnvVar) {
+	ExpectWithOffset(1, envVar.Value).To(BeEmpty())
+	ExpectWithOffset(1, envVar.ValueFrom).NotTo(BeNil())
+	ExpectWithOffset(1, envVar.ValueFrom.SecretKeyRef.Name).To(Equal(proxyConfigOwner("test").proxySecretName()))
+}
+
+var _ = Describe("Injecting the proxy environmental variables", func() {
+	own := corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own.example.com:8080"}
+	ownNoProxy := corev1.EnvVar{Name: "NO_PROXY", Value: "localhost,.internal"}
+
+	It("injects and removes the variables a container doesn't set", func() {
+		deployment := newTestDeployment("plain", corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"})
+		env, record := injectTestDeployment(deployment, testInjectionOptions(""))
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+			expectInjected(envVarNamed(env, name))
+		}
+		Expect(record.conflicts).To(BeEmpty())
+
+		Expect(stripTestDeployment(deployment)).To(Equal([]corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}))
+	})
+
+	Context("with the Overwrite policy", func() {
+		It("replaces the variable set by the container, and restores it on cleanup", func() {
+			deployment := newTestDeployment("overwrite", own)
+			env, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			expectInjected(envVarNamed(env, "HTTP_PROXY"))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "overwrite", Container: "app", Variable: "HTTP_PROXY", Source: "env", Resolution: proxyv1beta1.ResolutionOverwritten}))
+
+			// Injecting again keeps the variable of the container in the record
+			env, _ = injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			expectInjected(envVarNamed(env, "HTTP_PROXY"))
+
+			env = stripTestDeployment(deployment)
+			Expect(envVarNamed(env, "HTTP_PROXY")).To(Equal(own))
+			Expect(envVarIndex(env, "NO_PROXY")).To(Equal(-1))
+		})
+
+		It("replaces a variable provided by envFrom without recording it", func() {
+			deployment := newTestDeployment("envfrom")
+			deployment.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}}}
+			opts := testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite)
+			opts.envFrom = func(source corev1.EnvFromSource) (map[string]string, string) {
+				return map[string]string{"HTTP_PROXY": "http://own.example.com:8080"}, "ConfigMap " + source.ConfigMapRef.Name
+			}
+			env, record := injectTestDeployment(deployment, opts)
+			expectInjected(envVarNamed(env, "HTTP_PROXY"))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "envfrom", Container: "app", Variable: "HTTP_PROXY", Source: "ConfigMap app-env", Resolution: proxyv1beta1.ResolutionOverwritten}))
+			Expect(record.Originals).To(BeEmpty())
+
+			Expect(stripTestDeployment(deployment)).To(BeEmpty())
+		})
+
+		It("replaces a variable reading the legacy shared proxy Secret without recording it", func() {
+			legacy := corev1.EnvVar{Name: "HTTP_PROXY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: PROXY_INJECTION_SECRET_DEFAULT_NAME}, Key: "http_proxy"}}}
+			deployment := newTestDeployment("legacy", legacy)
+			env, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			expectInjected(envVarNamed(env, "HTTP_PROXY"))
+			Expect(record.conflicts).To(BeEmpty())
+
+			Expect(stripTestDeployment(deployment)).To(BeEmpty())
+		})
+	})
+
+	Context("with the Preserve policy", func() {
+		It("keeps the variable set by the container", func() {
+			deployment := newTestDeployment("preserve", own)
+			env, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyPreserve))
+			Expect(envVarNamed(env, "HTTP_PROXY")).To(Equal(own))
+			expectInjected(envVarNamed(env, "http_proxy"))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "preserve", Container: "app", Variable: "HTTP_PROXY", Source: "env", Resolution: proxyv1beta1.ResolutionPreserved}))
+
+			Expect(stripTestDeployment(deployment)).To(Equal([]corev1.EnvVar{own}))
+		})
+
+		It("restores the variable overwritten before the policy changed", func() {
+			deployment := newTestDeployment("switch", own)
+			injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			env, _ := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyPreserve))
+			Expect(envVarNamed(env, "HTTP_PROXY")).To(Equal(own))
+
+			Expect(stripTestDeployment(deployment)).To(Equal([]corev1.EnvVar{own}))
+		})
+	})
+
+	Context("with the Merge policy", func() {
+		It("merges the noProxy entries set by the container, and restores them on cleanup", func() {
+			deployment := newTestDeployment("merge", ownNoProxy)
+			env, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyMerge))
+			merged := envVarNamed(env, "NO_PROXY")
+			Expect(merged.ValueFrom).To(BeNil())
+			Expect(proxyv1beta1.ParseNoProxy(merged.Value)).To(ConsistOf("localhost", ".internal", ".cluster.local"))
+			expectInjected(envVarNamed(env, "no_proxy"))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "merge", Container: "app", Variable: "NO_PROXY", Source: "env", Resolution: proxyv1beta1.ResolutionMerged}))
+
+			Expect(stripTestDeployment(deployment)).To(Equal([]corev1.EnvVar{ownNoProxy}))
+		})
+
+		It("merges the noProxy entries provided by envFrom into the variable it sets", func() {
+			deployment := newTestDeployment("merge-envfrom")
+			deployment.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}}}
+			opts := testInjectionOptions(proxyv1beta1.ConflictPolicyMerge)
+			opts.envFrom = func(source corev1.EnvFromSource) (map[string]string, string) {
+				return map[string]string{"NO_PROXY": "localhost,.internal"}, "ConfigMap " + source.ConfigMapRef.Name
+			}
+			env, record := injectTestDeployment(deployment, opts)
+			merged := envVarNamed(env, "NO_PROXY")
+			Expect(merged.ValueFrom).To(BeNil())
+			Expect(proxyv1beta1.ParseNoProxy(merged.Value)).To(ConsistOf("localhost", ".internal", ".cluster.local"))
+			expectInjected(envVarNamed(env, "no_proxy"))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "merge-envfrom", Container: "app", Variable: "NO_PROXY", Source: "ConfigMap app-env", Resolution: proxyv1beta1.ResolutionMerged}))
+			Expect(record.Originals).To(BeEmpty())
+
+			// The merged variable is removed on cleanup, the container reads its own through envFrom again
+			Expect(stripTestDeployment(deployment)).To(BeEmpty())
+		})
+
+		It("keeps the proxy URLs set by the container", func() {
+			deployment := newTestDeployment("merge-url", own)
+			env, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyMerge))
+			Expect(envVarNamed(env, "HTTP_PROXY")).To(Equal(own))
+			Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: "merge-url", Container: "app", Variable: "HTTP_PROXY", Source: "env", Resolution: proxyv1beta1.ResolutionPreserved}))
+		})
+	})
+
+	Context("reading the envFrom sources", func() {
+		envFrom := []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}}}
+
+		// newCountingReconciler returns a reconciler reading the app-env ConfigMap from a fake client, counting the reads
+		newCountingReconciler := func(reads *int) *ProxyConfigReconciler {
+			configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app-env", Namespace: "default"}, Data: map[string]string{"HTTPS_PROXY": "http://own.example.com:8080"}}
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(configMap).WithInterceptorFuncs(interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					*reads++
+					return c.Get(ctx, key, obj, opts...)
+				},
+			}).Build()
+			return &ProxyConfigReconciler{Client: c, APIReader: c, Scheme: scheme.Scheme}
+		}
+
+		It("reads a source shared by several workloads once", func() {
+			reads := 0
+			r := newCountingReconciler(&reads)
+			cache := envFromCache{}
+			for _, name := range []string{"first", "second"} {
+				deployment := newTestDeployment(name)
+				deployment.Spec.Template.Spec.Containers[0].EnvFrom = envFrom
+				opts := testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite)
+				opts.proxy.HTTPSProxy = "http://proxy.example.com:3128"
+				opts.envFrom = r.readEnvFrom(context.Background(), "default", cache)
+				_, record := injectTestDeployment(deployment, opts)
+				Expect(record.conflicts).To(ConsistOf(proxyv1beta1.EnvConflict{Name: name, Container: "app", Variable: "HTTPS_PROXY", Source: "ConfigMap app-env", Resolution: proxyv1beta1.ResolutionOverwritten}))
+			}
+			Expect(reads).To(Equal(1))
+		})
+
+		It("doesn't read the sources of a container setting every variable in env", func() {
+			reads := 0
+			r := newCountingReconciler(&reads)
+			deployment := newTestDeployment("own-env", own, ownNoProxy, corev1.EnvVar{Name: "http_proxy", Value: own.Value}, corev1.EnvVar{Name: "no_proxy", Value: ownNoProxy.Value})
+			deployment.Spec.Template.Spec.Containers[0].EnvFrom = envFrom
+			opts := testInjectionOptions(proxyv1beta1.ConflictPolicyPreserve)
+			opts.envFrom = r.readEnvFrom(context.Background(), "default", envFromCache{})
+			injectTestDeployment(deployment, opts)
+			Expect(reads).To(BeZero())
+		})
+	})
+
+	Context("reporting the conflicts", func() {
+		It("only reports them again once they change", func() {
+			deployment := newTestDeployment("report", own)
+			_, record := injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			Expect(record.conflictsChanged).To(BeTrue())
+
+			_, record = injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyOverwrite))
+			Expect(record.conflictsChanged).To(BeFalse())
+
+			_, record = injectTestDeployment(deployment, testInjectionOptions(proxyv1beta1.ConflictPolicyPreserve))
+			Expect(record.conflictsChanged).To(BeTrue())
+		})
+
+		It("doesn't report a workload without conflicts", func() {
+			deployment := newTestDeployment("quiet")
+			_, record := injectTestDeployment(deployment, testInjectionOptions(""))
+			Expect(record.conflicts).To(BeEmpty())
+			Expect(record.ConflictsHash).To(BeEmpty())
+		})
+	})
+
+	Context("reporting the invalid overrides", func() {
+		It("only reports them again once they change", func() {
+			deployment := newTestDeployment("overrides")
+			deployment.Annotations = map[string]string{PROXY_CA_CERT_MOUNT_PATH_ANNOTATION: "relative/path"}
+			deployment.Labels[PROXY_INJECTION_SECRET_LABEL] = "proxy-secret"
+			injectOverrides := func() *injectionRecord {
+				opts := testInjectionOptions("")
+				opts.overrides = readWorkloadOverrides(deployment)
+				_, record := injectTestDeployment(deployment, opts)
+				return record
+			}
+			Expect(injectOverrides().overridesChanged).To(BeTrue())
+			Expect(injectOverrides().overridesChanged).To(BeFalse())
+
+			delete(deployment.Labels, PROXY_INJECTION_SECRET_LABEL)
+			Expect(injectOverrides().overridesChanged).To(BeTrue())
+
+			delete(deployment.Annotations, PROXY_CA_CERT_MOUNT_PATH_ANNOTATION)
+			record := injectOverrides()
+			Expect(record.overridesChanged).To(BeTrue())
+			Expect(record.OverridesHash).To(BeEmpty())
+		})
+	})
+})
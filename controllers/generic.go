@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// WorkloadConfig defines the additional workload kinds the operator injects into, read from the operator config file
+type WorkloadConfig struct {
+	// Workloads lists the custom resources embedding one or more pod templates
+	Workloads []GenericWorkload `json:"workloads"`
+}
+
+// GenericWorkload defines a custom resource kind embedding one or more pod templates
+type GenericWorkload struct {
+	// Group is the API group of the custom resource, eg "argoproj.io"
+	Group string `json:"group"`
+
+	// Version is the API version of the custom resource, eg "v1alpha1"
+	Version string `json:"version"`
+
+	// Kind is the kind of the custom resource, eg "Rollout"
+	Kind string `json:"kind"`
+
+	// PodTemplatePaths are the field paths to the PodTemplateSpecs in the custom resource, eg "spec.template"
+	PodTemplatePaths []string `json:"podTemplatePaths"`
+}
+
+// GroupVersionKind returns the GroupVersionKind of the custom resource
+func (w GenericWorkload) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: w.Group, Version: w.Version, Kind: w.Kind}
+}
+
+// LoadWorkloadConfig reads and validates the operator workload config file
+func LoadWorkloadConfig(path string) (*WorkloadConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	workloadConfig := &WorkloadConfig{}
+	if err = yaml.UnmarshalStrict(data, workloadConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse workload config %s: %w", path, err)
+	}
+
+	for _, w := range workloadConfig.Workloads {
+		if w.Version == "" || w.Kind == "" {
+			return nil, fmt.Errorf("workload config %s: version and kind are required for every workload", path)
+		}
+		if len(w.PodTemplatePaths) == 0 {
+			return nil, fmt.Errorf("workload config %s: no podTemplatePaths set for %s", path, w.GroupVersionKind().String())
+		}
+	}
+	return workloadConfig, nil
+}
+
+// unstructuredAdapter is a WorkloadAdapter for custom resources, handled as unstructured objects
+type unstructuredAdapter struct {
+	gvk       schema.GroupVersionKind
+	pathNames []string
+	paths     [][]string
+}
+
+// NewUnstructuredAdapter returns a WorkloadAdapter for a custom resource kind embedding pod templates at the given field paths
+func NewUnstructuredAdapter(workload GenericWorkload) WorkloadAdapter {
+	paths := [][]string{}
+	for _, path := range workload.PodTemplatePaths {
+		paths = append(paths, splitFieldPath(path))
+	}
+	return &unstructuredAdapter{gvk: workload.GroupVersionKind(), pathNames: workload.PodTemplatePaths, paths: paths}
+}
+
+// splitFieldPath splits a field path like "spec.template" or ".spec.template" into its fields
+func splitFieldPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(strings.TrimSpace(path), "."), ".")
+}
+
+func (a *unstructuredAdapter) Kind() string {
+	return a.gvk.Kind
+}
+
+func (a *unstructuredAdapter) PodTemplatePaths() []string {
+	return a.pathNames
+}
+
+func (a *unstructuredAdapter) NewObject() client.Object {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(a.gvk)
+	return u
+}
+
+func (a *unstructuredAdapter) List(ctx context.Context, c client.Reader, opts ...client.ListOption) ([]client.Object, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(a.gvk.GroupVersion().WithKind(a.gvk.Kind + "List"))
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+
+	objects := []client.Object{}
+	for i := range list.Items {
+		objects = append(objects, &list.Items[i])
+	}
+	return objects, nil
+}
+
+func (a *unstructuredAdapter) GetPodTemplates(obj client.Object) ([]*corev1.PodTemplateSpec, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("expected an unstructured %s, got %T", a.gvk.Kind, obj)
+	}
+
+	templates := []*corev1.PodTemplateSpec{}
+	for _, path := range a.paths {
+		m, found, err := unstructured.NestedMap(u.Object, path...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pod template at %s: %w", strings.Join(path, "."), err)
+		}
+		if !found {
+			continue
+		}
+
+		template := &corev1.PodTemplateSpec{}
+		if err = runtime.DefaultUnstructuredConverter.FromUnstructured(m, template); err != nil {
+			return nil, fmt.Errorf("the field %s is not a pod template: %w", strings.Join(path, "."), err)
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+func (a *unstructuredAdapter) SetPodTemplates(obj client.Object, templates []*corev1.PodTemplateSpec) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("expected an unstructured %s, got %T", a.gvk.Kind, obj)
+	}
+
+	// The templates are returned for the paths found in the object, in order
+	i := 0
+	for _, path := range a.paths {
+		if _, found, _ := unstructured.NestedMap(u.Object, path...); !found {
+			continue
+		}
+		if i >= len(templates) {
+			return fmt.Errorf("%s embeds more pod templates than were given", a.gvk.Kind)
+		}
+
+		m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(templates[i])
+		if err != nil {
+			return err
+		}
+		// Don't add the empty creationTimestamp the conversion leaves behind
+		unstructured.RemoveNestedField(m, "metadata", "creationTimestamp")
+
+		if err = unstructured.SetNestedMap(u.Object, m, path...); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
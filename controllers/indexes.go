@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"context"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PROXY_INJECTION_INDEX is the cache field index holding the value of the PROXY_INJECTION_LABEL of a workload
+	PROXY_INJECTION_INDEX = "metadata.labels.inject-proxy-env"
+
+	// PROXY_INJECTED_INDEX is the cache field index holding the ProxyConfig or ClusterProxyConfig that injected a workload
+	PROXY_INJECTED_INDEX = "metadata.annotations.injected"
+
+	// PROXY_CONFIG_CA_CONFIGMAP_INDEX is the cache field index holding the ConfigMap the CA certificate of a custom ProxyConfig is read from.
+	// ClusterProxyConfigs are indexed by the namespace and name of the ConfigMap.
+	PROXY_CONFIG_CA_CONFIGMAP_INDEX = "spec.proxy.caConfig.name"
+
+	// PROXY_CONFIG_CA_SECRET_INDEX is the cache field index holding the Secret the CA certificate of a custom ProxyConfig is read from.
+	// ClusterProxyConfigs are indexed by the namespace and name of the Secret.
+	PROXY_CONFIG_CA_SECRET_INDEX = "spec.proxy.caConfig.secretName"
+
+	// PROXY_CONFIG_INHERIT_INDEX is the cache field index holding the ClusterProxyConfig a ProxyConfig inherits from
+	PROXY_CONFIG_INHERIT_INDEX = "spec.inheritFrom.name"
+
+	// WORKLOAD_LIST_PAGE_SIZE is the page size used when listing workloads directly from the API server
+	WORKLOAD_LIST_PAGE_SIZE = 500
+)
+
+// indexProxyInjectionLabel indexes a workload by the value of its PROXY_INJECTION_LABEL
+func indexProxyInjectionLabel(obj client.Object) []string {
+	if value, ok := obj.GetLabels()[PROXY_INJECTION_LABEL]; ok {
+		return []string{value}
+	}
+	return nil
+}
+
+// indexInjectedBy indexes a workload by the ProxyConfig or ClusterProxyConfig that injected it
+func indexInjectedBy(obj client.Object) []string {
+	record, err := readInjectionRecord(obj)
+	if err != nil || record == nil {
+		return nil
+	}
+	return []string{record.owner().indexValue()}
+}
+
+// setupWorkloadIndex registers the injection label and injection record indexes for a watched workload kind
+func setupWorkloadIndex(ctx context.Context, mgr ctrl.Manager, obj client.Object) error {
+	if err := mgr.GetFieldIndexer().IndexField(ctx, obj, PROXY_INJECTION_INDEX, indexProxyInjectionLabel); err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(ctx, obj, PROXY_INJECTED_INDEX, indexInjectedBy)
+}
+
+// setupProxyConfigIndexes registers the indexes used to find the ProxyConfigs reading their CA certificate from a ConfigMap or Secret,
+// or inheriting from a ClusterProxyConfig
+func setupProxyConfigIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &proxyv1beta1.ProxyConfig{}, PROXY_CONFIG_CA_CONFIGMAP_INDEX, func(obj client.Object) []string {
+		proxyConfig := obj.(*proxyv1beta1.ProxyConfig)
+		source := customCASource(proxyConfig.Spec)
+		if source == nil || source.Type != proxyv1beta1.CASourceConfigMap || source.ConfigMap == nil {
+			return nil
+		}
+		return []string{source.ConfigMap.Name}
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &proxyv1beta1.ProxyConfig{}, PROXY_CONFIG_CA_SECRET_INDEX, func(obj client.Object) []string {
+		proxyConfig := obj.(*proxyv1beta1.ProxyConfig)
+		source := customCASource(proxyConfig.Spec)
+		if source == nil || source.Type != proxyv1beta1.CASourceSecret || source.Secret == nil {
+			return nil
+		}
+		return []string{source.Secret.Name}
+	}); err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(ctx, &proxyv1beta1.ProxyConfig{}, PROXY_CONFIG_INHERIT_INDEX, func(obj client.Object) []string {
+		inheritFrom := obj.(*proxyv1beta1.ProxyConfig).Spec.InheritFrom
+		if inheritFrom == nil || inheritFrom.Kind != proxyv1beta1.InheritFromClusterProxyConfig {
+			return nil
+		}
+		return []string{inheritFrom.Name}
+	})
+}
+
+// setupClusterProxyConfigIndexes registers the indexes used to find the ClusterProxyConfigs reading their CA certificate from a ConfigMap or Secret
+func setupClusterProxyConfigIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &proxyv1beta1.ClusterProxyConfig{}, PROXY_CONFIG_CA_CONFIGMAP_INDEX, func(obj client.Object) []string {
+		clusterProxyConfig := obj.(*proxyv1beta1.ClusterProxyConfig)
+		source := customCASource(clusterProxyConfig.Spec.ProxyConfigSpec)
+		if source == nil || source.Type != proxyv1beta1.CASourceConfigMap || source.ConfigMap == nil {
+			return nil
+		}
+		return []string{source.ConfigMap.Namespace + "/" + source.ConfigMap.Name}
+	}); err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(ctx, &proxyv1beta1.ClusterProxyConfig{}, PROXY_CONFIG_CA_SECRET_INDEX, func(obj client.Object) []string {
+		clusterProxyConfig := obj.(*proxyv1beta1.ClusterProxyConfig)
+		source := customCASource(clusterProxyConfig.Spec.ProxyConfigSpec)
+		if source == nil || source.Type != proxyv1beta1.CASourceSecret || source.Secret == nil {
+			return nil
+		}
+		return []string{source.Secret.Namespace + "/" + source.Secret.Name}
+	})
+}
+
+// listSelectedWorkloads lists the workloads matching a label selector in a namespace.
+// Watched kinds are served from the cache, using the label index for the injection label, every other kind
+// falls back to paginated lists against the API server so it doesn't start an informer of its own.
+func (r *ProxyConfigReconciler) listSelectedWorkloads(ctx context.Context, adapter WorkloadAdapter, namespace string, selector labels.Selector) ([]client.Object, error) {
+	if r.watchedKinds[adapter.Kind()] {
+		// Selectors hold slices, comparing them directly panics
+		if selector.String() == legacyWorkloadSelector.String() {
+			return adapter.List(ctx, r.Client, client.InNamespace(namespace), client.MatchingFields{PROXY_INJECTION_INDEX: "true"})
+		}
+		return adapter.List(ctx, r.Client, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector})
+	}
+	return adapter.List(ctx, &pagedReader{r.APIReader}, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector})
+}
+
+// listInjectedWorkloads lists the workloads in a namespace, or in every namespace when it is empty, that were injected by an owner
+func (r *ProxyConfigReconciler) listInjectedWorkloads(ctx context.Context, adapter WorkloadAdapter, namespace string, owner configOwner) ([]client.Object, error) {
+	if r.watchedKinds[adapter.Kind()] {
+		return adapter.List(ctx, r.Client, client.InNamespace(namespace), client.MatchingFields{PROXY_INJECTED_INDEX: owner.indexValue()})
+	}
+
+	// Annotations can't be selected on by the API server, filter the whole namespace
+	workloads, err := adapter.List(ctx, &pagedReader{r.APIReader}, client.InNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	injected := []client.Object{}
+	for _, workload := range workloads {
+		if ContainsString(indexInjectedBy(workload), owner.indexValue()) {
+			injected = append(injected, workload)
+		}
+	}
+	return injected, nil
+}
+
+// pagedReader is a client.Reader listing objects from the API server one page at a time
+type pagedReader struct {
+	client.Reader
+}
+
+// List lists objects directly from the API server, one page at a time
+func (r *pagedReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	items := []runtime.Object{}
+	continueToken := ""
+	for {
+		page := list.DeepCopyObject().(client.ObjectList)
+		pageOpts := append([]client.ListOption{client.Limit(WORKLOAD_LIST_PAGE_SIZE), client.Continue(continueToken)}, opts...)
+		if err := r.Reader.List(ctx, page, pageOpts...); err != nil {
+			return err
+		}
+
+		pageItems, err := meta.ExtractList(page)
+		if err != nil {
+			return err
+		}
+		items = append(items, pageItems...)
+
+		continueToken = page.GetContinue()
+		if continueToken == "" {
+			break
+		}
+	}
+	return meta.SetList(list, items)
+}
@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+//+kubebuilder:webhook:path=/mutate-proxy-injection,mutating=true,failurePolicy=ignore,sideEffects=NoneOnDryRun,groups="";apps;batch;apps.openshift.io,resources=pods;deployments;statefulsets;daemonsets;jobs;cronjobs;deploymentconfigs,verbs=create,versions=v1,name=minject.proxy.k8s.kemo.dev,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/mutate-proxy-injection,mutating=true,failurePolicy=ignore,sideEffects=NoneOnDryRun,groups="",resources=pods/ephemeralcontainers,verbs=update,versions=v1,name=meinject.proxy.k8s.kemo.dev,admissionReviewVersions=v1
+
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get
+//+kubebuilder:rbac:groups=core,resources=replicationcontrollers,verbs=get
+
+// ProxyInjector is a mutating admission webhook injecting the proxy configuration into labeled Pods, Jobs and workloads
+// as they are created, and into the ephemeral containers added to running Pods. Bare Pods and Jobs can't be injected
+// afterwards, and workloads don't roll out a second time once the reconciler gets to them.
+type ProxyInjector struct {
+	// Reconciler resolves the proxy configuration of the namespace the same way the ProxyConfig and ClusterProxyConfig reconcilers do
+	Reconciler *ProxyConfigReconciler
+
+	// FailClosed rejects objects the proxy configuration could not be injected into, instead of admitting them as they are
+	FailClosed bool
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the webhook with the webhook server of the Manager
+func (i *ProxyInjector) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	i.decoder = admission.NewDecoder(mgr.GetScheme())
+	mgr.GetWebhookServer().Register(PROXY_INJECTION_WEBHOOK_PATH, &webhook.Admission{Handler: i})
+	return nil
+}
+
+// adapter returns the adapter of an admitted kind, Pods and Jobs are only injected at admission
+func (i *ProxyInjector) adapter(kind string) (WorkloadAdapter, bool) {
+	switch kind {
+	case PodAdapter.Kind():
+		return PodAdapter, true
+	case JobAdapter.Kind():
+		return JobAdapter, true
+	}
+	return i.Reconciler.Workloads.Get(kind)
+}
+
+// Handle injects the proxy configuration into an admitted object selected by a ProxyConfig or ClusterProxyConfig
+func (i *ProxyInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.SubResource == "ephemeralcontainers" {
+		return i.handleEphemeralContainers(ctx, req)
+	}
+	adapter, ok := i.adapter(req.Kind.Kind)
+	if !ok {
+		return admission.Allowed(req.Kind.Kind + "s are not injected")
+	}
+	workload := adapter.NewObject()
+	if err := i.decoder.Decode(req, workload); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Pods of Jobs and workloads inherit the injection from their templates
+	if adapter == PodAdapter && metav1.GetControllerOf(workload) != nil {
+		return admission.Allowed("the Pod is injected through its controller")
+	}
+	// Objects created without a namespace are created in the namespace of the request
+	if workload.GetNamespace() == "" {
+		workload.SetNamespace(req.Namespace)
+	}
+
+	dryRun := req.DryRun != nil && *req.DryRun
+	injected, err := i.inject(ctx, adapter, workload, dryRun)
+	if err != nil {
+		return i.failed(adapter.Kind(), err)
+	}
+	if !injected {
+		return admission.Allowed("no ProxyConfig or ClusterProxyConfig selects the " + adapter.Kind())
+	}
+
+	marshaled, err := json.Marshal(workload)
+	if err != nil {
+		return i.failed(adapter.Kind(), err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// inject injects the proxy configuration of the ProxyConfig selecting an admitted object, or of the ClusterProxyConfig
+// selecting it when no ProxyConfig in the namespace does. It returns false when neither selects it, or the one selecting it is suspended.
+func (i *ProxyInjector) inject(ctx context.Context, adapter WorkloadAdapter, workload client.Object, dryRun bool) (bool, error) {
+	r := i.Reconciler
+
+	spec, owner, resolved, err := i.resolve(ctx, adapter.Kind(), workload)
+	if err != nil || spec == nil {
+		return false, err
+	}
+	opts, err := r.prepareInjection(ctx, adapter.Kind(), workload, spec, owner, resolved, dryRun)
+	if err != nil {
+		return false, err
+	}
+	_, record, err := mutateWorkload(adapter, workload, opts, owner)
+	if err != nil {
+		return false, err
+	}
+	if !dryRun && record.overridesChanged {
+		r.reportInvalidOverrides(workload, opts.overrides)
+	}
+	if !dryRun && record.conflictsChanged {
+		r.reportEnvConflicts(workload, record.conflicts, owner)
+	}
+	lggr.Info("Injected "+adapter.Kind()+" at admission by "+owner.String(), adapter.Kind()+".Namespace", workload.GetNamespace(), adapter.Kind()+".Name", workload.GetName())
+	return true, nil
+}
+
+// resolve returns the spec of the ProxyConfig selecting a workload of a kind, or of the ClusterProxyConfig selecting it
+// when no ProxyConfig in the namespace does, along with its owner and resolved proxy configuration.
+// The spec is nil when neither selects it, or the one selecting it is suspended.
+func (i *ProxyInjector) resolve(ctx context.Context, kind string, workload client.Object) (*proxyv1beta1.ProxyConfigSpec, configOwner, resolvedProxyConfig, error) {
+	r := i.Reconciler
+
+	var spec *proxyv1beta1.ProxyConfigSpec
+	var owner configOwner
+	namespace := workload.GetNamespace()
+	proxyConfig, err := r.workloadProxyConfig(ctx, kind, workload)
+	if err != nil {
+		return nil, owner, resolvedProxyConfig{}, err
+	}
+	if proxyConfig != nil {
+		spec, owner = &proxyConfig.Spec, proxyConfigOwner(proxyConfig.Name)
+	} else {
+		clusterProxyConfig, err := r.workloadClusterProxyConfig(ctx, kind, workload)
+		if err != nil || clusterProxyConfig == nil {
+			return nil, owner, resolvedProxyConfig{}, err
+		}
+		spec, owner, namespace = &clusterProxyConfig.Spec.ProxyConfigSpec, clusterProxyConfigOwner(clusterProxyConfig.Name), ""
+	}
+	// Suspended proxy configurations inject the object once they are resumed
+	if spec.Suspend {
+		lggr.Info("Not injecting "+kind+" at admission, "+owner.String()+" is suspended", kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+		return nil, owner, resolvedProxyConfig{}, nil
+	}
+
+	resolved, err := r.resolveProxySource(ctx, *spec)
+	if err != nil {
+		return nil, owner, resolved, err
+	}
+	if err = r.resolveCACert(ctx, spec, namespace, &resolved); err != nil {
+		return nil, owner, resolved, err
+	}
+	return spec, owner, resolved, nil
+}
+
+// handleEphemeralContainers injects the proxy configuration into the ephemeral containers added to a Pod
+func (i *ProxyInjector) handleEphemeralContainers(ctx context.Context, req admission.Request) admission.Response {
+	pod, oldPod := &corev1.Pod{}, &corev1.Pod{}
+	if err := i.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := i.decoder.DecodeRaw(req.OldObject, oldPod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	dryRun := req.DryRun != nil && *req.DryRun
+	injected, err := i.injectEphemeralContainers(ctx, pod, oldPod, dryRun)
+	if err != nil {
+		return i.failed("ephemeral containers", err)
+	}
+	if !injected {
+		return admission.Allowed("no ephemeral container is injected")
+	}
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return i.failed("ephemeral containers", err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// injectEphemeralContainers injects the ephemeral containers added to a Pod, when the proxy configuration injecting
+// the workload the Pod belongs to injects ephemeral containers. It returns false when none was injected.
+// Ephemeral containers can't be changed once they are added, and the volumes of a Pod can't be changed at all,
+// so the containers are not recorded and the CA certificate is only mounted when the Pod already has its volume.
+func (i *ProxyInjector) injectEphemeralContainers(ctx context.Context, pod *corev1.Pod, oldPod *corev1.Pod, dryRun bool) (bool, error) {
+	kind, workload, err := i.podWorkload(ctx, pod)
+	if err != nil {
+		return false, err
+	}
+	spec, owner, resolved, err := i.resolve(ctx, kind, workload)
+	if err != nil || spec == nil || spec.Containers == nil || !spec.Containers.EphemeralContainers {
+		return false, err
+	}
+	opts, err := i.Reconciler.prepareInjection(ctx, kind, workload, spec, owner, resolved, dryRun)
+	if err != nil {
+		return false, err
+	}
+
+	added := []podContainer{}
+	for _, container := range opts.containers.selectContainers(&pod.Spec) {
+		if container.list == "ephemeralContainers" && !ContainsString(ephemeralContainerNames(oldPod), container.name) {
+			added = append(added, container)
+		}
+	}
+	mountCACert := opts.caCert != nil && hasVolume(pod.Spec.Volumes, PROXY_CA_CERT_VOLUME_NAME)
+	record := newInjectionRecord(owner)
+	for _, container := range added {
+		injectContainerEnv(container, opts, nil, record)
+		if mountCACert {
+			if err = injectCACert(container, opts.caCert, record); err != nil {
+				return false, err
+			}
+		}
+		lggr.Info("Injected ephemeral container "+container.name+" at admission by "+owner.String(), "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+	}
+	if !dryRun {
+		i.Reconciler.reportEnvConflicts(pod, record.conflicts, owner)
+	}
+	return len(added) > 0, nil
+}
+
+// podWorkload returns the kind and metadata of the top-level workload controlling a Pod, following its controller
+// references through eg ReplicaSets, or the Pod itself when it isn't controlled by a kind that is injected
+func (i *ProxyInjector) podWorkload(ctx context.Context, pod *corev1.Pod) (string, client.Object, error) {
+	kind, workload := PodAdapter.Kind(), client.Object(pod)
+	for ref := metav1.GetControllerOf(pod); ref != nil; {
+		controller := &metav1.PartialObjectMetadata{}
+		controller.SetGroupVersionKind(schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind))
+		if err := i.Reconciler.APIReader.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: ref.Name}, controller); err != nil {
+			return "", nil, err
+		}
+		if _, ok := i.adapter(ref.Kind); ok {
+			kind, workload = ref.Kind, controller
+		}
+		ref = metav1.GetControllerOf(controller)
+	}
+	return kind, workload, nil
+}
+
+// ephemeralContainerNames returns the names of the ephemeral containers of a Pod
+func ephemeralContainerNames(pod *corev1.Pod) []string {
+	names := []string{}
+	for _, container := range pod.Spec.EphemeralContainers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+// hasVolume returns whether a list of volumes holds a volume of a name
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// failed admits the object as it is or rejects it, depending on FailClosed
+func (i *ProxyInjector) failed(kind string, err error) admission.Response {
+	lggr.Error(err, "Failed to inject "+kind+" at admission")
+	if i.FailClosed {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.Allowed("the proxy configuration could not be injected").WithWarnings("proxy configuration not injected: " + err.Error())
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// newTestInjector returns a ProxyInjector reading the objects from a fake client
+func newTestInjector(objs ...client.Object) (*ProxyInjector, client.Client) {
+	objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build()
+	workloads := NewWorkloadRegistry()
+	workloads.Register(DeploymentAdapter)
+	injector := &ProxyInjector{
+		Reconciler: &ProxyConfigReconciler{Client: c, APIReader: c, Scheme: scheme.Scheme, Workloads: workloads},
+		decoder:    admission.NewDecoder(scheme.Scheme),
+	}
+	return injector, c
+}
+
+// newAdmissionRequest returns the admission request creating an object of a kind in the default namespace
+func newAdmissionRequest(kind string, obj runtime.Object, dryRun bool) admission.Request {
+	raw, err := json.Marshal(obj)
+	Expect(err).NotTo(HaveOccurred())
+	gvk := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind}
+	if kind == "Pod" {
+		gvk.Group = ""
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       types.UID("request-" + strings.ToLower(kind)),
+		Kind:      gvk,
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+		DryRun:    &dryRun,
+	}}
+}
+
+// patchedPaths returns the paths of the JSON patch operations of an admission response
+func patchedPaths(resp admission.Response) []string {
+	paths := []string{}
+	for _, op := range resp.Patches {
+		paths = append(paths, op.Path)
+	}
+	return paths
+}
+
+// newTestProxyConfig returns a ProxyConfig in the default namespace injecting a custom HTTP proxy
+func newTestProxyConfig(name string) *proxyv1beta1.ProxyConfig {
+	return &proxyv1beta1.ProxyConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: proxyv1beta1.ProxyConfigSpec{
+			ProxySource: "custom",
+			Proxy:       &proxyv1beta1.Proxy{HTTPProxy: "http://proxy.example.com:3128"},
+		},
+	}
+}
+
+// newTestClusterProxyConfig returns a ClusterProxyConfig selecting every namespace, injecting a custom HTTP proxy
+func newTestClusterProxyConfig(name string) *proxyv1beta1.ClusterProxyConfig {
+	clusterProxyConfig := &proxyv1beta1.ClusterProxyConfig{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	clusterProxyConfig.Spec.ProxySource = "custom"
+	clusterProxyConfig.Spec.Proxy = &proxyv1beta1.Proxy{HTTPProxy: "http://cluster-proxy.example.com:3128"}
+	return clusterProxyConfig
+}
+
+// expectSecret fails unless a Secret exists in the default namespace, or doesn't when exists is false
+func expectSecret(c client.Client, name string, exists bool) {
+	err := c.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, &corev1.Secret{})
+	if exists {
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	} else {
+		ExpectWithOffset(1, errors.IsNotFound(err)).To(BeTrue(), "expected Secret %s not to exist, got %v", name, err)
+	}
+}
+
+var _ = Describe("Injecting at admission", func() {
+	ctx := context.Background()
+
+	It("injects a selected workload and creates the proxy Secret", func() {
+		injector, c := newTestInjector(newTestProxyConfig("test"))
+		resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("admitted"), false))
+
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(patchedPaths(resp)).To(ContainElements("/spec/template/spec/containers/0/env", "/metadata/annotations"))
+		expectSecret(c, proxyConfigOwner("test").proxySecretName(), true)
+	})
+
+	It("doesn't create the proxy Secret on a dry run", func() {
+		injector, c := newTestInjector(newTestProxyConfig("test"))
+		resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("dry-run"), true))
+
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).NotTo(BeEmpty())
+		expectSecret(c, proxyConfigOwner("test").proxySecretName(), false)
+	})
+
+	It("prefers the ProxyConfig of the namespace over a ClusterProxyConfig", func() {
+		injector, c := newTestInjector(newTestProxyConfig("local"), newTestClusterProxyConfig("cluster"))
+		resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("local"), false))
+
+		Expect(resp.Allowed).To(BeTrue())
+		expectSecret(c, proxyConfigOwner("local").proxySecretName(), true)
+		expectSecret(c, clusterProxyConfigOwner("cluster").proxySecretName(), false)
+	})
+
+	It("falls back to a ClusterProxyConfig", func() {
+		injector, c := newTestInjector(newTestClusterProxyConfig("cluster"))
+		resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("cluster"), false))
+
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).NotTo(BeEmpty())
+		expectSecret(c, clusterProxyConfigOwner("cluster").proxySecretName(), true)
+	})
+
+	It("admits the workloads nothing selects as they are", func() {
+		injector, _ := newTestInjector(newTestProxyConfig("test"))
+		deployment := newTestDeployment("unlabeled")
+		deployment.Labels = nil
+		resp := injector.Handle(ctx, newAdmissionRequest("Deployment", deployment, false))
+
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(BeEmpty())
+	})
+
+	It("leaves the Pods of a controller to their pod template", func() {
+		injector, _ := newTestInjector(newTestProxyConfig("test"))
+		controller := true
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "controlled", Namespace: "default", Labels: map[string]string{PROXY_INJECTION_LABEL: "true"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "controlled-5d9f7", UID: "uid", Controller: &controller}},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "registry.example.com/app:latest"}}},
+		}
+		resp := injector.Handle(ctx, newAdmissionRequest("Pod", pod, false))
+
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(BeEmpty())
+	})
+
+	Context("when the proxy configuration can't be injected", func() {
+		// The CA certificate ConfigMap of the ProxyConfig doesn't exist
+		newBrokenProxyConfig := func() *proxyv1beta1.ProxyConfig {
+			proxyConfig := newTestProxyConfig("broken")
+			proxyConfig.Spec.CACert = &proxyv1beta1.CACert{Inject: true, Source: &proxyv1beta1.CASource{
+				Type: proxyv1beta1.CASourceConfigMap, ConfigMap: &proxyv1beta1.CAKeyReference{Name: "missing"},
+			}}
+			return proxyConfig
+		}
+
+		It("admits the workload as it is with a warning", func() {
+			injector, _ := newTestInjector(newBrokenProxyConfig())
+			resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("fail-open"), false))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+			Expect(resp.Warnings).To(ContainElement(ContainSubstring("proxy configuration not injected")))
+		})
+
+		It("rejects the workload with FailClosed", func() {
+			injector, _ := newTestInjector(newBrokenProxyConfig())
+			injector.FailClosed = true
+			resp := injector.Handle(ctx, newAdmissionRequest("Deployment", newTestDeployment("fail-closed"), false))
+
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Code).To(Equal(int32(http.StatusInternalServerError)))
+		})
+	})
+
+	Context("with ephemeral containers", func() {
+		newDebuggedPod := func() (*corev1.Pod, *corev1.Pod) {
+			oldPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "debugged", Namespace: "default", Labels: map[string]string{PROXY_INJECTION_LABEL: "true"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "registry.example.com/app:latest"}}},
+			}
+			pod := oldPod.DeepCopy()
+			pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "registry.example.com/debug:latest"}}}
+			return pod, oldPod
+		}
+		newEphemeralRequest := func(pod *corev1.Pod, oldPod *corev1.Pod) admission.Request {
+			req := newAdmissionRequest("Pod", pod, false)
+			oldRaw, err := json.Marshal(oldPod)
+			Expect(err).NotTo(HaveOccurred())
+			req.Operation = admissionv1.Update
+			req.SubResource = "ephemeralcontainers"
+			req.OldObject = runtime.RawExtension{Raw: oldRaw}
+			return req
+		}
+
+		It("injects the added ephemeral containers when the ProxyConfig asks for it", func() {
+			proxyConfig := newTestProxyConfig("test")
+			proxyConfig.Spec.Containers = &proxyv1beta1.ContainerFilter{EphemeralContainers: true}
+			injector, _ := newTestInjector(proxyConfig)
+			resp := injector.Handle(ctx, newEphemeralRequest(newDebuggedPod()))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedPaths(resp)).To(ContainElement("/spec/ephemeralContainers/0/env"))
+		})
+
+		It("leaves them alone otherwise", func() {
+			injector, _ := newTestInjector(newTestProxyConfig("test"))
+			resp := injector.Handle(ctx, newEphemeralRequest(newDebuggedPod()))
+
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,148 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// WebhookNamespaceReconciler labels the namespaces a ProxyConfig or ClusterProxyConfig applies to with
+// PROXY_WEBHOOK_NAMESPACE_LABEL, so the proxy injection webhook is only sent the objects of those namespaces,
+// and removes the label once none applies anymore.
+type WebhookNamespaceReconciler struct {
+	*ProxyConfigReconciler
+}
+
+// Reconcile sets or removes the webhook label of a namespace
+func (r *WebhookNamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, req.NamespacedName, namespace); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if namespace.Status.Phase == corev1.NamespaceTerminating {
+		return ctrl.Result{}, nil
+	}
+
+	selected, err := r.isNamespaceSelected(ctx, namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if _, labeled := namespace.Labels[PROXY_WEBHOOK_NAMESPACE_LABEL]; labeled == selected {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFrom(namespace.DeepCopy())
+	if selected {
+		if namespace.Labels == nil {
+			namespace.Labels = map[string]string{}
+		}
+		namespace.Labels[PROXY_WEBHOOK_NAMESPACE_LABEL] = PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE
+		lggr.Info("Sending the objects of namespace " + namespace.Name + " to the proxy injection webhook")
+	} else {
+		delete(namespace.Labels, PROXY_WEBHOOK_NAMESPACE_LABEL)
+		lggr.Info("No longer sending the objects of namespace " + namespace.Name + " to the proxy injection webhook")
+	}
+	return ctrl.Result{}, r.Patch(ctx, namespace, patch)
+}
+
+// isNamespaceSelected returns whether a ProxyConfig in a namespace or a ClusterProxyConfig selecting it exists,
+// leaving out the ones being deleted
+func (r *WebhookNamespaceReconciler) isNamespaceSelected(ctx context.Context, namespace *corev1.Namespace) (bool, error) {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList, client.InNamespace(namespace.Name)); err != nil {
+		return false, err
+	}
+	for _, proxyConfig := range proxyConfigList.Items {
+		if proxyConfig.DeletionTimestamp.IsZero() {
+			return true, nil
+		}
+	}
+
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList); err != nil {
+		return false, err
+	}
+	// The webhook label itself isn't matched, so a namespaceSelector can't keep a namespace labeled on its own
+	namespaceLabels := labels.Set{}
+	for key, value := range namespace.Labels {
+		if key != PROXY_WEBHOOK_NAMESPACE_LABEL {
+			namespaceLabels[key] = value
+		}
+	}
+	for _, clusterProxyConfig := range clusterProxyConfigList.Items {
+		if !clusterProxyConfig.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if clusterProxyConfig.Spec.NamespaceSelector == nil {
+			return true, nil
+		}
+		selector, err := metav1.LabelSelectorAsSelector(clusterProxyConfig.Spec.NamespaceSelector)
+		if err != nil {
+			lggr.Error(err, "Invalid namespaceSelector of clusterProxyConfig "+clusterProxyConfig.Name)
+			continue
+		}
+		if selector.Matches(namespaceLabels) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mapProxyConfigToNamespace enqueues the namespace of a ProxyConfig
+func (r *WebhookNamespaceReconciler) mapProxyConfigToNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// mapClusterProxyConfigToNamespaces enqueues every namespace, the namespaceSelector of a ClusterProxyConfig may have changed
+func (r *WebhookNamespaceReconciler) mapClusterProxyConfigToNamespaces(ctx context.Context, obj client.Object) []reconcile.Request {
+	namespaceList := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaceList); err != nil {
+		lggr.Error(err, "Failed to list Namespaces")
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, namespace := range namespaceList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: namespace.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// The namespaces are reconciled when their labels change, and when a ProxyConfig or ClusterProxyConfig is created,
+// changed or deleted.
+func (r *WebhookNamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("webhooknamespace").
+		For(&corev1.Namespace{}, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&proxyv1beta1.ProxyConfig{}, handler.EnqueueRequestsFromMapFunc(r.mapProxyConfigToNamespace)).
+		Watches(&proxyv1beta1.ClusterProxyConfig{}, handler.EnqueueRequestsFromMapFunc(r.mapClusterProxyConfigToNamespaces)).
+		Complete(r)
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestNamespaceReconciler returns a WebhookNamespaceReconciler reading the objects from a fake client
+func newTestNamespaceReconciler(objs ...client.Object) (*WebhookNamespaceReconciler, client.Client) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build()
+	return &WebhookNamespaceReconciler{ProxyConfigReconciler: &ProxyConfigReconciler{Client: c, APIReader: c, Scheme: scheme.Scheme}}, c
+}
+
+// reconcileWebhookLabel reconciles a namespace and returns whether it carries the webhook label afterwards
+func reconcileWebhookLabel(r *WebhookNamespaceReconciler, c client.Client, name string) bool {
+	ctx := context.Background()
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	namespace := &corev1.Namespace{}
+	ExpectWithOffset(1, c.Get(ctx, types.NamespacedName{Name: name}, namespace)).To(Succeed())
+	return namespace.Labels[PROXY_WEBHOOK_NAMESPACE_LABEL] == PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE
+}
+
+var _ = Describe("Labeling the namespaces sent to the injection webhook", func() {
+	newNamespace := func(name string, namespaceLabels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: namespaceLabels}}
+	}
+
+	It("labels a namespace holding a ProxyConfig", func() {
+		r, c := newTestNamespaceReconciler(newNamespace("default", nil), newTestProxyConfig("test"))
+		Expect(reconcileWebhookLabel(r, c, "default")).To(BeTrue())
+	})
+
+	It("labels the namespaces a ClusterProxyConfig selects", func() {
+		clusterProxyConfig := newTestClusterProxyConfig("cluster")
+		clusterProxyConfig.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}
+		r, c := newTestNamespaceReconciler(newNamespace("payments", map[string]string{"team": "payments"}), newNamespace("search", nil), clusterProxyConfig)
+
+		Expect(reconcileWebhookLabel(r, c, "payments")).To(BeTrue())
+		Expect(reconcileWebhookLabel(r, c, "search")).To(BeFalse())
+	})
+
+	It("labels every namespace for a ClusterProxyConfig without a namespaceSelector", func() {
+		r, c := newTestNamespaceReconciler(newNamespace("search", nil), newTestClusterProxyConfig("cluster"))
+		Expect(reconcileWebhookLabel(r, c, "search")).To(BeTrue())
+	})
+
+	It("removes the label once nothing applies to the namespace", func() {
+		namespace := newNamespace("search", map[string]string{PROXY_WEBHOOK_NAMESPACE_LABEL: PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE, "team": "search"})
+		r, c := newTestNamespaceReconciler(namespace)
+		Expect(reconcileWebhookLabel(r, c, "search")).To(BeFalse())
+
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(namespace), namespace)).To(Succeed())
+		Expect(namespace.Labels).To(Equal(map[string]string{"team": "search"}))
+	})
+
+	It("leaves out the ProxyConfigs being deleted", func() {
+		proxyConfig := newTestProxyConfig("deleted")
+		proxyConfig.Finalizers = []string{PROXY_CONFIG_FINALIZER}
+		now := metav1.Now()
+		proxyConfig.DeletionTimestamp = &now
+		r, c := newTestNamespaceReconciler(newNamespace("default", map[string]string{PROXY_WEBHOOK_NAMESPACE_LABEL: PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE}), proxyConfig)
+		Expect(reconcileWebhookLabel(r, c, "default")).To(BeFalse())
+	})
+
+	It("doesn't match the webhook label against a namespaceSelector", func() {
+		clusterProxyConfig := newTestClusterProxyConfig("cluster")
+		clusterProxyConfig.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{PROXY_WEBHOOK_NAMESPACE_LABEL: PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE}}
+		r, c := newTestNamespaceReconciler(newNamespace("search", map[string]string{PROXY_WEBHOOK_NAMESPACE_LABEL: PROXY_WEBHOOK_NAMESPACE_LABEL_VALUE}), clusterProxyConfig)
+		Expect(reconcileWebhookLabel(r, c, "search")).To(BeFalse())
+	})
+})
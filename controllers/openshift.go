@@ -13,7 +13,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func IsOpenshiftSno(c client.Client, log logr.Logger) (bool, error) {
+func IsOpenshiftSno(c client.Reader, log logr.Logger) (bool, error) {
 	infra := &configv1.Infrastructure{}
 
 	defaultInfraName := "cluster"
@@ -25,7 +25,7 @@ func IsOpenshiftSno(c client.Client, log logr.Logger) (bool, error) {
 	return infra.Status.ControlPlaneTopology == configv1.SingleReplicaTopologyMode, nil
 }
 
-func getOpenShiftClusterProxyConfiguration(cl client.Client, log logr.Logger) (configv1.Proxy, error) {
+func getOpenShiftClusterProxyConfiguration(cl client.Reader, log logr.Logger) (configv1.Proxy, error) {
 	// Get the cluster proxy config
 	clusterProxyConfig := &configv1.Proxy{}
 
@@ -43,7 +43,9 @@ func getOpenShiftClusterProxyConfiguration(cl client.Client, log logr.Logger) (c
 	}
 }
 
-func createOpenShiftCACertConfigMap(cl client.Client, ctx context.Context, log logr.Logger, configMapName string, configMapNamespace string) {
+// createOpenShiftCACertConfigMap creates a ConfigMap the Cluster Network Operator injects the trusted CA bundle into.
+// An existing ConfigMap of the same name is adopted by adding the injection label to it.
+func createOpenShiftCACertConfigMap(cl client.Client, ctx context.Context, log logr.Logger, configMapName string, configMapNamespace string, owner configOwner) error {
 	cm := corev1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "ConfigMap",
@@ -52,16 +54,38 @@ func createOpenShiftCACertConfigMap(cl client.Client, ctx context.Context, log l
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      configMapName,
 			Namespace: configMapNamespace,
-			Labels: map[string]string{
-				"config.openshift.io/inject-trusted-cabundle": "true",
-			},
+			Labels:    owner.ownerLabels(),
 		},
 	}
+	cm.Labels[TRUSTED_CA_BUNDLE_LABEL] = "true"
 
 	err := cl.Create(ctx, &cm)
-	if err != nil {
-		log.Error(err, "Failed to create ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
-	} else {
+	if err == nil {
 		log.Info("Created ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return nil
+	} else if !errors.IsAlreadyExists(err) {
+		log.Error(err, "Failed to create ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return err
+	}
+
+	// ConfigMap already exists, make sure the Cluster Network Operator injects into it
+	existing := corev1.ConfigMap{}
+	if err = cl.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: configMapNamespace}, &existing); err != nil {
+		log.Error(err, "Failed to get ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return err
+	}
+	if existing.Labels[TRUSTED_CA_BUNDLE_LABEL] == "true" {
+		log.Info("ConfigMap already exists and is up to date", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return nil
+	}
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	existing.Labels[TRUSTED_CA_BUNDLE_LABEL] = "true"
+	if err = cl.Update(ctx, &existing); err != nil {
+		log.Error(err, "Failed to adopt ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		return err
 	}
+	log.Info("Adopted ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+	return nil
 }
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// workloadOverrides holds the per-workload overrides of the Secret, ConfigMap and mount path the proxy configuration is injected with,
+// and of the proxy configuration itself.
+// Empty fields are not overridden.
+type workloadOverrides struct {
+	proxySecretName     string
+	caCertConfigMapName string
+	caCertConfigMapKey  string
+	caCertMountPath     string
+
+	// proxy holds the proxy URLs replacing the ones of the proxy configuration, and the noProxy entries appended to it
+	proxy proxyv1beta1.Proxy
+
+	// includeContainers replaces the include list of the proxy configuration, excludeContainers adds to its exclude list
+	includeContainers []string
+	excludeContainers []string
+
+	// invalid describes the override values that were ignored
+	invalid []string
+	// deprecated describes the deprecated override labels that were read
+	deprecated []string
+}
+
+// readWorkloadOverrides reads the override annotations of a workload, falling back to the deprecated override labels
+// for the Secret, ConfigMap and mount path.
+// Invalid values are ignored and reported in invalid.
+func readWorkloadOverrides(workload client.Object) workloadOverrides {
+	overrides := workloadOverrides{}
+	overrides.proxySecretName = overrides.read(workload, PROXY_SECRET_NAME_ANNOTATION, PROXY_INJECTION_SECRET_LABEL, validation.IsDNS1123Subdomain)
+	overrides.caCertConfigMapName = overrides.read(workload, PROXY_CA_CERT_CONFIGMAP_ANNOTATION, PROXY_CA_CERT_CONFIGMAP_LABEL, validation.IsDNS1123Subdomain)
+	overrides.caCertConfigMapKey = overrides.read(workload, PROXY_CA_CERT_CONFIGMAP_KEY_ANNOTATION, PROXY_CA_CERT_CONFIGMAP_KEY_LABEL, validation.IsConfigMapKey)
+	overrides.caCertMountPath = overrides.read(workload, PROXY_CA_CERT_MOUNT_PATH_ANNOTATION, PROXY_CA_CERT_MOUNT_PATH_LABEL, validateMountPath)
+	overrides.proxy.HTTPProxy = overrides.read(workload, PROXY_HTTP_PROXY_ANNOTATION, "", validateProxyURL)
+	overrides.proxy.HTTPSProxy = overrides.read(workload, PROXY_HTTPS_PROXY_ANNOTATION, "", validateProxyURL)
+	overrides.proxy.NoProxy = proxyv1beta1.ParseNoProxy(overrides.read(workload, PROXY_NO_PROXY_ANNOTATION, "", validateNoProxy))
+	overrides.includeContainers = splitNames(overrides.read(workload, PROXY_INCLUDE_CONTAINERS_ANNOTATION, "", validateContainerNames))
+	overrides.excludeContainers = splitNames(overrides.read(workload, PROXY_EXCLUDE_CONTAINERS_ANNOTATION, "", validateContainerNames))
+	return overrides
+}
+
+// patchesProxy returns whether the workload overrides the proxy URLs or noProxy, and needs a proxy Secret of its own
+func (o workloadOverrides) patchesProxy() bool {
+	return o.proxy.HTTPProxy != "" || o.proxy.HTTPSProxy != "" || len(o.proxy.NoProxy) > 0
+}
+
+// read returns the value of an override annotation, or of the deprecated label, if any, when the annotation is not set,
+// or an empty string when neither is set or the value is invalid
+func (o *workloadOverrides) read(workload client.Object, annotation string, label string, validate func(string) []string) string {
+	key, value := annotation, workload.GetAnnotations()[annotation]
+	if value == "" {
+		if label == "" {
+			return ""
+		}
+		key, value = label, workload.GetLabels()[label]
+		if value == "" {
+			return ""
+		}
+		o.deprecated = append(o.deprecated, "The "+label+" label is deprecated, use the "+annotation+" annotation instead")
+	}
+	if errs := validate(value); len(errs) > 0 {
+		// The value isn't echoed, proxy URLs may hold credentials
+		o.invalid = append(o.invalid, fmt.Sprintf("%s is ignored: %s", key, strings.Join(errs, "; ")))
+		return ""
+	}
+	return value
+}
+
+// validateMountPath validates the mount path of the CA certificate, returning the reasons it is invalid
+func validateMountPath(mountPath string) []string {
+	if !path.IsAbs(mountPath) {
+		return []string{"must be an absolute path"}
+	}
+	for _, element := range strings.Split(mountPath, "/") {
+		if element == ".." {
+			return []string{"must not contain '..'"}
+		}
+	}
+	if strings.Contains(mountPath, ":") {
+		return []string{"must not contain ':'"}
+	}
+	return nil
+}
+
+// validateProxyURL validates a proxy URL override, returning the reasons it is invalid
+func validateProxyURL(proxyURL string) []string {
+	errs, _ := proxyv1beta1.ValidateProxyURL(nil, proxyURL)
+	return errorBodies(errs)
+}
+
+// validateNoProxy validates a comma separated noProxy override, returning the reasons it is invalid
+func validateNoProxy(noProxy string) []string {
+	return errorBodies(proxyv1beta1.ValidateNoProxy(nil, proxyv1beta1.ParseNoProxy(noProxy)))
+}
+
+// validateContainerNames validates comma separated container names, returning the reasons they are invalid
+func validateContainerNames(names string) []string {
+	return errorBodies(proxyv1beta1.ValidateContainerNames(nil, splitNames(names)))
+}
+
+// splitNames splits a comma separated list of names, dropping empty entries
+func splitNames(names string) []string {
+	var split []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			split = append(split, name)
+		}
+	}
+	return split
+}
+
+// errorBodies returns the messages of field errors, without their field path
+func errorBodies(errs field.ErrorList) []string {
+	bodies := []string{}
+	for _, err := range errs {
+		bodies = append(bodies, err.ErrorBody())
+	}
+	return bodies
+}
+
+// reportInvalidOverrides logs the deprecated override labels a workload uses, and records a warning event on it
+// for every override value that was ignored
+func (r *ProxyConfigReconciler) reportInvalidOverrides(workload client.Object, overrides workloadOverrides) {
+	for _, deprecated := range overrides.deprecated {
+		lggr.Info(deprecated, "Namespace", workload.GetNamespace(), "Name", workload.GetName())
+	}
+	for _, invalid := range overrides.invalid {
+		lggr.Info("Invalid override: "+invalid, "Namespace", workload.GetNamespace(), "Name", workload.GetName())
+		if r.Recorder != nil {
+			r.Recorder.Event(workload, corev1.EventTypeWarning, EVENT_REASON_INVALID_OVERRIDE, invalid)
+		}
+	}
+}
+
+// reportNotOwned records an event on a workload referencing a Secret or ConfigMap the operator refuses to overwrite
+func (r *ProxyConfigReconciler) reportNotOwned(workload client.Object, err error) {
+	var notOwned *notOwnedError
+	if r.Recorder != nil && errors.As(err, &notOwned) {
+		r.Recorder.Event(workload, corev1.EventTypeWarning, EVENT_REASON_NOT_OWNED, notOwned.Error())
+	}
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// configOwner identifies the ProxyConfig or ClusterProxyConfig that created a Secret or ConfigMap, or injected a workload
+type configOwner struct {
+	// clusterScoped is set for ClusterProxyConfigs
+	clusterScoped bool
+	name          string
+}
+
+// proxyConfigOwner returns the owner of what a ProxyConfig created, in its own namespace
+func proxyConfigOwner(name string) configOwner {
+	return configOwner{name: name}
+}
+
+// clusterProxyConfigOwner returns the owner of what a ClusterProxyConfig created, in any namespace
+func clusterProxyConfigOwner(name string) configOwner {
+	return configOwner{clusterScoped: true, name: name}
+}
+
+// ownerLabels returns the labels set on the Secrets and ConfigMaps created for the owner
+func (o configOwner) ownerLabels() map[string]string {
+	if o.clusterScoped {
+		return map[string]string{PROXY_CLUSTER_CONFIG_OWNER_LABEL: o.labelValue()}
+	}
+	return map[string]string{PROXY_CONFIG_OWNER_LABEL: o.labelValue()}
+}
+
+// labelValue returns the name of the owner as a label value.
+// Names that would be too long are shortened and suffixed with a hash, the same way as workloadProxySecretName.
+func (o configOwner) labelValue() string {
+	if len(o.name) <= validation.LabelValueMaxLength {
+		return o.name
+	}
+	digest := sha256.Sum256([]byte(o.name))
+	return strings.TrimRight(o.name[:validation.LabelValueMaxLength-9], "-.") + "-" + hex.EncodeToString(digest[:])[:8]
+}
+
+// indexValue returns the value the workloads injected by the owner are indexed by
+func (o configOwner) indexValue() string {
+	if o.clusterScoped {
+		return "ClusterProxyConfig/" + o.name
+	}
+	return o.name
+}
+
+// proxySecretName returns the name of the proxy Secret used by workloads that don't override it.
+// Every ProxyConfig and ClusterProxyConfig has its own, so they don't overwrite each other's.
+func (o configOwner) proxySecretName() string {
+	if o.clusterScoped {
+		return CLUSTER_PROXY_SECRET_NAME_PREFIX + o.name
+	}
+	return PROXY_INJECTION_SECRET_DEFAULT_NAME + "-" + o.name
+}
+
+// workloadProxySecretName returns the name of the proxy Secret of a workload overriding the proxy configuration.
+// Names that would be too long are shortened and suffixed with a hash.
+func (o configOwner) workloadProxySecretName(kind string, workload string) string {
+	name := o.proxySecretName() + "-" + strings.ToLower(kind) + "-" + workload
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	digest := sha256.Sum256([]byte(name))
+	return strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-9], "-.") + "-" + hex.EncodeToString(digest[:])[:8]
+}
+
+// caCertConfigMapName returns the name of the CA certificate ConfigMap used by workloads that don't override it
+func (o configOwner) caCertConfigMapName() string {
+	if o.clusterScoped {
+		return CLUSTER_PROXY_CA_CERT_CONFIGMAP_NAME_PREFIX + o.name
+	}
+	return PROXY_CA_CERT_CONFIGMAP_DEFAULT_NAME + "-" + o.name
+}
+
+// String returns the kind and name of the owner, for logging
+func (o configOwner) String() string {
+	if o.clusterScoped {
+		return "ClusterProxyConfig " + o.name
+	}
+	return "ProxyConfig " + o.name
+}
+
+// workloadName returns the name of a workload, or the prefix of its generated name when it is admitted without one
+func workloadName(workload client.Object) string {
+	if workload.GetName() != "" {
+		return workload.GetName()
+	}
+	return strings.TrimRight(workload.GetGenerateName(), "-.")
+}
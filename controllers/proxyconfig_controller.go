@@ -18,26 +18,56 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
-	ocpappsv1 "github.com/openshift/api/apps/v1"
-	appsv1 "k8s.io/api/apps/v1"
-	batchv1 "k8s.io/api/batch/v1"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
-	proxyv1alpha1 "github.com/kenmoini/proxy-config-operator/api/v1alpha1"
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
 )
 
 // ProxyConfigReconciler reconciles a ProxyConfig object
 type ProxyConfigReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// APIReader reads directly from the API server, for kinds that are not cached
+	APIReader client.Reader
+
+	// MaxConcurrentReconciles is the maximum number of ProxyConfigs reconciled in parallel
+	MaxConcurrentReconciles int
+
+	// Workloads holds the workload kinds the proxy configuration is injected into
+	Workloads *WorkloadRegistry
+
+	// Recorder records events on the workloads, eg for invalid override annotations
+	Recorder record.EventRecorder
+
+	// watchedKinds holds the workload kinds that are watched and served from the cache
+	watchedKinds map[string]bool
+
+	// snoCheck logs whether the cluster is a Single Node OpenShift instance the first time the OpenShift source is resolved
+	snoCheck sync.Once
 }
 
 //+kubebuilder:rbac:groups=proxy.k8s.kemo.dev,resources=proxyconfigs,verbs=get;list;watch;create;update;patch;delete
@@ -46,7 +76,10 @@ type ProxyConfigReconciler struct {
 
 //+kubebuilder:rbac:groups=config.openshift.io,resources=proxies,verbs=get;list;watch
 //+kubebuilder:rbac:groups=config.openshift.io,resources=proxies/status,verbs=get
+//+kubebuilder:rbac:groups=config.openshift.io,resources=infrastructures,verbs=get
 
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 
@@ -82,24 +115,9 @@ var scanningInterval = 30
 func (r *ProxyConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
 
-	// Get the current connection configuration
-	currentConfig, _ := config.GetConfig()
-	clusterEndpoint := currentConfig.Host
-	apiPath := currentConfig.APIPath
-	lggr.Info("Connected to: " + clusterEndpoint + " | API Path:" + apiPath)
-
-	// Set up new Client
-	cl, err := client.New(currentConfig, client.Options{Scheme: r.Scheme})
-	if err != nil {
-		lggr.Error(err, "Failed to create client")
-		lggr.Info("Running reconciler again in " + strconv.Itoa(scanningInterval) + "s")
-		time.Sleep(time.Second * time.Duration(scanningInterval))
-		return ctrl.Result{}, err
-	}
-
 	// Fetch the proxyConfig instance that we're reconciling
-	proxyConfig := &proxyv1alpha1.ProxyConfig{}
-	err = r.Get(ctx, req.NamespacedName, proxyConfig)
+	proxyConfig := &proxyv1beta1.ProxyConfig{}
+	err := r.Get(ctx, req.NamespacedName, proxyConfig)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
@@ -112,255 +130,477 @@ func (r *ProxyConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		lggr.Error(err, "Failed to get proxyConfig")
 		return ctrl.Result{}, err
 	}
+
+	// Check to see if the proxyConfig is being deleted, and remove what it injected before letting it go
+	if !proxyConfig.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(proxyConfig, PROXY_CONFIG_FINALIZER) {
+			return ctrl.Result{}, nil
+		}
+		if err = r.cleanupOwner(ctx, proxyConfig.Namespace, proxyConfigOwner(proxyConfig.Name)); err != nil {
+			lggr.Error(err, "Failed to clean up proxyConfig", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(proxyConfig, PROXY_CONFIG_FINALIZER)
+		if err = r.Update(ctx, proxyConfig); err != nil {
+			lggr.Error(err, "Failed to remove the proxyConfig finalizer", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+		lggr.Info("proxyConfig cleaned up", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+		return ctrl.Result{}, nil
+	}
+
+	// Add the finalizer so the workloads are cleaned up when the proxyConfig is deleted
+	if controllerutil.AddFinalizer(proxyConfig, PROXY_CONFIG_FINALIZER) {
+		if err = r.Update(ctx, proxyConfig); err != nil {
+			lggr.Error(err, "Failed to add the proxyConfig finalizer", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Detect what type of proxySource we're using
 	proxySource := SetDefaultString(DEFAULT_PROXY_SOURCE, proxyConfig.Spec.ProxySource)
 
 	// Log out the proxyConfig metadata
 	lggr.Info("proxyConfig found in '" + proxyConfig.ObjectMeta.Namespace + "/" + proxyConfig.ObjectMeta.Name + "', proxySource: " + proxySource)
 
-	// Set up the proxy variables
-	var httpProxy string
-	var httpsProxy string
-	var noProxy string
-	var injectCACert bool
+	// Resolve the proxy configuration from its source
+	resolved, err := r.resolveProxySource(ctx, proxyConfig.Spec)
+	setSourceResolvedCondition(&proxyConfig.Status.Conditions, proxyConfig.Generation, resolved, err, "ProxyConfig")
+	if err != nil {
+		return r.sourceFailed(ctx, proxyConfig, resolved)
+	}
+	resolved.envFrom = envFromCache{}
 
-	// This can be overridden by the label on a workload
-	//caCertConfigMapName := PROXY_CA_CERT_CONFIGMAP_DEFAULT_NAME
+	// Read the CA certificate of the custom proxy source
+	caErr := r.resolveCACert(ctx, &proxyConfig.Spec, proxyConfig.Namespace, &resolved)
+	if caErr != nil {
+		lggr.Error(caErr, "Failed to read the CA certificate of the custom proxy source")
+	}
 
-	// Switch based on proxySource types
-	if proxySource == "openshift" {
-		// Check to see if this is a SNO instance - just because
-		IsOpenshiftSno, err := IsOpenshiftSno(cl, lggr)
-		if err != nil {
-			lggr.Error(err, "Failed to determine if this is a SNO instance")
-		} else {
-			lggr.Info("IsOpenshiftSno: " + strconv.FormatBool(IsOpenshiftSno))
+	proxyObj := resolved.proxy
+	lggr.Info("httpProxy: " + redactProxyURL(proxyObj.HTTPProxy))
+	lggr.Info("httpsProxy: " + redactProxyURL(proxyObj.HTTPSProxy))
+	lggr.Info("noProxy: " + proxyv1beta1.FormatNoProxy(proxyObj.NoProxy))
+	lggr.Info("injectCACert: " + strconv.FormatBool(resolved.injectCACert))
+
+	proxyConfig.Status.ProxySource = SetDefaultString(proxySource, resolved.source)
+	proxyConfig.Status.InheritedFrom = resolved.inheritedFrom
+	proxyConfig.Status.EffectiveProxy = effectiveProxy(proxyObj)
+	inventory := newWorkloadInventory()
+
+	// Find the workloads selected by the proxyConfig, by default the ones that have the label to inject the proxy configuration.
+	// When the namespace opted in, every workload in it is a candidate.
+	namespace := proxyConfig.ObjectMeta.Namespace
+	owner := proxyConfigOwner(proxyConfig.Name)
+	selector, err := workloadSelector(proxyConfig.Spec)
+	if err != nil {
+		lggr.Error(err, "Invalid workloadSelector", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+		return r.listFailed(ctx, proxyConfig, "workloads", err)
+	}
+	namespaceOptIn, err := r.isNamespaceOptedIn(ctx, namespace)
+	if err != nil {
+		lggr.Error(err, "Failed to get Namespace "+namespace)
+		return r.listFailed(ctx, proxyConfig, "workloads", err)
+	}
+	candidates := selector
+	if namespaceOptIn {
+		candidates = labels.Everything()
+	}
+
+	// While suspended, nothing is written but the changes that would be are reported
+	suspended := proxyConfig.Spec.Suspend
+	if suspended {
+		lggr.Info("proxyConfig is suspended, holding back changes to its workloads", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+	}
+
+	// Workloads targeted by several ProxyConfigs are injected by the one taking precedence
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err = r.List(ctx, proxyConfigList, client.InNamespace(namespace)); err != nil {
+		lggr.Error(err, "Failed to list the ProxyConfigs in "+namespace)
+		return r.listFailed(ctx, proxyConfig, "ProxyConfigs", err)
+	}
+	// decide returns whether the proxyConfig injects a workload, the reason reported in its status,
+	// and the ProxyConfig injecting it instead when another one takes precedence
+	decide := func(kind string, workload client.Object) (bool, string, *proxyv1beta1.ProxyConfig) {
+		inject, reason := injectionDecision(proxyConfig.Spec, selector, kind, workload, namespaceOptIn)
+		if !inject {
+			return false, reason, nil
 		}
+		if selected := selectProxyConfig(proxyConfigList.Items, kind, workload, namespaceOptIn); selected != nil && selected.Name != proxyConfig.Name {
+			return false, proxyv1beta1.DecisionOverridden, selected
+		}
+		return true, reason, nil
+	}
 
-		// Get the OpenShift Cluster Proxy Configuration
-		clusterProxyConfig, err := getOpenShiftClusterProxyConfiguration(cl, lggr)
-		if err != nil {
-			lggr.Error(err, "Failed to get OpenShift Cluster Proxy Configuration")
-		} else {
-			// Set the Proxy variables
-			httpProxy = SetDefaultString("", clusterProxyConfig.Status.HTTPProxy)
-			httpsProxy = SetDefaultString("", clusterProxyConfig.Status.HTTPSProxy)
-			noProxy = SetDefaultString("", clusterProxyConfig.Status.NoProxy)
-
-			// Check if there is a trustedCA defined in the OpenShift proxy config
-			if clusterProxyConfig.Spec.TrustedCA.Name != "" && proxyConfig.Spec.InjectCACert {
-				// We don't need to get the name of the CA Certificate ConfigMap since:
-				// 1. The ConfigMap is in the openshift-config namespace
-				// 2. The ConfigMap can be generated with the proper label
-				// 3. We just need to know if we're injecting it into workloads at this point
-				injectCACert = true
+	for _, adapter := range r.Workloads.Adapters() {
+		kind := adapter.Kind()
+
+		// Remove the proxy configuration from the workloads that are no longer selected
+		stripped, err := r.stripOptedOutWorkloads(ctx, adapter, namespace, owner, func(workload client.Object) (bool, error) {
+			inject, _, _ := decide(kind, workload)
+			return inject, nil
+		}, suspended)
+		if suspended {
+			for _, workload := range stripped {
+				inventory.recordPending(kind, workload.GetName())
 			}
 		}
-	} else {
-		// Set the proxy variables
-		httpProxy = SetDefaultString("", proxyConfig.Spec.Proxy.HTTPProxy)
-		httpsProxy = SetDefaultString("", proxyConfig.Spec.Proxy.HTTPSProxy)
-		noProxy = SetDefaultString("", proxyConfig.Spec.Proxy.NoProxy)
-	}
-
-	lggr.Info("httpProxy: " + httpProxy)
-	lggr.Info("httpsProxy: " + httpsProxy)
-	lggr.Info("noProxy: " + noProxy)
-	proxyObj := proxyv1alpha1.Proxy{HTTPProxy: httpProxy, HTTPSProxy: httpsProxy, NoProxy: noProxy}
-	lggr.Info("injectCACert: " + strconv.FormatBool(injectCACert))
-
-	// Find the workloads that have the label to inject the proxy configuration
-	listOpts := []client.ListOption{
-		client.InNamespace(proxyConfig.ObjectMeta.Namespace),
-		client.MatchingLabels(map[string]string{
-			"proxy.k8s.kemo.dev/inject-proxy-env": "true",
-		}),
-	}
-
-	deploymentList := &appsv1.DeploymentList{}
-	deploymentConfigList := &ocpappsv1.DeploymentConfigList{}
-	statefulSetList := &appsv1.StatefulSetList{}
-	daemonSetList := &appsv1.DaemonSetList{}
-	jobList := &batchv1.JobList{}
-	cronJobList := &batchv1.CronJobList{}
-
-	// Get the Deployments
-	if err = cl.List(ctx, deploymentList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list Deployments in "+proxyConfig.ObjectMeta.Namespace)
-		return ctrl.Result{}, err
-	} else {
-		lggr.Info("Found " + strconv.Itoa(len(deploymentList.Items)) + " Deployments")
+		if meta.IsNoMatchError(err) {
+			lggr.Info(kind + "s are not served by this cluster, skipping them")
+			continue
+		} else if err != nil {
+			lggr.Error(err, "Failed to remove the proxy configuration from opted out "+kind+"s in "+namespace)
+			return ctrl.Result{}, err
+		}
+		if !targetsKind(proxyConfig.Spec, kind) {
+			continue
+		}
+
+		workloads, err := r.listSelectedWorkloads(ctx, adapter, namespace, candidates)
+		if meta.IsNoMatchError(err) {
+			lggr.Info(kind + "s are not served by this cluster, skipping them")
+			continue
+		} else if err != nil {
+			lggr.Error(err, "Failed to list "+kind+"s in "+namespace)
+			return r.listFailed(ctx, proxyConfig, kind+"s", err)
+		}
+		lggr.Info("Found " + strconv.Itoa(len(workloads)) + " " + kind + "s")
 
-		for _, deployment := range deploymentList.Items {
-			// Set the Proxy Secret Name
-			proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, deployment.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
-			// Create the Proxy Secret
-			err = createWorkloadProxySecret(proxySecretName, deployment.ObjectMeta.Namespace, proxyObj, "Deployment", cl, ctx, lggr)
+		for _, workload := range workloads {
+			inject, reason, winner := decide(kind, workload)
+			if winner != nil {
+				inventory.recordConflict(kind, workload, proxyConfigOwner(winner.Name))
+				continue
+			}
+			if reason != "" {
+				inventory.recordDecision(kind, workload.GetName(), inject, reason)
+			}
+			if !inject {
+				continue
+			}
+			if suspended {
+				r.recordSuspendedInjection(ctx, inventory, adapter, workload, &proxyConfig.Spec, owner, resolved)
+				continue
+			}
+			conflicts, err := r.injectWorkload(ctx, adapter, workload, &proxyConfig.Spec, owner, resolved)
 			if err != nil {
-				lggr.Error(err, "Failed to create Proxy Secret")
+				inventory.recordFailure(kind, workload.GetName(), err)
 			} else {
-				// Loop through the containers and update the environmental variables
-				for i := range deployment.Spec.Template.Spec.Containers {
-					currentEnvVars := deployment.Spec.Template.Spec.Containers[i].Env
-					updatedEnvVars := createWorkloadEnvVariables(currentEnvVars, proxySecretName, proxyObj)
-					deployment.Spec.Template.Spec.Containers[i].Env = updatedEnvVars
-				}
-
-				err = cl.Update(ctx, &deployment)
-				if err != nil {
-					lggr.Error(err, "Failed to update Deployment", "Deployment.Namespace", deployment.Namespace, "Deployment.Name", deployment.Name)
-				} else {
-					lggr.Info("Updated Deployment", "Deployment.Namespace", deployment.Namespace, "Deployment.Name", deployment.Name)
-				}
+				inventory.recordInjected(kind, workload.GetName())
+				inventory.recordEnvConflicts(kind, conflicts)
 			}
 		}
 	}
 
-	// Get the DeploymentConfigs
-	if err = cl.List(ctx, deploymentConfigList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list DeploymentConfigs in "+proxyConfig.ObjectMeta.Namespace)
-		return ctrl.Result{}, err
-	} else {
-		lggr.Info("Found " + strconv.Itoa(len(deploymentConfigList.Items)) + " DeploymentConfigs")
+	// The Secret shared by all workloads of the namespace before every ProxyConfig got its own is deleted once they all moved on
+	if !suspended && inventory.failed() == 0 {
+		if err = r.deleteLegacyProxySecret(ctx, namespace); err != nil {
+			lggr.Error(err, "Failed to delete the legacy proxy Secret in "+namespace)
+		}
+	}
+	// The proxy Secrets of single Pods and Jobs created at admission are garbage collected along with them once they exist
+	if !suspended {
+		if err = r.adoptWorkloadProxySecrets(ctx, namespace, owner); err != nil {
+			lggr.Error(err, "Failed to adopt the proxy Secrets created at admission in "+namespace)
+		}
+		if err = r.migrateWorkloadProxySecrets(ctx, proxyConfig, []string{namespace}, owner); err != nil {
+			lggr.Error(err, "Failed to migrate the proxy Secrets created at admission in "+namespace)
+		}
+	}
 
-		for _, deploymentConfig := range deploymentConfigList.Items {
-			// Set the Proxy Secret Name
-			proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, deploymentConfig.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
-			// Create the Proxy Secret
-			err = createWorkloadProxySecret(proxySecretName, deploymentConfig.ObjectMeta.Namespace, proxyObj, "DeploymentConfig", cl, ctx, lggr)
-			if err != nil {
-				lggr.Error(err, "Failed to create Proxy Secret")
-			} else {
-				// Loop through the containers and update the environmental variables
-				for i := range deploymentConfig.Spec.Template.Spec.Containers {
-					currentEnvVars := deploymentConfig.Spec.Template.Spec.Containers[i].Env
-					updatedEnvVars := createWorkloadEnvVariables(currentEnvVars, proxySecretName, proxyObj)
-					deploymentConfig.Spec.Template.Spec.Containers[i].Env = updatedEnvVars
-				}
+	// Report the results of the reconciliation
+	proxyConfig.Status.Workloads = inventory.statuses()
+	proxyConfig.Status.InjectedCount = inventory.injected
 
-				err = cl.Update(ctx, &deploymentConfig)
-				if err != nil {
-					lggr.Error(err, "Failed to update DeploymentConfig", "DeploymentConfig.Namespace", deploymentConfig.Namespace, "DeploymentConfig.Name", deploymentConfig.Name)
-				} else {
-					lggr.Info("Updated DeploymentConfig", "DeploymentConfig.Namespace", deploymentConfig.Namespace, "DeploymentConfig.Name", deploymentConfig.Name)
-				}
-			}
-		}
+	setResultConditions(&proxyConfig.Status.Conditions, proxyConfig.Generation, caErr, resolved.injectCACert, inventory.injected, inventory.failed())
+	setConflictCondition(&proxyConfig.Status.Conditions, proxyConfig.Generation, inventory.conflicts)
+	setSuspendedCondition(&proxyConfig.Status.Conditions, proxyConfig.Generation, suspended, inventory.pending)
+	setEnvConflictCondition(&proxyConfig.Status.Conditions, proxyConfig.Generation, proxyConfig.Spec.ConflictPolicy, inventory.envConflicts)
+
+	if err = r.updateStatus(ctx, proxyConfig); err != nil {
+		return ctrl.Result{}, err
 	}
 
-	// Get the StatefulSets
-	if err = cl.List(ctx, statefulSetList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list StatefulSets in "+proxyConfig.ObjectMeta.Namespace)
+	return ctrl.Result{}, nil
+}
+
+// sourceFailed reports a proxy source that could not be resolved in the ProxyConfig status, and retries later instead of
+// blocking a worker. The workloads are left as they are meanwhile: injecting the empty proxy configuration would remove
+// the proxy from every one of them, and roll them all out.
+func (r *ProxyConfigReconciler) sourceFailed(ctx context.Context, proxyConfig *proxyv1beta1.ProxyConfig, resolved resolvedProxyConfig) (ctrl.Result, error) {
+	proxyConfig.Status.InheritedFrom = resolved.inheritedFrom
+	reason := meta.FindStatusCondition(proxyConfig.Status.Conditions, proxyv1beta1.ConditionSourceResolved).Reason
+	setCondition(proxyConfig, proxyv1beta1.ConditionReady, metav1.ConditionFalse, reason, "The proxy configuration could not be resolved, the workloads are left as they are")
+	if err := r.updateStatus(ctx, proxyConfig); err != nil {
 		return ctrl.Result{}, err
-	} else {
-		lggr.Info("Found " + strconv.Itoa(len(statefulSetList.Items)) + " StatefulSets")
+	}
 
-		for _, statefulSet := range statefulSetList.Items {
-			// Set the Proxy Secret Name
-			proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, statefulSet.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
-			// Create the Proxy Secret
-			err = createWorkloadProxySecret(proxySecretName, statefulSet.ObjectMeta.Namespace, proxyObj, "StatefulSet", cl, ctx, lggr)
-			if err != nil {
-				lggr.Error(err, "Failed to create Proxy Secret")
-			} else {
-				// Loop through the containers and update the environmental variables
-				for i := range statefulSet.Spec.Template.Spec.Containers {
-					currentEnvVars := statefulSet.Spec.Template.Spec.Containers[i].Env
-					updatedEnvVars := createWorkloadEnvVariables(currentEnvVars, proxySecretName, proxyObj)
-					statefulSet.Spec.Template.Spec.Containers[i].Env = updatedEnvVars
-				}
+	lggr.Info("Running reconciler again in " + strconv.Itoa(scanningInterval) + "s")
+	return ctrl.Result{RequeueAfter: time.Second * time.Duration(scanningInterval)}, nil
+}
 
-				err = cl.Update(ctx, &statefulSet)
-				if err != nil {
-					lggr.Error(err, "Failed to update StatefulSet", "StatefulSet.Namespace", statefulSet.Namespace, "StatefulSet.Name", statefulSet.Name)
-				} else {
-					lggr.Info("Updated StatefulSet", "StatefulSet.Namespace", statefulSet.Namespace, "StatefulSet.Name", statefulSet.Name)
-				}
-			}
+// injectWorkload injects the proxy configuration, and the CA certificate when requested, into every pod template of a workload.
+// What was injected is recorded on the workload, so entries that are no longer injected are removed again.
+// It returns the proxy environmental variables the containers set themselves, which are reported with events on the workload.
+func (r *ProxyConfigReconciler) injectWorkload(ctx context.Context, adapter WorkloadAdapter, workload client.Object, spec *proxyv1beta1.ProxyConfigSpec, owner configOwner, resolved resolvedProxyConfig) ([]proxyv1beta1.EnvConflict, error) {
+	kind := adapter.Kind()
+
+	opts, err := r.prepareInjection(ctx, kind, workload, spec, owner, resolved, false)
+	if err != nil {
+		return nil, err
+	}
+	migratesLegacySecret := readsLegacyProxySecret(adapter, workload)
+
+	var record *injectionRecord
+	err = r.retryOnConflict(ctx, adapter, workload, func(workload client.Object) error {
+		var err error
+		record, err = r.injectPodTemplates(ctx, adapter, workload, opts, owner)
+		return err
+	})
+	if err != nil {
+		lggr.Error(err, "Failed to update "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+		return nil, err
+	}
+	lggr.Info("Updated "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+	if migratesLegacySecret {
+		if err = r.markLegacyProxySecret(ctx, workload.GetNamespace(), owner); err != nil {
+			lggr.Error(err, "Failed to mark the legacy proxy Secret as migrated in "+workload.GetNamespace())
 		}
 	}
+	// The events are only recorded when the conflicts or invalid overrides change, not on every reconciliation
+	if record.overridesChanged {
+		r.reportInvalidOverrides(workload, opts.overrides)
+	}
+	if record.conflictsChanged {
+		r.reportEnvConflicts(workload, record.conflicts, owner)
+	}
+	return record.conflicts, nil
+}
 
-	// Get the DaemonSets
-	if err = cl.List(ctx, daemonSetList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list DaemonSets in "+proxyConfig.ObjectMeta.Namespace)
-		return ctrl.Result{}, err
+// recordSuspendedInjection records a workload the proxy configuration would be injected into as pending when injecting it
+// would change it, and as injected otherwise, without writing anything
+func (r *ProxyConfigReconciler) recordSuspendedInjection(ctx context.Context, inventory *workloadInventory, adapter WorkloadAdapter, workload client.Object, spec *proxyv1beta1.ProxyConfigSpec, owner configOwner, resolved resolvedProxyConfig) {
+	kind := adapter.Kind()
+
+	opts, err := r.prepareInjection(ctx, kind, workload, spec, owner, resolved, true)
+	if err != nil {
+		inventory.recordFailure(kind, workload.GetName(), err)
+		return
+	}
+	desired := workload.DeepCopyObject().(client.Object)
+	_, record, err := mutateWorkload(adapter, desired, opts, owner)
+	if err != nil {
+		inventory.recordFailure(kind, workload.GetName(), err)
+		return
+	}
+	inventory.recordEnvConflicts(kind, record.conflicts)
+	if equality.Semantic.DeepEqual(workload, desired) {
+		inventory.recordInjected(kind, workload.GetName())
 	} else {
-		lggr.Info("Found " + strconv.Itoa(len(daemonSetList.Items)) + " DaemonSets")
+		inventory.recordPending(kind, workload.GetName())
+	}
+}
 
-		for _, daemonSet := range daemonSetList.Items {
-			// Set the Proxy Secret Name
-			proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, daemonSet.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
-			// Create the Proxy Secret
-			err = createWorkloadProxySecret(proxySecretName, daemonSet.ObjectMeta.Namespace, proxyObj, "DaemonSet", cl, ctx, lggr)
-			if err != nil {
-				lggr.Error(err, "Failed to create Proxy Secret")
-			} else {
-				// Loop through the containers and update the environmental variables
-				for i := range daemonSet.Spec.Template.Spec.Containers {
-					currentEnvVars := daemonSet.Spec.Template.Spec.Containers[i].Env
-					updatedEnvVars := createWorkloadEnvVariables(currentEnvVars, proxySecretName, proxyObj)
-					daemonSet.Spec.Template.Spec.Containers[i].Env = updatedEnvVars
-				}
+// prepareInjection returns the injection options of a workload, creating the proxy Secret and CA certificate ConfigMap
+// it references unless dryRun is set
+func (r *ProxyConfigReconciler) prepareInjection(ctx context.Context, kind string, workload client.Object, spec *proxyv1beta1.ProxyConfigSpec, owner configOwner, resolved resolvedProxyConfig, dryRun bool) (injectionOptions, error) {
+	// Set the Proxy Secret Name, the CA certificate ConfigMap and mount path, and the injected containers, from the overrides of the workload
+	overrides := readWorkloadOverrides(workload)
+	opts := injectionOptions{
+		proxySecretName: SetDefaultString(owner.proxySecretName(), overrides.proxySecretName),
+		proxy:           resolved.proxy,
+		containers:      workloadContainerFilter(spec, overrides),
+		conflictPolicy:  spec.ConflictPolicy,
+		envFrom:         r.readEnvFrom(ctx, workload.GetNamespace(), resolved.envFrom),
+		overrides:       overrides,
+	}
+	if resolved.injectCACert {
+		opts.caCert = workloadCACertOptions(workload, overrides, owner)
+	}
 
-				err = cl.Update(ctx, &daemonSet)
-				if err != nil {
-					lggr.Error(err, "Failed to update DaemonSet", "DaemonSet.Namespace", daemonSet.Namespace, "DaemonSet.Name", daemonSet.Name)
-				} else {
-					lggr.Info("Updated DaemonSet", "DaemonSet.Namespace", daemonSet.Namespace, "DaemonSet.Name", daemonSet.Name)
-				}
-			}
+	// Workloads overriding the proxy URLs or noProxy get a proxy Secret of their own, holding the patched proxy configuration
+	if overrides.patchesProxy() {
+		resolved.proxy = mergeProxy(resolved.proxy, overrides.proxy)
+		opts.proxy = resolved.proxy
+		opts.proxySecretName = SetDefaultString(owner.workloadProxySecretName(kind, workloadName(workload)), overrides.proxySecretName)
+	}
+
+	// Stamp the content hash so a change to the proxy Secret or CA certificate rolls out the workload
+	if !spec.DisableRolloutOnChange {
+		opts.contentHash = resolved.contentHash(opts.caCert != nil)
+	}
+
+	if dryRun {
+		return opts, nil
+	}
+
+	// Create the Proxy Secret, the one of the workload is garbage collected along with it once it exists.
+	// At admission the workload doesn't exist yet, the Secret records it to be adopted on a later reconciliation.
+	var ownerReferences []metav1.OwnerReference
+	var adoptBy *adoptionTarget
+	if overrides.patchesProxy() && workload.GetUID() != "" {
+		gvk, err := apiutil.GVKForObject(workload, r.Scheme)
+		if err != nil {
+			return opts, err
+		}
+		ownerReferences = []metav1.OwnerReference{{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind, Name: workload.GetName(), UID: workload.GetUID()}}
+	} else if overrides.patchesProxy() {
+		adoptBy = &adoptionTarget{kind: kind, name: workload.GetName(), generateName: workload.GetGenerateName()}
+	}
+	if err := createWorkloadProxySecret(opts.proxySecretName, workload.GetNamespace(), resolved.proxy, owner, ownerReferences, adoptBy, kind, r.Client, ctx, lggr); err != nil {
+		lggr.Error(err, "Failed to create Proxy Secret")
+		r.reportNotOwned(workload, err)
+		return opts, err
+	}
+	if !overrides.patchesProxy() && workload.GetName() != "" {
+		if err := r.deleteWorkloadProxySecret(ctx, workload.GetNamespace(), owner.workloadProxySecretName(kind, workload.GetName()), owner); err != nil {
+			return opts, err
 		}
 	}
 
-	// Get the Jobs
-	if err = cl.List(ctx, jobList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list Jobs in "+proxyConfig.ObjectMeta.Namespace)
-		return ctrl.Result{}, err
-	} else {
-		lggr.Info("Found " + strconv.Itoa(len(jobList.Items)) + " Jobs")
+	// Create, adopt or sync the CA certificate ConfigMap
+	if opts.caCert != nil {
+		if err := r.ensureCACertConfigMap(ctx, workload.GetNamespace(), opts.caCert, resolved, owner); err != nil {
+			lggr.Error(err, "Failed to create CA certificate ConfigMap")
+			r.reportNotOwned(workload, err)
+			return opts, err
+		}
 	}
+	return opts, nil
+}
 
-	// Get the CronJobs
-	if err = cl.List(ctx, cronJobList, listOpts...); err != nil {
-		lggr.Error(err, "Failed to list CronJobs in "+proxyConfig.ObjectMeta.Namespace)
-		return ctrl.Result{}, err
-	} else {
-		lggr.Info("Found " + strconv.Itoa(len(cronJobList.Items)) + " CronJobs")
+// injectPodTemplates injects into the pod templates of a workload and writes it back to the API server.
+// It returns the injection record, holding the proxy environmental variables the containers set themselves.
+func (r *ProxyConfigReconciler) injectPodTemplates(ctx context.Context, adapter WorkloadAdapter, workload client.Object, opts injectionOptions, owner configOwner) (*injectionRecord, error) {
+	live := workload.DeepCopyObject().(client.Object)
+	templates, record, err := mutateWorkload(adapter, workload, opts, owner)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.writeWorkload(ctx, adapter, live, workload, templates, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
 
-		for _, cronJob := range cronJobList.Items {
-			// Set the Proxy Secret Name
-			proxySecretName := SetDefaultString(PROXY_INJECTION_SECRET_DEFAULT_NAME, cronJob.ObjectMeta.Labels[PROXY_INJECTION_SECRET_LABEL])
-			// Create the Proxy Secret
-			err = createWorkloadProxySecret(proxySecretName, cronJob.ObjectMeta.Namespace, proxyObj, "CronJob", cl, ctx, lggr)
-			if err != nil {
-				lggr.Error(err, "Failed to create Proxy Secret")
-			} else {
-				// Loop through the containers and update the environmental variables
-				for i := range cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers {
-					currentEnvVars := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[i].Env
-					updatedEnvVars := createWorkloadEnvVariables(currentEnvVars, proxySecretName, proxyObj)
-					cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[i].Env = updatedEnvVars
-				}
+// mutateWorkload injects into the pod templates of a workload in place, removing what is no longer injected,
+// and records what was injected in its annotations
+func mutateWorkload(adapter WorkloadAdapter, workload client.Object, opts injectionOptions, owner configOwner) ([]*corev1.PodTemplateSpec, *injectionRecord, error) {
+	kind := adapter.Kind()
 
-				err = cl.Update(ctx, &cronJob)
-				if err != nil {
-					lggr.Error(err, "Failed to update CronJob", "CronJob.Namespace", cronJob.Namespace, "CronJob.Name", cronJob.Name)
-				} else {
-					lggr.Info("Updated CronJob", "CronJob.Namespace", cronJob.Namespace, "CronJob.Name", cronJob.Name)
+	previous, err := readInjectionRecord(workload)
+	if err != nil {
+		lggr.Error(err, "Ignoring the injection record of "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+	}
+
+	templates, err := adapter.GetPodTemplates(workload)
+	if err != nil {
+		lggr.Error(err, "Failed to get the pod templates of "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+		return nil, nil, err
+	}
+	record := newInjectionRecord(owner)
+	for _, template := range templates {
+		if err = injectPodSpec(&template.Spec, opts, previous, record); err != nil {
+			lggr.Error(err, "Failed to inject into "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+			return nil, nil, err
+		}
+		if opts.contentHash != "" {
+			stampContentHash(template, opts.contentHash, record)
+		}
+	}
+	// Remove what was injected before but isn't anymore, eg the CA certificate after opting out of it.
+	// The variables set by the containers themselves are restored instead, and kept in the record so they are applied as they were.
+	if previous != nil {
+		stale := previous.subtract(record)
+		for _, template := range templates {
+			stripPodTemplate(template, stale)
+		}
+		for _, template := range templates {
+			for _, container := range podContainers(&template.Spec) {
+				for name, original := range stale.Originals[container.name] {
+					record.addEnv(container.name, name)
+					record.addOriginal(container.name, original)
 				}
 			}
 		}
 	}
+	for i := range record.conflicts {
+		record.conflicts[i].Name = workloadName(workload)
+	}
+	record.hashConflicts(previous)
+	record.hashOverrides(opts.overrides, previous)
+	if err = adapter.SetPodTemplates(workload, templates); err != nil {
+		lggr.Error(err, "Failed to set the pod templates of "+kind, kind+".Namespace", workload.GetNamespace(), kind+".Name", workload.GetName())
+		return nil, nil, err
+	}
+	if err = writeInjectionRecord(workload, record); err != nil {
+		return nil, nil, err
+	}
+	return templates, record, nil
+}
 
-	// Create a ConfigMap
-	//createOpenShiftCACertConfigMap(cl, ctx, lggr, caCertConfigMapName, proxyConfig.ObjectMeta.Namespace)
-
-	return ctrl.Result{}, nil
+// listFailed reports a workload listing failure in the ProxyConfig status and returns the error to requeue the request
+func (r *ProxyConfigReconciler) listFailed(ctx context.Context, proxyConfig *proxyv1beta1.ProxyConfig, kind string, err error) (ctrl.Result, error) {
+	setCondition(proxyConfig, proxyv1beta1.ConditionDegraded, metav1.ConditionTrue, REASON_LIST_FAILED, "Failed to list "+kind+": "+err.Error())
+	setCondition(proxyConfig, proxyv1beta1.ConditionReady, metav1.ConditionFalse, REASON_LIST_FAILED, "Failed to list "+kind)
+	_ = r.updateStatus(ctx, proxyConfig)
+	return ctrl.Result{}, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// Besides the ProxyConfigs themselves, the workloads, their namespaces, the OpenShift cluster Proxy, the inherited
+// ClusterProxyConfigs and the trusted CA ConfigMaps are watched so changes reach the workloads without touching the ProxyConfig.
+// Secrets and ConfigMaps are only watched by their metadata, so their data isn't cached for the whole cluster.
 func (r *ProxyConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&proxyv1alpha1.ProxyConfig{}).
-		Complete(r)
+	if r.Workloads == nil {
+		return fmt.Errorf("no workload registry set on the ProxyConfig reconciler")
+	}
+
+	ctx := context.Background()
+	if err := setupProxyConfigIndexes(ctx, mgr); err != nil {
+		return err
+	}
+	workloadPredicates := builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{}))
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{MaxConcurrentReconciles: SetDefaultInt(1, r.MaxConcurrentReconciles)}).
+		For(&proxyv1beta1.ProxyConfig{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.mapConfigMapToProxyConfigs), builder.OnlyMetadata).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapSecretToProxyConfigs), builder.OnlyMetadata).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.mapNamespaceToProxyConfigs),
+			builder.WithPredicates(predicate.Or(predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Watches(&proxyv1beta1.ClusterProxyConfig{}, handler.EnqueueRequestsFromMapFunc(r.mapClusterProxyConfigToProxyConfigs),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+
+	// Watch and index every registered workload kind the cluster serves, eg DeploymentConfigs only exist on OpenShift.
+	// Kinds that are not watched are listed from the API server instead.
+	r.watchedKinds = map[string]bool{}
+	for _, adapter := range r.Workloads.Adapters() {
+		obj := adapter.NewObject()
+		gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+		if err != nil {
+			return err
+		}
+		if !isKindAvailable(mgr, gvk) {
+			lggr.Info(adapter.Kind() + "s are not served by this cluster, not watching them")
+			continue
+		}
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			// Custom resources need their own RBAC rules, which can't be generated ahead of time
+			lggr.Info("Injecting into custom resource "+gvk.String()+", make sure the manager role grants access to it", "Rule", workloadRBACRule(mgr, gvk))
+		}
+		if err := setupWorkloadIndex(ctx, mgr, obj); err != nil {
+			return err
+		}
+		b = b.Watches(obj, handler.EnqueueRequestsFromMapFunc(r.mapWorkloadToProxyConfigs), workloadPredicates)
+		r.watchedKinds[adapter.Kind()] = true
+	}
+
+	if isKindAvailable(mgr, configv1.GroupVersion.WithKind("Proxy")) {
+		b = b.Watches(&configv1.Proxy{}, handler.EnqueueRequestsFromMapFunc(r.mapClusterProxyToProxyConfigs))
+	} else {
+		lggr.Info("The OpenShift cluster Proxy is not served by this cluster, not watching it")
+	}
+
+	return b.Complete(r)
 }
@@ -0,0 +1,360 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// resolvedProxyConfig is the proxy configuration resolved from the source of a ProxyConfig
+type resolvedProxyConfig struct {
+	source string
+	// inheritedFrom is the cluster-level proxy configuration that was inherited and patched, if any
+	inheritedFrom string
+	proxy         proxyv1beta1.Proxy
+	injectCACert  bool
+	// caSource is how the CA certificate reaches the workload namespaces. With "openshift" the bundle is injected
+	// by the Cluster Network Operator, and caBundle holds the trusted CA of the cluster Proxy only to detect changes.
+	// With "custom" caBundle is copied into the workload namespaces.
+	caSource string
+	caBundle string
+	// envFrom memoizes the envFrom sources read while injecting the workloads, it is nil when they are read every time
+	envFrom envFromCache
+}
+
+// contentHash returns a hash of the injected proxy configuration and CA certificate, stamped on the pod templates
+// so a change rolls out the workloads
+func (r resolvedProxyConfig) contentHash(withCACert bool) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.proxy.HTTPProxy + "\n" + r.proxy.HTTPSProxy + "\n" + proxyv1beta1.FormatNoProxy(r.proxy.NoProxy) + "\n"))
+	if withCACert {
+		caDigest := sha256.Sum256([]byte(r.caBundle))
+		hash.Write([]byte(hex.EncodeToString(caDigest[:])))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// resolveProxySource reads the proxy configuration from the source of a ProxyConfig, or the configuration it inherits
+func (r *ProxyConfigReconciler) resolveProxySource(ctx context.Context, spec proxyv1beta1.ProxyConfigSpec) (resolvedProxyConfig, error) {
+	if spec.InheritFrom != nil {
+		return r.resolveInherited(ctx, spec)
+	}
+	resolved := resolvedProxyConfig{source: SetDefaultString(DEFAULT_PROXY_SOURCE, spec.ProxySource)}
+
+	// Switch based on proxySource types
+	if resolved.source == "openshift" {
+		// Check to see if this is a SNO instance - just because, once as the topology of a cluster doesn't change
+		r.snoCheck.Do(func() {
+			IsOpenshiftSno, err := IsOpenshiftSno(r.APIReader, lggr)
+			if err != nil {
+				lggr.Error(err, "Failed to determine if this is a SNO instance")
+			} else {
+				lggr.Info("IsOpenshiftSno: " + strconv.FormatBool(IsOpenshiftSno))
+			}
+		})
+
+		// Get the OpenShift Cluster Proxy Configuration
+		clusterProxyConfig, err := getOpenShiftClusterProxyConfiguration(r.Client, lggr)
+		if err != nil {
+			lggr.Error(err, "Failed to get OpenShift Cluster Proxy Configuration")
+			return resolved, err
+		}
+
+		// Set the Proxy variables
+		resolved.proxy = proxyv1beta1.Proxy{
+			HTTPProxy:  SetDefaultString("", clusterProxyConfig.Status.HTTPProxy),
+			HTTPSProxy: SetDefaultString("", clusterProxyConfig.Status.HTTPSProxy),
+			NoProxy:    proxyv1beta1.ParseNoProxy(clusterProxyConfig.Status.NoProxy),
+		}
+
+		// Check if there is a trustedCA defined in the OpenShift proxy config
+		if clusterProxyConfig.Spec.TrustedCA.Name != "" && spec.CACert != nil && spec.CACert.Inject {
+			// We don't need to get the name of the CA Certificate ConfigMap since:
+			// 1. The ConfigMap is in the openshift-config namespace
+			// 2. The ConfigMap can be generated with the proper label
+			// 3. We just need to know if we're injecting it into workloads at this point
+			resolved.injectCACert = true
+			resolved.caSource = "openshift"
+
+			// Read the trusted CA to detect changes, the Cluster Network Operator copies it into the workload namespaces
+			trustedCA := &corev1.ConfigMap{}
+			if err := r.Get(ctx, types.NamespacedName{Name: clusterProxyConfig.Spec.TrustedCA.Name, Namespace: OPENSHIFT_CONFIG_NAMESPACE}, trustedCA); err != nil {
+				lggr.Error(err, "Failed to get the trusted CA ConfigMap of the OpenShift cluster Proxy")
+			} else {
+				resolved.caBundle = trustedCA.Data[PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY]
+			}
+		}
+		return resolved, nil
+	}
+
+	// Set the proxy variables
+	if spec.Proxy != nil {
+		resolved.proxy = *spec.Proxy.DeepCopy()
+	}
+	return resolved, nil
+}
+
+// resolveInherited reads the cluster-level proxy configuration a ProxyConfig inherits from, and patches it with the ProxyConfig.
+// The CA certificate is patched by resolveCACert.
+func (r *ProxyConfigReconciler) resolveInherited(ctx context.Context, spec proxyv1beta1.ProxyConfigSpec) (resolvedProxyConfig, error) {
+	resolved, err := r.resolveParent(ctx, spec)
+	resolved.inheritedFrom = string(spec.InheritFrom.Kind)
+	if spec.InheritFrom.Name != "" {
+		resolved.inheritedFrom += "/" + spec.InheritFrom.Name
+	}
+	if err != nil {
+		return resolved, err
+	}
+
+	if spec.Proxy != nil {
+		resolved.proxy = mergeProxy(resolved.proxy, *spec.Proxy)
+	}
+	return resolved, nil
+}
+
+// resolveParent reads the cluster-level proxy configuration a ProxyConfig inherits from
+func (r *ProxyConfigReconciler) resolveParent(ctx context.Context, spec proxyv1beta1.ProxyConfigSpec) (resolvedProxyConfig, error) {
+	switch inheritFrom := spec.InheritFrom; inheritFrom.Kind {
+	case proxyv1beta1.InheritFromClusterProxy:
+		// The trustedCA of the cluster Proxy is injected as requested by the ProxyConfig
+		return r.resolveProxySource(ctx, proxyv1beta1.ProxyConfigSpec{ProxySource: "openshift", CACert: spec.CACert})
+
+	case proxyv1beta1.InheritFromClusterProxyConfig:
+		clusterProxyConfig := &proxyv1beta1.ClusterProxyConfig{}
+		if err := r.Get(ctx, types.NamespacedName{Name: inheritFrom.Name}, clusterProxyConfig); err != nil {
+			lggr.Error(err, "Failed to get the inherited ClusterProxyConfig "+inheritFrom.Name)
+			return resolvedProxyConfig{}, err
+		}
+		parent := clusterProxyConfig.Spec.ProxyConfigSpec
+		if parent.InheritFrom != nil && parent.InheritFrom.Kind == proxyv1beta1.InheritFromClusterProxyConfig {
+			return resolvedProxyConfig{}, fmt.Errorf("ClusterProxyConfig %s inherits from another ClusterProxyConfig, which is not supported", inheritFrom.Name)
+		}
+		resolved, err := r.resolveProxySource(ctx, parent)
+		if err != nil {
+			return resolved, err
+		}
+		return resolved, r.resolveCACert(ctx, &parent, "", &resolved)
+	}
+	return resolvedProxyConfig{}, fmt.Errorf("can't inherit from a %s", spec.InheritFrom.Kind)
+}
+
+// mergeProxy patches an inherited proxy configuration: the proxy URLs that are set replace the inherited ones,
+// and the noProxy entries are appended to the inherited ones
+func mergeProxy(inherited proxyv1beta1.Proxy, patch proxyv1beta1.Proxy) proxyv1beta1.Proxy {
+	merged := *inherited.DeepCopy()
+	if patch.HTTPProxy != "" {
+		merged.HTTPProxy = patch.HTTPProxy
+	}
+	if patch.HTTPSProxy != "" {
+		merged.HTTPSProxy = patch.HTTPSProxy
+	}
+	for _, entry := range patch.NoProxy {
+		if !ContainsString(merged.NoProxy, entry) {
+			merged.NoProxy = append(merged.NoProxy, entry)
+		}
+	}
+	return merged
+}
+
+// workloadProxyConfig returns the ProxyConfig injecting a workload of a kind, or nil when there is none.
+// When there are several, the one taking precedence is used.
+func (r *ProxyConfigReconciler) workloadProxyConfig(ctx context.Context, kind string, workload client.Object) (*proxyv1beta1.ProxyConfig, error) {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList, client.InNamespace(workload.GetNamespace())); err != nil {
+		return nil, err
+	}
+
+	namespaceOptIn, err := r.isNamespaceOptedIn(ctx, workload.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	return selectProxyConfig(proxyConfigList.Items, kind, workload, namespaceOptIn), nil
+}
+
+// selectProxyConfig returns the ProxyConfig taking precedence of the ones in the namespace of a workload injecting it,
+// or nil when there is none
+func selectProxyConfig(proxyConfigs []proxyv1beta1.ProxyConfig, kind string, workload client.Object, namespaceOptIn bool) *proxyv1beta1.ProxyConfig {
+	var selected *proxyv1beta1.ProxyConfig
+	for i := range proxyConfigs {
+		proxyConfig := &proxyConfigs[i]
+		if !proxyConfig.DeletionTimestamp.IsZero() {
+			continue
+		}
+		selector, err := workloadSelector(proxyConfig.Spec)
+		if err != nil {
+			continue
+		}
+		if inject, _ := injectionDecision(proxyConfig.Spec, selector, kind, workload, namespaceOptIn); !inject {
+			continue
+		}
+		if selected == nil || takesPrecedence(proxyConfig.Spec.Priority, proxyConfig, selected.Spec.Priority, selected) {
+			selected = proxyConfig
+		}
+	}
+	return selected
+}
+
+// workloadClusterProxyConfig returns the ClusterProxyConfig injecting a workload of a kind that no ProxyConfig injects,
+// or nil when there is none. When there are several, the one taking precedence is used.
+func (r *ProxyConfigReconciler) workloadClusterProxyConfig(ctx context.Context, kind string, workload client.Object) (*proxyv1beta1.ClusterProxyConfig, error) {
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList); err != nil {
+		return nil, err
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: workload.GetNamespace()}, namespace); err != nil {
+		return nil, err
+	}
+	return selectClusterProxyConfig(clusterProxyConfigList.Items, kind, workload, namespace), nil
+}
+
+// selectClusterProxyConfig returns the ClusterProxyConfig taking precedence of the ones selecting the namespace of a workload
+// and injecting it, or nil when there is none
+func selectClusterProxyConfig(clusterProxyConfigs []proxyv1beta1.ClusterProxyConfig, kind string, workload client.Object, namespace *corev1.Namespace) *proxyv1beta1.ClusterProxyConfig {
+	var selected *proxyv1beta1.ClusterProxyConfig
+	for i := range clusterProxyConfigs {
+		clusterProxyConfig := &clusterProxyConfigs[i]
+		if !clusterProxyConfig.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if selects, err := selectsNamespace(clusterProxyConfig.Spec, namespace); err != nil || !selects {
+			continue
+		}
+		selector, err := workloadSelector(clusterProxyConfig.Spec.ProxyConfigSpec)
+		if err != nil {
+			continue
+		}
+		if inject, _ := injectionDecision(clusterProxyConfig.Spec.ProxyConfigSpec, selector, kind, workload, namespaceOptedIn(namespace)); !inject {
+			continue
+		}
+		if selected == nil || takesPrecedence(clusterProxyConfig.Spec.Priority, clusterProxyConfig, selected.Spec.Priority, selected) {
+			selected = clusterProxyConfig
+		}
+	}
+	return selected
+}
+
+// takesPrecedence returns whether a proxy configuration takes precedence over another one injecting the same workload:
+// the highest priority wins, then the oldest, then the name sorting first
+func takesPrecedence(priority int32, obj metav1.Object, otherPriority int32, other metav1.Object) bool {
+	if priority != otherPriority {
+		return priority > otherPriority
+	}
+	created, otherCreated := obj.GetCreationTimestamp(), other.GetCreationTimestamp()
+	if !created.Equal(&otherCreated) {
+		return created.Before(&otherCreated)
+	}
+	return obj.GetName() < other.GetName()
+}
+
+// resolveCACert reads the CA certificate of the "custom" proxy source when it is to be injected,
+// there is no Cluster Network Operator to inject it.
+// With inheritFrom, a caCert without a source keeps the inherited CA certificate, or stops injecting it.
+// The namespace is the one of the ProxyConfig, ClusterProxyConfigs pass an empty one and reference the namespace of their CA certificate.
+func (r *ProxyConfigReconciler) resolveCACert(ctx context.Context, spec *proxyv1beta1.ProxyConfigSpec, namespace string, resolved *resolvedProxyConfig) error {
+	if spec.CACert == nil {
+		return nil
+	}
+	if spec.InheritFrom != nil {
+		if !spec.CACert.Inject {
+			resolved.injectCACert = false
+			return nil
+		}
+		if spec.CACert.Source == nil {
+			return nil
+		}
+	} else if resolved.source != "custom" || !spec.CACert.Inject {
+		return nil
+	}
+	caBundle, err := resolveCustomCABundle(ctx, r.Client, namespace, spec.CACert.Source)
+	resolved.caSource = "custom"
+	resolved.caBundle = caBundle
+	resolved.injectCACert = caBundle != ""
+	return err
+}
+
+// customCASource returns the source of the CA certificate of a ProxyConfig using the "custom" proxy source, or nil
+func customCASource(spec proxyv1beta1.ProxyConfigSpec) *proxyv1beta1.CASource {
+	if spec.ProxySource != "custom" || spec.CACert == nil {
+		return nil
+	}
+	return spec.CACert.Source
+}
+
+// caSourceNamespace returns the namespace the CA certificate of a CA source is read from.
+// A ProxyConfig can only read from its own namespace, whatever the namespace it references, as the validating webhook
+// may not have checked it. ClusterProxyConfigs, passing an empty namespace, have to reference one.
+func caSourceNamespace(ref *proxyv1beta1.CAKeyReference, namespace string) (string, error) {
+	if namespace == "" {
+		if ref.Namespace == "" {
+			return "", fmt.Errorf("the namespace of the CA certificate %s is not set", ref.Name)
+		}
+		return ref.Namespace, nil
+	}
+	if ref.Namespace != "" && ref.Namespace != namespace {
+		return "", fmt.Errorf("a ProxyConfig can only read its CA certificate from its own namespace %s, not %s", namespace, ref.Namespace)
+	}
+	return namespace, nil
+}
+
+// resolveCustomCABundle reads the CA certificate from the CA source of the "custom" proxy source.
+// It returns an empty bundle when no CA certificate is referenced.
+func resolveCustomCABundle(ctx context.Context, c client.Reader, namespace string, source *proxyv1beta1.CASource) (string, error) {
+	if source == nil {
+		return "", nil
+	}
+
+	switch source.Type {
+	case proxyv1beta1.CASourceInline:
+		return source.Inline, nil
+
+	case proxyv1beta1.CASourceSecret:
+		if source.Secret == nil {
+			return "", fmt.Errorf("CA source of type %s references no Secret", source.Type)
+		}
+		key := SetDefaultString(PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY, source.Secret.Key)
+		namespace, err := caSourceNamespace(source.Secret, namespace)
+		if err != nil {
+			return "", err
+		}
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Name: source.Secret.Name, Namespace: namespace}, secret); err != nil {
+			return "", err
+		}
+		bundle, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in Secret %s/%s", key, namespace, source.Secret.Name)
+		}
+		return string(bundle), nil
+
+	case proxyv1beta1.CASourceConfigMap:
+		if source.ConfigMap == nil {
+			return "", fmt.Errorf("CA source of type %s references no ConfigMap", source.Type)
+		}
+		key := SetDefaultString(PROXY_CA_CERT_CONFIGMAP_DEFAULT_KEY, source.ConfigMap.Key)
+		namespace, err := caSourceNamespace(source.ConfigMap, namespace)
+		if err != nil {
+			return "", err
+		}
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, types.NamespacedName{Name: source.ConfigMap.Name, Namespace: namespace}, configMap); err != nil {
+			return "", err
+		}
+		bundle, ok := configMap.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in ConfigMap %s/%s", key, namespace, source.ConfigMap.Name)
+		}
+		return bundle, nil
+	}
+
+	return "", nil
+}
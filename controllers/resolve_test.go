@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// testObjectMeta returns the metadata of a ProxyConfig or ClusterProxyConfig created some time ago
+func testObjectMeta(name string, age time.Duration) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(time.Now().Add(-age).Truncate(time.Second))}
+}
+
+var _ = Describe("Deciding which proxy configuration injects a workload", func() {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+
+	newProxyConfig := func(name string, age time.Duration, priority int32) proxyv1beta1.ProxyConfig {
+		return proxyv1beta1.ProxyConfig{ObjectMeta: testObjectMeta(name, age), Spec: proxyv1beta1.ProxyConfigSpec{Priority: priority}}
+	}
+	newClusterProxyConfig := func(name string, age time.Duration, priority int32) proxyv1beta1.ClusterProxyConfig {
+		clusterProxyConfig := proxyv1beta1.ClusterProxyConfig{ObjectMeta: testObjectMeta(name, age)}
+		clusterProxyConfig.Namespace = ""
+		clusterProxyConfig.Spec.Priority = priority
+		return clusterProxyConfig
+	}
+	selected := func(p *precedence) *configOwner {
+		return p.selected("Deployment", newTestDeployment("app"), namespace)
+	}
+
+	It("prefers the higher priority", func() {
+		p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"default": {
+			newProxyConfig("old", time.Hour, 0),
+			newProxyConfig("urgent", time.Minute, 10),
+		}}}
+		Expect(selected(p)).To(Equal(configOwnerPtr(proxyConfigOwner("urgent"))))
+	})
+
+	It("prefers the older one at the same priority", func() {
+		p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"default": {
+			newProxyConfig("a-new", time.Minute, 0),
+			newProxyConfig("b-old", time.Hour, 0),
+		}}}
+		Expect(selected(p)).To(Equal(configOwnerPtr(proxyConfigOwner("b-old"))))
+	})
+
+	It("prefers the lower name when created at once", func() {
+		p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"default": {
+			newProxyConfig("b", time.Hour, 0),
+			newProxyConfig("a", time.Hour, 0),
+		}}}
+		Expect(selected(p)).To(Equal(configOwnerPtr(proxyConfigOwner("a"))))
+	})
+
+	It("ignores the ones being deleted", func() {
+		deleting := newProxyConfig("deleting", time.Hour, 10)
+		deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"default": {deleting, newProxyConfig("kept", time.Minute, 0)}}}
+		Expect(selected(p)).To(Equal(configOwnerPtr(proxyConfigOwner("kept"))))
+	})
+
+	It("prefers a ProxyConfig in the namespace over a ClusterProxyConfig", func() {
+		p := &precedence{
+			proxyConfigs:        map[string][]proxyv1beta1.ProxyConfig{"default": {newProxyConfig("local", time.Minute, 0)}},
+			clusterProxyConfigs: []proxyv1beta1.ClusterProxyConfig{newClusterProxyConfig("cluster", time.Hour, 100)},
+		}
+		Expect(selected(p)).To(Equal(configOwnerPtr(proxyConfigOwner("local"))))
+	})
+
+	It("falls back to the ClusterProxyConfig taking precedence", func() {
+		other := newClusterProxyConfig("other-namespaces", time.Hour, 100)
+		other.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "other"}}
+		p := &precedence{
+			proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"elsewhere": {newProxyConfig("elsewhere", time.Hour, 0)}},
+			clusterProxyConfigs: []proxyv1beta1.ClusterProxyConfig{
+				other,
+				newClusterProxyConfig("low", time.Hour, 0),
+				newClusterProxyConfig("high", time.Minute, 5),
+			},
+		}
+		Expect(selected(p)).To(Equal(configOwnerPtr(clusterProxyConfigOwner("high"))))
+	})
+
+	It("selects nothing when no proxy configuration targets the workload", func() {
+		p := &precedence{proxyConfigs: map[string][]proxyv1beta1.ProxyConfig{"default": {{
+			ObjectMeta: testObjectMeta("statefulsets", time.Hour),
+			Spec:       proxyv1beta1.ProxyConfigSpec{Kinds: []string{"StatefulSet"}},
+		}}}}
+		Expect(selected(p)).To(BeNil())
+	})
+})
+
+// configOwnerPtr returns a pointer to a configOwner
+func configOwnerPtr(owner configOwner) *configOwner {
+	return &owner
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"context"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// legacyWorkloadSelector selects the workloads carrying the injection label, used when a ProxyConfig sets no workloadSelector
+var legacyWorkloadSelector = labels.SelectorFromSet(labels.Set{PROXY_INJECTION_LABEL: "true"})
+
+// workloadSelector returns the label selector of the workloads a ProxyConfig targets.
+// Without a workloadSelector, the workloads carrying the injection label are targeted.
+func workloadSelector(spec proxyv1beta1.ProxyConfigSpec) (labels.Selector, error) {
+	if spec.WorkloadSelector == nil {
+		return legacyWorkloadSelector, nil
+	}
+	return metav1.LabelSelectorAsSelector(spec.WorkloadSelector)
+}
+
+// targetsKind returns whether a ProxyConfig injects into a workload kind, all kinds are targeted when it lists none
+func targetsKind(spec proxyv1beta1.ProxyConfigSpec, kind string) bool {
+	return len(spec.Kinds) == 0 || ContainsString(spec.Kinds, kind)
+}
+
+// containerFilter decides which containers of a workload the proxy configuration is injected into, by name.
+// The zero value injects every container but the well-known sidecars.
+type containerFilter struct {
+	// include lists the only containers that are injected, every container is a candidate when it is nil
+	include []string
+	exclude []string
+
+	// initContainers, nativeSidecars and ephemeralContainers inject these types of containers along with the containers
+	initContainers      bool
+	nativeSidecars      bool
+	ephemeralContainers bool
+}
+
+// workloadContainerFilter returns the container filter of a workload, the include annotation replacing the include list
+// of the proxy configuration and the exclude annotation adding to its exclude list
+func workloadContainerFilter(spec *proxyv1beta1.ProxyConfigSpec, overrides workloadOverrides) containerFilter {
+	filter := containerFilter{}
+	if spec.Containers != nil {
+		if len(spec.Containers.Include) > 0 {
+			filter.include = spec.Containers.Include
+		}
+		filter.exclude = append(filter.exclude, spec.Containers.Exclude...)
+		filter.initContainers = spec.Containers.InitContainers
+		filter.nativeSidecars = spec.Containers.NativeSidecars
+		filter.ephemeralContainers = spec.Containers.EphemeralContainers
+	}
+	if len(overrides.includeContainers) > 0 {
+		filter.include = overrides.includeContainers
+	}
+	filter.exclude = append(filter.exclude, overrides.excludeContainers...)
+	return filter
+}
+
+// selectContainers returns the containers of a pod spec the proxy configuration is injected into
+func (f containerFilter) selectContainers(podSpec *corev1.PodSpec) []podContainer {
+	selected := []podContainer{}
+	for _, container := range podContainers(podSpec) {
+		if f.injectsType(container) && f.injects(container.name) {
+			selected = append(selected, container)
+		}
+	}
+	return selected
+}
+
+// injectsType returns whether the type of a container is injected, the containers always are
+func (f containerFilter) injectsType(container podContainer) bool {
+	switch {
+	case container.nativeSidecar:
+		return f.nativeSidecars
+	case container.list == "initContainers":
+		return f.initContainers
+	case container.list == "ephemeralContainers":
+		return f.ephemeralContainers
+	}
+	return true
+}
+
+// injects returns whether a container is injected by name. Excluded containers never are, and the well-known sidecars
+// only are when they are explicitly included.
+func (f containerFilter) injects(name string) bool {
+	if ContainsString(f.exclude, name) {
+		return false
+	}
+	if f.include != nil {
+		return ContainsString(f.include, name)
+	}
+	return !ContainsString(DEFAULT_EXCLUDED_CONTAINERS, name)
+}
+
+// selectsNamespace returns whether a ClusterProxyConfig selects a namespace, every namespace is selected without a namespaceSelector
+func selectsNamespace(spec proxyv1beta1.ClusterProxyConfigSpec, namespace *corev1.Namespace) (bool, error) {
+	if spec.NamespaceSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// namespaceOptedIn returns whether a namespace opted every workload in it into the injection,
+// with the injection label or an annotation of the same name
+func namespaceOptedIn(namespace *corev1.Namespace) bool {
+	return namespace.Labels[PROXY_INJECTION_LABEL] == "true" || namespace.Annotations[PROXY_INJECTION_LABEL] == "true"
+}
+
+// isNamespaceOptedIn reads a namespace and returns whether it opted every workload in it into the injection
+func (r *ProxyConfigReconciler) isNamespaceOptedIn(ctx context.Context, name string) (bool, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return false, err
+	}
+	return namespaceOptedIn(namespace), nil
+}
+
+// injectionDecision returns whether a ProxyConfig injects a workload of a kind, and the reason reported in its status.
+// A workload is targeted when it matches the workloadSelector or its namespace opted in, and the injection label set
+// to "false" opts it out again. The reason is empty for workloads that are not targeted at all.
+func injectionDecision(spec proxyv1beta1.ProxyConfigSpec, selector labels.Selector, kind string, workload client.Object, namespaceOptIn bool) (bool, string) {
+	if !targetsKind(spec, kind) {
+		return false, ""
+	}
+	selected := selector.Matches(labels.Set(workload.GetLabels()))
+	if !selected && !namespaceOptIn {
+		return false, ""
+	}
+	if workload.GetLabels()[PROXY_INJECTION_LABEL] == "false" {
+		return false, proxyv1beta1.DecisionWorkloadOptOut
+	}
+	if !selected {
+		return true, proxyv1beta1.DecisionNamespaceOptIn
+	}
+	if spec.WorkloadSelector == nil {
+		return true, proxyv1beta1.DecisionWorkloadLabel
+	}
+	return true, proxyv1beta1.DecisionWorkloadSelector
+}
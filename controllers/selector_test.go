@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+)
+
+// decide returns the injection decision of a ProxyConfig spec for a Deployment carrying some labels
+func decide(spec proxyv1beta1.ProxyConfigSpec, workloadLabels map[string]string, namespaceOptIn bool) (bool, string) {
+	selector, err := workloadSelector(spec)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	deployment := newTestDeployment("decide")
+	deployment.Labels = workloadLabels
+	return injectionDecision(spec, selector, "Deployment", deployment, namespaceOptIn)
+}
+
+var _ = Describe("Deciding which workloads are injected", func() {
+	labelled := map[string]string{PROXY_INJECTION_LABEL: "true"}
+	frontend := map[string]string{"app.kubernetes.io/part-of": "frontend"}
+
+	It("injects the workloads carrying the injection label without a workloadSelector", func() {
+		inject, decision := decide(proxyv1beta1.ProxyConfigSpec{}, labelled, false)
+		Expect(inject).To(BeTrue())
+		Expect(decision).To(Equal(proxyv1beta1.DecisionWorkloadLabel))
+
+		inject, decision = decide(proxyv1beta1.ProxyConfigSpec{}, frontend, false)
+		Expect(inject).To(BeFalse())
+		Expect(decision).To(BeEmpty())
+	})
+
+	It("injects the workloads matching the workloadSelector", func() {
+		spec := proxyv1beta1.ProxyConfigSpec{WorkloadSelector: &metav1.LabelSelector{MatchLabels: frontend}}
+		inject, decision := decide(spec, frontend, false)
+		Expect(inject).To(BeTrue())
+		Expect(decision).To(Equal(proxyv1beta1.DecisionWorkloadSelector))
+
+		inject, _ = decide(spec, labelled, false)
+		Expect(inject).To(BeFalse())
+	})
+
+	It("injects every workload with an empty workloadSelector", func() {
+		inject, decision := decide(proxyv1beta1.ProxyConfigSpec{WorkloadSelector: &metav1.LabelSelector{}}, nil, false)
+		Expect(inject).To(BeTrue())
+		Expect(decision).To(Equal(proxyv1beta1.DecisionWorkloadSelector))
+	})
+
+	It("only injects the listed kinds", func() {
+		inject, decision := decide(proxyv1beta1.ProxyConfigSpec{Kinds: []string{"StatefulSet"}}, labelled, false)
+		Expect(inject).To(BeFalse())
+		Expect(decision).To(BeEmpty())
+
+		inject, _ = decide(proxyv1beta1.ProxyConfigSpec{Kinds: []string{"StatefulSet", "Deployment"}}, labelled, false)
+		Expect(inject).To(BeTrue())
+	})
+	Context("with a namespace opted in", func() {
+		It("injects every workload of the namespace", func() {
+			inject, decision := decide(proxyv1beta1.ProxyConfigSpec{}, frontend, true)
+			Expect(inject).To(BeTrue())
+			Expect(decision).To(Equal(proxyv1beta1.DecisionNamespaceOptIn))
+		})
+
+		It("reports the workloads selected on their own", func() {
+			inject, decision := decide(proxyv1beta1.ProxyConfigSpec{}, labelled, true)
+			Expect(inject).To(BeTrue())
+			Expect(decision).To(Equal(proxyv1beta1.DecisionWorkloadLabel))
+		})
+
+		It("skips the workloads opting out", func() {
+			inject, decision := decide(proxyv1beta1.ProxyConfigSpec{}, map[string]string{PROXY_INJECTION_LABEL: "false"}, true)
+			Expect(inject).To(BeFalse())
+			Expect(decision).To(Equal(proxyv1beta1.DecisionWorkloadOptOut))
+		})
+
+		It("still only injects the listed kinds", func() {
+			inject, decision := decide(proxyv1beta1.ProxyConfigSpec{Kinds: []string{"StatefulSet"}}, frontend, true)
+			Expect(inject).To(BeFalse())
+			Expect(decision).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Listing the selected workloads from the cache", func() {
+	ctx := context.Background()
+
+	newWatchingReconciler := func(objs ...client.Object) *ProxyConfigReconciler {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).
+			WithIndex(&appsv1.Deployment{}, PROXY_INJECTION_INDEX, indexProxyInjectionLabel).Build()
+		return &ProxyConfigReconciler{Client: c, APIReader: c, Scheme: scheme.Scheme, watchedKinds: map[string]bool{"Deployment": true}}
+	}
+
+	It("uses the injection label index without a workloadSelector", func() {
+		unlabeled := newTestDeployment("unlabeled")
+		unlabeled.Labels = nil
+		r := newWatchingReconciler(newTestDeployment("labeled"), unlabeled)
+
+		workloads, err := r.listSelectedWorkloads(ctx, DeploymentAdapter, "default", legacyWorkloadSelector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(workloads).To(HaveLen(1))
+		Expect(workloads[0].GetName()).To(Equal("labeled"))
+	})
+
+	It("matches any other selector against the labels", func() {
+		unlabeled := newTestDeployment("unlabeled")
+		unlabeled.Labels = nil
+		r := newWatchingReconciler(newTestDeployment("labeled"), unlabeled)
+
+		workloads, err := r.listSelectedWorkloads(ctx, DeploymentAdapter, "default", labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(workloads).To(HaveLen(2))
+	})
+})
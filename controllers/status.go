@@ -0,0 +1,307 @@
+package controllers
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// REASON_RESOLVED is the condition reason used when the proxy source was read successfully
+	REASON_RESOLVED = "Resolved"
+
+	// REASON_CLUSTER_PROXY_NOT_FOUND is the condition reason used when the OpenShift cluster Proxy could not be read
+	REASON_CLUSTER_PROXY_NOT_FOUND = "ClusterProxyNotFound"
+
+	// REASON_INHERIT_FAILED is the condition reason used when the inherited proxy configuration could not be read
+	REASON_INHERIT_FAILED = "InheritFailed"
+
+	// REASON_CA_BUNDLE_NOT_FOUND is the condition reason used when the CA certificate of the custom proxy source could not be read
+	REASON_CA_BUNDLE_NOT_FOUND = "CABundleNotFound"
+
+	// REASON_INJECTED is the condition reason used when all targeted workloads were injected
+	REASON_INJECTED = "Injected"
+
+	// REASON_INJECTION_FAILED is the condition reason used when one or more workloads could not be injected
+	REASON_INJECTION_FAILED = "InjectionFailed"
+
+	// REASON_LIST_FAILED is the condition reason used when the workloads could not be listed
+	REASON_LIST_FAILED = "ListFailed"
+
+	// REASON_DISTRIBUTION_FAILED is the condition reason used when the proxy Secret or CA certificate ConfigMap of a
+	// ClusterProxyConfig could not be created in one or more namespaces
+	REASON_DISTRIBUTION_FAILED = "DistributionFailed"
+
+	// REASON_NOT_REQUESTED is the condition reason used when CA certificate injection was not requested
+	REASON_NOT_REQUESTED = "NotRequested"
+
+	// REASON_OVERRIDDEN is the condition reason used when targeted workloads are injected by a proxy configuration taking precedence
+	REASON_OVERRIDDEN = "Overridden"
+
+	// REASON_SUSPENDED is the condition reason used when changes are held back by spec.suspend
+	REASON_SUSPENDED = "Suspended"
+
+	// REASON_ENV_CONFLICT is the condition reason used when injected containers set proxy environmental variables themselves
+	REASON_ENV_CONFLICT = "EnvConflict"
+
+	// REASON_AS_EXPECTED is the condition reason used when nothing is wrong
+	REASON_AS_EXPECTED = "AsExpected"
+
+	// REDACTED_USERINFO replaces any credentials found in a proxy URL reported in the status
+	REDACTED_USERINFO = "redacted"
+)
+
+// workloadInventory collects the per-kind injection results of a reconciliation, in a single namespace
+type workloadInventory struct {
+	kinds    []string
+	byKind   map[string]*proxyv1beta1.WorkloadKindStatus
+	injected int32
+	// pending counts the workloads whose changes are held back while suspended
+	pending int
+	// conflicts describes the targeted workloads injected by another proxy configuration taking precedence
+	conflicts []string
+	// envConflicts counts the proxy environmental variables the injected containers set themselves
+	envConflicts int
+}
+
+func newWorkloadInventory() *workloadInventory {
+	return &workloadInventory{byKind: map[string]*proxyv1beta1.WorkloadKindStatus{}}
+}
+
+func (i *workloadInventory) kind(kind string) *proxyv1beta1.WorkloadKindStatus {
+	if k, ok := i.byKind[kind]; ok {
+		return k
+	}
+	k := &proxyv1beta1.WorkloadKindStatus{Kind: kind}
+	i.byKind[kind] = k
+	i.kinds = append(i.kinds, kind)
+	return k
+}
+
+// recordInjected records a workload that was injected
+func (i *workloadInventory) recordInjected(kind string, name string) {
+	k := i.kind(kind)
+	if len(k.Injected) < STATUS_MAX_LISTED_WORKLOADS {
+		k.Injected = append(k.Injected, name)
+	}
+	k.InjectedCount++
+	i.injected++
+}
+
+// recordPending records a workload whose changes are held back while suspended
+func (i *workloadInventory) recordPending(kind string, name string) {
+	k := i.kind(kind)
+	if len(k.Pending) < STATUS_MAX_LISTED_WORKLOADS {
+		k.Pending = append(k.Pending, name)
+	}
+	k.PendingCount++
+	i.pending++
+}
+
+// recordDecision records whether a targeted workload is injected, and why
+func (i *workloadInventory) recordDecision(kind string, name string, inject bool, reason string) {
+	k := i.kind(kind)
+	if len(k.Decisions) < STATUS_MAX_LISTED_WORKLOADS {
+		k.Decisions = append(k.Decisions, proxyv1beta1.WorkloadDecision{Name: name, Inject: inject, Reason: reason})
+	}
+	k.DecisionCount++
+}
+
+// recordConflict records a targeted workload that is injected by another proxy configuration taking precedence
+func (i *workloadInventory) recordConflict(kind string, workload client.Object, winner configOwner) {
+	i.recordDecision(kind, workload.GetName(), false, proxyv1beta1.DecisionOverridden)
+	i.conflicts = append(i.conflicts, kind+" "+workload.GetNamespace()+"/"+workload.GetName()+" is injected by "+winner.String())
+}
+
+// recordEnvConflicts records the proxy environmental variables the containers of an injected workload set themselves
+func (i *workloadInventory) recordEnvConflicts(kind string, conflicts []proxyv1beta1.EnvConflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	k := i.kind(kind)
+	for _, conflict := range conflicts {
+		if len(k.EnvConflicts) == STATUS_MAX_LISTED_WORKLOADS {
+			break
+		}
+		k.EnvConflicts = append(k.EnvConflicts, conflict)
+	}
+	k.EnvConflictCount += int32(len(conflicts))
+	i.envConflicts += len(conflicts)
+}
+
+// recordFailure records a workload that could not be injected
+func (i *workloadInventory) recordFailure(kind string, name string, err error) {
+	k := i.kind(kind)
+	if len(k.Failed) < STATUS_MAX_LISTED_WORKLOADS {
+		k.Failed = append(k.Failed, proxyv1beta1.WorkloadFailure{Name: name, Reason: err.Error()})
+	}
+	k.FailedCount++
+}
+
+// failed returns the number of workloads that could not be injected
+func (i *workloadInventory) failed() int {
+	failed := 0
+	for _, k := range i.byKind {
+		failed += int(k.FailedCount)
+	}
+	return failed
+}
+
+// empty returns whether nothing was recorded
+func (i *workloadInventory) empty() bool {
+	return len(i.kinds) == 0
+}
+
+// statuses returns the inventory in the order the kinds were first seen
+func (i *workloadInventory) statuses() []proxyv1beta1.WorkloadKindStatus {
+	statuses := []proxyv1beta1.WorkloadKindStatus{}
+	for _, kind := range i.kinds {
+		statuses = append(statuses, *i.byKind[kind])
+	}
+	return statuses
+}
+
+// setCondition sets a condition on the ProxyConfig status for the current generation
+func setCondition(proxyConfig *proxyv1beta1.ProxyConfig, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	setStatusCondition(&proxyConfig.Status.Conditions, proxyConfig.Generation, conditionType, status, reason, message)
+}
+
+// setClusterCondition sets a condition on the ClusterProxyConfig status for the current generation
+func setClusterCondition(clusterProxyConfig *proxyv1beta1.ClusterProxyConfig, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	setStatusCondition(&clusterProxyConfig.Status.Conditions, clusterProxyConfig.Generation, conditionType, status, reason, message)
+}
+
+// setStatusCondition sets a condition observed at a generation
+func setStatusCondition(conditions *[]metav1.Condition, generation int64, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setSourceResolvedCondition sets the SourceResolved condition from the result of resolving the proxy source of a resource,
+// eg "ProxyConfig"
+func setSourceResolvedCondition(conditions *[]metav1.Condition, generation int64, resolved resolvedProxyConfig, err error, resource string) {
+	switch {
+	case err != nil && resolved.inheritedFrom != "":
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSourceResolved, metav1.ConditionFalse, REASON_INHERIT_FAILED, "Failed to inherit from "+resolved.inheritedFrom+": "+err.Error())
+	case err != nil:
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSourceResolved, metav1.ConditionFalse, REASON_CLUSTER_PROXY_NOT_FOUND, err.Error())
+	case resolved.inheritedFrom != "":
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSourceResolved, metav1.ConditionTrue, REASON_RESOLVED, "Proxy configuration inherited from "+resolved.inheritedFrom+" and patched by the "+resource+" resource")
+	case resolved.source == "openshift":
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSourceResolved, metav1.ConditionTrue, REASON_RESOLVED, "Proxy configuration read from the OpenShift cluster Proxy")
+	default:
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSourceResolved, metav1.ConditionTrue, REASON_RESOLVED, "Proxy configuration read from the "+resource+" resource")
+	}
+}
+
+// setResultConditions sets the CACertInjected, Degraded and Ready conditions from the results of a reconciliation.
+// The SourceResolved condition has to be set already.
+func setResultConditions(conditions *[]metav1.Condition, generation int64, caErr error, injectCACert bool, injected int32, failed int) {
+	if caErr != nil {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionCACertInjected, metav1.ConditionFalse, REASON_CA_BUNDLE_NOT_FOUND, caErr.Error())
+	} else if injectCACert && failed > 0 {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionCACertInjected, metav1.ConditionFalse, REASON_INJECTION_FAILED, "The CA certificate could not be injected into every workload")
+	} else if injectCACert {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionCACertInjected, metav1.ConditionTrue, REASON_INJECTED, "The CA certificate was injected into the targeted workloads")
+	} else {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionCACertInjected, metav1.ConditionFalse, REASON_NOT_REQUESTED, "CA certificate injection is not enabled or no CA source was resolved")
+	}
+
+	if failed > 0 {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionDegraded, metav1.ConditionTrue, REASON_INJECTION_FAILED, strconv.Itoa(failed)+" workload(s) could not be injected")
+	} else {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionDegraded, metav1.ConditionFalse, REASON_AS_EXPECTED, "All targeted workloads were injected")
+	}
+
+	if meta.IsStatusConditionTrue(*conditions, proxyv1beta1.ConditionSourceResolved) && !meta.IsStatusConditionTrue(*conditions, proxyv1beta1.ConditionDegraded) {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionReady, metav1.ConditionTrue, REASON_INJECTED, strconv.Itoa(int(injected))+" workload(s) injected")
+	} else {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionReady, metav1.ConditionFalse, REASON_INJECTION_FAILED, "The proxy configuration could not be resolved or applied to every workload")
+	}
+}
+
+// setSuspendedCondition sets the Suspended condition, and holds back the Ready condition while changes to workloads are pending
+func setSuspendedCondition(conditions *[]metav1.Condition, generation int64, suspended bool, pending int) {
+	if !suspended {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionSuspended, metav1.ConditionFalse, REASON_AS_EXPECTED, "Changes are applied to the workloads")
+		return
+	}
+	setStatusCondition(conditions, generation, proxyv1beta1.ConditionSuspended, metav1.ConditionTrue, REASON_SUSPENDED, "Changes to "+strconv.Itoa(pending)+" workload(s) are held back until spec.suspend is unset")
+	if pending > 0 {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionReady, metav1.ConditionFalse, REASON_SUSPENDED, strconv.Itoa(pending)+" workload(s) have changes held back by spec.suspend")
+	}
+}
+
+// setConflictCondition sets the Conflict condition from the targeted workloads injected by another proxy configuration
+func setConflictCondition(conditions *[]metav1.Condition, generation int64, conflicts []string) {
+	if len(conflicts) == 0 {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionConflict, metav1.ConditionFalse, REASON_AS_EXPECTED, "No targeted workload is injected by another proxy configuration")
+		return
+	}
+	listed := strings.Join(conflicts, ", ")
+	if len(conflicts) > CONDITION_MAX_LISTED_CONFLICTS {
+		listed = strings.Join(conflicts[:CONDITION_MAX_LISTED_CONFLICTS], ", ") + " and " + strconv.Itoa(len(conflicts)-CONDITION_MAX_LISTED_CONFLICTS) + " more"
+	}
+	setStatusCondition(conditions, generation, proxyv1beta1.ConditionConflict, metav1.ConditionTrue, REASON_OVERRIDDEN, strconv.Itoa(len(conflicts))+" targeted workload(s) are injected by a proxy configuration taking precedence: "+listed)
+}
+
+// setEnvConflictCondition sets the EnvConflict condition from the number of proxy environmental variables the injected containers set themselves
+func setEnvConflictCondition(conditions *[]metav1.Condition, generation int64, policy proxyv1beta1.ConflictPolicy, envConflicts int) {
+	if envConflicts == 0 {
+		setStatusCondition(conditions, generation, proxyv1beta1.ConditionEnvConflict, metav1.ConditionFalse, REASON_AS_EXPECTED, "No injected container sets the proxy environmental variables itself")
+		return
+	}
+	policy = proxyv1beta1.ConflictPolicy(SetDefaultString(string(proxyv1beta1.ConflictPolicyOverwrite), string(policy)))
+	setStatusCondition(conditions, generation, proxyv1beta1.ConditionEnvConflict, metav1.ConditionTrue, REASON_ENV_CONFLICT, strconv.Itoa(envConflicts)+" proxy environmental variable(s) set by the injected containers themselves, resolved with the "+string(policy)+" conflict policy")
+}
+
+// redactProxyURL removes any credentials from a proxy URL so it can be reported in the status or logged.
+// URLs that can't be parsed have everything up to the last @ replaced, since the credentials may be what breaks them.
+func redactProxyURL(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		if i := strings.LastIndex(proxyURL, "@"); i >= 0 {
+			scheme, _, found := strings.Cut(proxyURL[:i], "://")
+			if !found {
+				return REDACTED_USERINFO + proxyURL[i:]
+			}
+			return scheme + "://" + REDACTED_USERINFO + proxyURL[i:]
+		}
+		return proxyURL
+	}
+	if u.User == nil {
+		return proxyURL
+	}
+	u.User = url.User(REDACTED_USERINFO)
+	return u.String()
+}
+
+// effectiveProxy returns the resolved proxy configuration with any credentials redacted
+func effectiveProxy(proxyObj proxyv1beta1.Proxy) proxyv1beta1.EffectiveProxy {
+	return proxyv1beta1.EffectiveProxy{
+		HTTPProxy:  redactProxyURL(proxyObj.HTTPProxy),
+		HTTPSProxy: redactProxyURL(proxyObj.HTTPSProxy),
+		NoProxy:    proxyObj.NoProxy,
+	}
+}
+
+// updateStatus writes the status subresource of the ProxyConfig
+func (r *ProxyConfigReconciler) updateStatus(ctx context.Context, proxyConfig *proxyv1beta1.ProxyConfig) error {
+	proxyConfig.Status.ObservedGeneration = proxyConfig.Generation
+	if err := r.Status().Update(ctx, proxyConfig); err != nil {
+		lggr.Error(err, "Failed to update proxyConfig status", "ProxyConfig.Namespace", proxyConfig.Namespace, "ProxyConfig.Name", proxyConfig.Name)
+		return err
+	}
+	return nil
+}
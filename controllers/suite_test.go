@@ -31,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	proxyv1alpha1 "github.com/kenmoini/proxy-config-operator/api/v1alpha1"
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -64,6 +65,8 @@ var _ = BeforeSuite(func() {
 
 	err = proxyv1alpha1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
+	err = proxyv1beta1.AddToScheme(scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
 
 	//+kubebuilder:scaffold:scheme
 
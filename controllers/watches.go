@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
+	configv1 "github.com/openshift/api/config/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// proxyConfigRequests returns a reconcile request for every ProxyConfig in the namespace,
+// or in every namespace when namespace is empty.
+// When openshiftOnly is set, only ProxyConfigs depending on the OpenShift cluster Proxy are returned.
+func (r *ProxyConfigReconciler) proxyConfigRequests(ctx context.Context, namespace string, openshiftOnly bool) []reconcile.Request {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	listOpts := []client.ListOption{}
+	if namespace != "" {
+		listOpts = append(listOpts, client.InNamespace(namespace))
+	}
+	if err := r.List(ctx, proxyConfigList, listOpts...); err != nil {
+		lggr.Error(err, "Failed to list ProxyConfigs", "Namespace", namespace)
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, proxyConfig := range proxyConfigList.Items {
+		if openshiftOnly && !usesClusterProxy(proxyConfig.Spec) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: proxyConfig.Name, Namespace: proxyConfig.Namespace}})
+	}
+	return requests
+}
+
+// mapWorkloadToProxyConfigs enqueues the ProxyConfigs in the namespace of a workload whose workloadSelector matches it,
+// or all of them when the namespace opted in, and the ProxyConfig that injected it, which may no longer select it
+func (r *ProxyConfigReconciler) mapWorkloadToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if optedIn, err := r.isNamespaceOptedIn(ctx, obj.GetNamespace()); err == nil && optedIn {
+		return r.proxyConfigRequests(ctx, obj.GetNamespace(), false)
+	}
+
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList, client.InNamespace(obj.GetNamespace())); err != nil {
+		lggr.Error(err, "Failed to list ProxyConfigs", "Namespace", obj.GetNamespace())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, proxyConfig := range proxyConfigList.Items {
+		// The kinds are checked by the reconciler, the watched object doesn't always carry its kind
+		selector, err := workloadSelector(proxyConfig.Spec)
+		if err != nil || !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: proxyConfig.Name, Namespace: proxyConfig.Namespace}})
+	}
+	if record, err := readInjectionRecord(obj); err == nil && record != nil && record.ProxyConfig != "" {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: record.ProxyConfig, Namespace: obj.GetNamespace()}})
+	}
+	return requests
+}
+
+// mapNamespaceToProxyConfigs enqueues the ProxyConfigs in a namespace, whose labels or annotations may have opted it in or out
+func (r *ProxyConfigReconciler) mapNamespaceToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.proxyConfigRequests(ctx, obj.GetName(), false)
+}
+
+// mapClusterProxyToProxyConfigs enqueues every ProxyConfig using the OpenShift cluster Proxy as its source
+func (r *ProxyConfigReconciler) mapClusterProxyToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetName() != OpenShiftProxy().Name {
+		return nil
+	}
+	return r.proxyConfigRequests(ctx, "", true)
+}
+
+// mapClusterProxyConfigToProxyConfigs enqueues the ProxyConfigs inheriting from a ClusterProxyConfig
+func (r *ProxyConfigReconciler) mapClusterProxyConfigToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList, client.MatchingFields{PROXY_CONFIG_INHERIT_INDEX: obj.GetName()}); err != nil {
+		lggr.Error(err, "Failed to list the ProxyConfigs inheriting from ClusterProxyConfig "+obj.GetName())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, proxyConfig := range proxyConfigList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: proxyConfig.Name, Namespace: proxyConfig.Namespace}})
+	}
+	return requests
+}
+
+// usesClusterProxy returns whether a proxy configuration depends on the OpenShift cluster Proxy, either as its source
+// or through the configuration it inherits from
+func usesClusterProxy(spec proxyv1beta1.ProxyConfigSpec) bool {
+	if spec.InheritFrom != nil {
+		return true
+	}
+	return SetDefaultString(DEFAULT_PROXY_SOURCE, spec.ProxySource) == "openshift"
+}
+
+// mapConfigMapToProxyConfigs enqueues the ProxyConfigs affected by a change to a CA ConfigMap.
+// This is either a ConfigMap the Cluster Network Operator injects the trusted CA bundle into,
+// the ConfigMap referenced by the trustedCA of the OpenShift cluster Proxy, or the ConfigMap
+// the CA certificate of a custom ProxyConfig is read from.
+func (r *ProxyConfigReconciler) mapConfigMapToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetLabels()[TRUSTED_CA_BUNDLE_LABEL] == "true" {
+		return r.proxyConfigRequests(ctx, obj.GetNamespace(), false)
+	}
+
+	if obj.GetNamespace() == OPENSHIFT_CONFIG_NAMESPACE {
+		clusterProxyConfig := &configv1.Proxy{}
+		if err := r.Get(ctx, OpenShiftProxy(), clusterProxyConfig); err == nil && clusterProxyConfig.Spec.TrustedCA.Name == obj.GetName() {
+			return r.proxyConfigRequests(ctx, "", true)
+		}
+	}
+
+	return r.indexedProxyConfigRequests(ctx, obj, PROXY_CONFIG_CA_CONFIGMAP_INDEX)
+}
+
+// mapSecretToProxyConfigs enqueues the custom ProxyConfigs reading their CA certificate from a Secret
+func (r *ProxyConfigReconciler) mapSecretToProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.indexedProxyConfigRequests(ctx, obj, PROXY_CONFIG_CA_SECRET_INDEX)
+}
+
+// indexedProxyConfigRequests returns a reconcile request for every ProxyConfig in the namespace of obj referencing it through an index
+func (r *ProxyConfigReconciler) indexedProxyConfigRequests(ctx context.Context, obj client.Object, index string) []reconcile.Request {
+	proxyConfigList := &proxyv1beta1.ProxyConfigList{}
+	if err := r.List(ctx, proxyConfigList, client.InNamespace(obj.GetNamespace()), client.MatchingFields{index: obj.GetName()}); err != nil {
+		lggr.Error(err, "Failed to list ProxyConfigs", "Namespace", obj.GetNamespace())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, proxyConfig := range proxyConfigList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: proxyConfig.Name, Namespace: proxyConfig.Namespace}})
+	}
+	return requests
+}
+
+// clusterProxyConfigRequests returns a reconcile request for every ClusterProxyConfig.
+// When openshiftOnly is set, only ClusterProxyConfigs depending on the OpenShift cluster Proxy are returned.
+func (r *ClusterProxyConfigReconciler) clusterProxyConfigRequests(ctx context.Context, openshiftOnly bool) []reconcile.Request {
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList); err != nil {
+		lggr.Error(err, "Failed to list ClusterProxyConfigs")
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, clusterProxyConfig := range clusterProxyConfigList.Items {
+		if openshiftOnly && !usesClusterProxy(clusterProxyConfig.Spec.ProxyConfigSpec) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterProxyConfig.Name}})
+	}
+	return requests
+}
+
+// mapToClusterProxyConfigs enqueues every ClusterProxyConfig, eg when a namespace may have been selected or opted in,
+// or a ProxyConfig may have taken over or released workloads
+func (r *ClusterProxyConfigReconciler) mapToClusterProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.clusterProxyConfigRequests(ctx, false)
+}
+
+// mapWorkloadToClusterProxyConfigs enqueues the ClusterProxyConfigs whose workloadSelector matches a workload,
+// or all of them when its namespace opted in, and the ClusterProxyConfig that injected it, which may no longer select it
+func (r *ClusterProxyConfigReconciler) mapWorkloadToClusterProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if optedIn, err := r.isNamespaceOptedIn(ctx, obj.GetNamespace()); err == nil && optedIn {
+		return r.clusterProxyConfigRequests(ctx, false)
+	}
+
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList); err != nil {
+		lggr.Error(err, "Failed to list ClusterProxyConfigs")
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, clusterProxyConfig := range clusterProxyConfigList.Items {
+		// The namespaceSelector and kinds are checked by the reconciler
+		selector, err := workloadSelector(clusterProxyConfig.Spec.ProxyConfigSpec)
+		if err != nil || !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterProxyConfig.Name}})
+	}
+	if record, err := readInjectionRecord(obj); err == nil && record != nil && record.ClusterProxyConfig != "" {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: record.ClusterProxyConfig}})
+	}
+	return requests
+}
+
+// mapClusterProxyToClusterProxyConfigs enqueues every ClusterProxyConfig using the OpenShift cluster Proxy as its source
+func (r *ClusterProxyConfigReconciler) mapClusterProxyToClusterProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetName() != OpenShiftProxy().Name {
+		return nil
+	}
+	return r.clusterProxyConfigRequests(ctx, true)
+}
+
+// mapConfigMapToClusterProxyConfigs enqueues the ClusterProxyConfigs affected by a change to a CA ConfigMap,
+// the same ConfigMaps mapConfigMapToProxyConfigs looks for
+func (r *ClusterProxyConfigReconciler) mapConfigMapToClusterProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetLabels()[TRUSTED_CA_BUNDLE_LABEL] == "true" {
+		return r.clusterProxyConfigRequests(ctx, true)
+	}
+
+	if obj.GetNamespace() == OPENSHIFT_CONFIG_NAMESPACE {
+		clusterProxyConfig := &configv1.Proxy{}
+		if err := r.Get(ctx, OpenShiftProxy(), clusterProxyConfig); err == nil && clusterProxyConfig.Spec.TrustedCA.Name == obj.GetName() {
+			return r.clusterProxyConfigRequests(ctx, true)
+		}
+	}
+
+	return r.indexedClusterProxyConfigRequests(ctx, obj, PROXY_CONFIG_CA_CONFIGMAP_INDEX)
+}
+
+// mapSecretToClusterProxyConfigs enqueues the custom ClusterProxyConfigs reading their CA certificate from a Secret
+func (r *ClusterProxyConfigReconciler) mapSecretToClusterProxyConfigs(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.indexedClusterProxyConfigRequests(ctx, obj, PROXY_CONFIG_CA_SECRET_INDEX)
+}
+
+// indexedClusterProxyConfigRequests returns a reconcile request for every ClusterProxyConfig referencing obj through an index
+func (r *ClusterProxyConfigReconciler) indexedClusterProxyConfigRequests(ctx context.Context, obj client.Object, index string) []reconcile.Request {
+	clusterProxyConfigList := &proxyv1beta1.ClusterProxyConfigList{}
+	if err := r.List(ctx, clusterProxyConfigList, client.MatchingFields{index: obj.GetNamespace() + "/" + obj.GetName()}); err != nil {
+		lggr.Error(err, "Failed to list ClusterProxyConfigs")
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, clusterProxyConfig := range clusterProxyConfigList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterProxyConfig.Name}})
+	}
+	return requests
+}
+
+// isKindAvailable checks whether the API server serves a kind, eg OpenShift specific kinds on other distributions
+func isKindAvailable(mgr ctrl.Manager, gvk schema.GroupVersionKind) bool {
+	_, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	return err == nil
+}
+
+// workloadRBACRule describes the RBAC rule the manager role needs to inject into a workload kind
+func workloadRBACRule(mgr ctrl.Manager, gvk schema.GroupVersionKind) string {
+	resource := strings.ToLower(gvk.Kind) + "s"
+	if mapping, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err == nil {
+		resource = mapping.Resource.Resource
+	}
+	return "apiGroups=" + gvk.Group + " resources=" + resource + " verbs=get;list;watch;update;patch"
+}
@@ -0,0 +1,414 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The certificates are only provisioned for the objects of the operator, named as config/default prefixes them.
+// When the names are changed through the manager flags, change the resourceNames below accordingly.
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;update;patch,resourceNames=proxy-config-operator-mutating-webhook-configuration
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;update;patch,resourceNames=proxy-config-operator-validating-webhook-configuration
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;update;patch,resourceNames=proxyconfigs.proxy.k8s.kemo.dev
+
+const (
+	// WEBHOOK_CA_VALIDITY is how long the self-signed webhook CA is valid for
+	WEBHOOK_CA_VALIDITY = 10 * 365 * 24 * time.Hour
+
+	// WEBHOOK_CERT_VALIDITY is how long the webhook serving certificate is valid for
+	WEBHOOK_CERT_VALIDITY = 365 * 24 * time.Hour
+
+	// WEBHOOK_CA_ROTATE_BEFORE is how long before its expiry the webhook CA is rotated
+	WEBHOOK_CA_ROTATE_BEFORE = 365 * 24 * time.Hour
+
+	// WEBHOOK_CERT_ROTATE_BEFORE is how long before its expiry the webhook serving certificate is rotated
+	WEBHOOK_CERT_ROTATE_BEFORE = 30 * 24 * time.Hour
+
+	// WEBHOOK_CERT_CHECK_INTERVAL is how often the webhook certificates are checked for rotation
+	WEBHOOK_CERT_CHECK_INTERVAL = time.Hour
+
+	// WEBHOOK_CA_CERT_KEY is the key of the CA certificate in the webhook certificate Secret
+	WEBHOOK_CA_CERT_KEY = "ca.crt"
+
+	// WEBHOOK_CA_KEY_KEY is the key of the CA private key in the webhook certificate Secret
+	WEBHOOK_CA_KEY_KEY = "ca.key"
+
+	// WEBHOOK_PREVIOUS_CA_CERT_KEY is the key of the rotated CA certificate in the webhook certificate Secret,
+	// kept in the caBundles until it expires so clients trust both the old and new serving certificates
+	WEBHOOK_PREVIOUS_CA_CERT_KEY = "previous-ca.crt"
+)
+
+// WebhookCertProvisioner provides the webhook server with a serving certificate without cert-manager.
+// It generates a self-signed CA and serving certificate, stores them in a Secret shared by the manager replicas,
+// writes them to the certificate directory of the webhook server, and sets the caBundle of the webhook
+// configurations and conversion webhooks. While the manager runs, the certificates are rotated before they expire.
+type WebhookCertProvisioner struct {
+	// Client writes the Secret, webhook configurations and CustomResourceDefinitions
+	Client client.Client
+
+	// Reader reads them directly from the API server, the certificates are provisioned before the cache starts
+	Reader client.Reader
+
+	// Namespace is the namespace of the manager, holding the Secret and webhook Service
+	Namespace string
+
+	// SecretName is the name of the Secret the certificates are stored in
+	SecretName string
+
+	// ServiceName is the name of the Service in front of the webhook server
+	ServiceName string
+
+	// CertDir is the directory the webhook server reads tls.crt and tls.key from
+	CertDir string
+
+	// MutatingWebhookConfigurations are the names of the MutatingWebhookConfigurations to set the caBundle of
+	MutatingWebhookConfigurations []string
+
+	// ValidatingWebhookConfigurations are the names of the ValidatingWebhookConfigurations to set the caBundle of
+	ValidatingWebhookConfigurations []string
+
+	// CustomResourceDefinitions are the names of the CRDs to set the caBundle of the conversion webhook of
+	CustomResourceDefinitions []string
+
+	// MutatingFailurePolicy is set on the webhooks of the MutatingWebhookConfigurations when not empty
+	MutatingFailurePolicy admissionregistrationv1.FailurePolicyType
+}
+
+// Start checks the certificates periodically until the context is done, rotating them before they expire
+func (p *WebhookCertProvisioner) Start(ctx context.Context) error {
+	ticker := time.NewTicker(WEBHOOK_CERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := p.Provision(ctx); err != nil {
+				lggr.Error(err, "Failed to rotate the webhook certificates")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false, every manager replica serves webhooks and needs the certificates
+func (p *WebhookCertProvisioner) NeedLeaderElection() bool {
+	return false
+}
+
+// Provision makes sure valid certificates are stored, written to the certificate directory and set in the caBundles
+func (p *WebhookCertProvisioner) Provision(ctx context.Context) error {
+	var secret *corev1.Secret
+	// Another replica may be rotating the certificates at the same time, use what it stored
+	err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		secret, err = p.ensureSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = p.writeCertFiles(secret); err != nil {
+		return err
+	}
+
+	caBundle := append([]byte{}, secret.Data[WEBHOOK_CA_CERT_KEY]...)
+	caBundle = append(caBundle, secret.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY]...)
+	return p.injectCABundle(ctx, caBundle)
+}
+
+// ensureSecret returns the certificate Secret, generating or rotating the certificates it holds when needed
+func (p *WebhookCertProvisioner) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := p.Reader.Get(ctx, types.NamespacedName{Name: p.SecretName, Namespace: p.Namespace}, secret)
+	exists := err == nil
+	if errors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      p.SecretName,
+				Namespace: p.Namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	rotated := false
+	caRotated := false
+	now := time.Now()
+
+	// Check to see if the CA needs to be generated or rotated
+	caCert, caKey, err := parseKeyPair(secret.Data[WEBHOOK_CA_CERT_KEY], secret.Data[WEBHOOK_CA_KEY_KEY])
+	if err != nil || now.Add(WEBHOOK_CA_ROTATE_BEFORE).After(caCert.NotAfter) {
+		if caCert != nil && now.Before(caCert.NotAfter) {
+			secret.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY] = secret.Data[WEBHOOK_CA_CERT_KEY]
+		}
+		caCertPEM, caKeyPEM, err := generateCA(now)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[WEBHOOK_CA_CERT_KEY] = caCertPEM
+		secret.Data[WEBHOOK_CA_KEY_KEY] = caKeyPEM
+		if caCert, caKey, err = parseKeyPair(caCertPEM, caKeyPEM); err != nil {
+			return nil, err
+		}
+		rotated = true
+		caRotated = true
+		lggr.Info("Generated a new webhook CA", "Secret.Namespace", p.Namespace, "Secret.Name", p.SecretName)
+	}
+
+	// Drop the previous CA once it expired
+	if previous, err := parseCert(secret.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY]); err != nil || now.After(previous.NotAfter) {
+		if _, ok := secret.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY]; ok {
+			delete(secret.Data, WEBHOOK_PREVIOUS_CA_CERT_KEY)
+			rotated = true
+		}
+	}
+
+	// Check to see if the serving certificate needs to be generated or rotated
+	cert, _, err := parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if caRotated || err != nil || now.Add(WEBHOOK_CERT_ROTATE_BEFORE).After(cert.NotAfter) || cert.CheckSignatureFrom(caCert) != nil || cert.VerifyHostname(p.dnsNames()[0]) != nil {
+		certPEM, keyPEM, err := generateServingCert(now, caCert, caKey, p.dnsNames())
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[corev1.TLSCertKey] = certPEM
+		secret.Data[corev1.TLSPrivateKeyKey] = keyPEM
+		rotated = true
+		lggr.Info("Generated a new webhook serving certificate", "Secret.Namespace", p.Namespace, "Secret.Name", p.SecretName)
+	}
+
+	if !rotated {
+		return secret, nil
+	}
+	if exists {
+		err = p.Client.Update(ctx, secret)
+	} else {
+		err = p.Client.Create(ctx, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// dnsNames returns the DNS names the webhook Service is reached at
+func (p *WebhookCertProvisioner) dnsNames() []string {
+	return []string{
+		p.ServiceName + "." + p.Namespace + ".svc",
+		p.ServiceName + "." + p.Namespace + ".svc.cluster.local",
+		p.ServiceName + "." + p.Namespace,
+		p.ServiceName,
+	}
+}
+
+// writeCertFiles writes the serving certificate to the certificate directory, the webhook server reloads it on changes
+func (p *WebhookCertProvisioner) writeCertFiles(secret *corev1.Secret) error {
+	if err := os.MkdirAll(p.CertDir, 0o700); err != nil {
+		return err
+	}
+	for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+		path := filepath.Join(p.CertDir, key)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, secret.Data[key]) {
+			continue
+		}
+		// Write to a temporary file first so the webhook server never reads a partial file
+		if err := os.WriteFile(path+".tmp", secret.Data[key], 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// injectCABundle sets the caBundle of the webhook configurations and conversion webhooks
+func (p *WebhookCertProvisioner) injectCABundle(ctx context.Context, caBundle []byte) error {
+	for _, name := range p.MutatingWebhookConfigurations {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			if err := p.Reader.Get(ctx, types.NamespacedName{Name: name}, config); err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			changed := false
+			for i := range config.Webhooks {
+				webhook := &config.Webhooks[i]
+				if !bytes.Equal(webhook.ClientConfig.CABundle, caBundle) {
+					webhook.ClientConfig.CABundle = caBundle
+					changed = true
+				}
+				if p.MutatingFailurePolicy != "" && (webhook.FailurePolicy == nil || *webhook.FailurePolicy != p.MutatingFailurePolicy) {
+					failurePolicy := p.MutatingFailurePolicy
+					webhook.FailurePolicy = &failurePolicy
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+			lggr.Info("Updating MutatingWebhookConfiguration", "MutatingWebhookConfiguration.Name", name)
+			return p.Client.Update(ctx, config)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range p.ValidatingWebhookConfigurations {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+			if err := p.Reader.Get(ctx, types.NamespacedName{Name: name}, config); err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			changed := false
+			for i := range config.Webhooks {
+				if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+					config.Webhooks[i].ClientConfig.CABundle = caBundle
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+			lggr.Info("Updating ValidatingWebhookConfiguration", "ValidatingWebhookConfiguration.Name", name)
+			return p.Client.Update(ctx, config)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// CustomResourceDefinitions are handled unstructured, the apiextensions types aren't part of the scheme
+	encoded := base64.StdEncoding.EncodeToString(caBundle)
+	for _, name := range p.CustomResourceDefinitions {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			crd := &unstructured.Unstructured{}
+			crd.SetGroupVersionKind(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"})
+			if err := p.Reader.Get(ctx, types.NamespacedName{Name: name}, crd); err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			if strategy, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy"); strategy != "Webhook" {
+				return nil
+			}
+			if current, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle"); current == encoded {
+				return nil
+			}
+			if err := unstructured.SetNestedField(crd.Object, encoded, "spec", "conversion", "webhook", "clientConfig", "caBundle"); err != nil {
+				return err
+			}
+			lggr.Info("Updating the conversion webhook of CustomResourceDefinition", "CustomResourceDefinition.Name", name)
+			return p.Client.Update(ctx, crd)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateCA generates a self-signed CA certificate and private key, PEM encoded
+func generateCA(now time.Time) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "proxy-config-operator-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(WEBHOOK_CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return generateCert(template, nil, nil)
+}
+
+// generateServingCert generates a serving certificate and private key signed by the CA, PEM encoded
+func generateServingCert(now time.Time, caCert *x509.Certificate, caKey *rsa.PrivateKey, dnsNames []string) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(WEBHOOK_CERT_VALIDITY),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return generateCert(template, caCert, caKey)
+}
+
+// generateCert generates a private key and a certificate from the template, self-signed when no parent is given
+func generateCert(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+// parseCert parses a PEM encoded certificate
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseKeyPair parses a PEM encoded certificate and its RSA private key
+func parseKeyPair(certPEM []byte, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return cert, nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return cert, nil, err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return cert, nil, fmt.Errorf("the private key doesn't match the certificate")
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestCertProvisioner returns a WebhookCertProvisioner reading and writing the objects through a fake client
+func newTestCertProvisioner(objs ...client.Object) (*WebhookCertProvisioner, client.Client) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build()
+	return &WebhookCertProvisioner{
+		Client:                          c,
+		Reader:                          c,
+		Namespace:                       "proxy-config-operator-system",
+		SecretName:                      WEBHOOK_CERT_SECRET_NAME,
+		ServiceName:                     WEBHOOK_SERVICE_NAME,
+		CertDir:                         GinkgoT().TempDir(),
+		MutatingWebhookConfigurations:   []string{MUTATING_WEBHOOK_CONFIGURATION_NAME},
+		ValidatingWebhookConfigurations: []string{VALIDATING_WEBHOOK_CONFIGURATION_NAME},
+		CustomResourceDefinitions:       []string{PROXY_CONFIG_CRD_NAME},
+	}, c
+}
+
+// newTestCertSecret returns the certificate Secret holding a CA and a serving certificate issued at the given times
+func newTestCertSecret(p *WebhookCertProvisioner, caIssued time.Time, certIssued time.Time) *corev1.Secret {
+	caCertPEM, caKeyPEM, err := generateCA(caIssued)
+	Expect(err).NotTo(HaveOccurred())
+	caCert, caKey, err := parseKeyPair(caCertPEM, caKeyPEM)
+	Expect(err).NotTo(HaveOccurred())
+	certPEM, keyPEM, err := generateServingCert(certIssued, caCert, caKey, p.dnsNames())
+	Expect(err).NotTo(HaveOccurred())
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: p.SecretName, Namespace: p.Namespace},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			WEBHOOK_CA_CERT_KEY:     caCertPEM,
+			WEBHOOK_CA_KEY_KEY:      caKeyPEM,
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+}
+
+// getCertSecret returns the certificate Secret the provisioner stored
+func getCertSecret(c client.Client, p *WebhookCertProvisioner) *corev1.Secret {
+	secret := &corev1.Secret{}
+	ExpectWithOffset(1, c.Get(context.Background(), types.NamespacedName{Name: p.SecretName, Namespace: p.Namespace}, secret)).To(Succeed())
+	return secret
+}
+
+// newTestConversionCRD returns the ProxyConfig CustomResourceDefinition with a conversion strategy
+func newTestConversionCRD(strategy string) *unstructured.Unstructured {
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]interface{}{"name": PROXY_CONFIG_CRD_NAME},
+		"spec": map[string]interface{}{
+			"conversion": map[string]interface{}{"strategy": strategy},
+		},
+	}}
+	return crd
+}
+
+var _ = Describe("Provisioning the webhook certificates", func() {
+	ctx := context.Background()
+	// Far enough in the past for a certificate issued then to be due for rotation, but still valid
+	dueForRotation := func(validity time.Duration, rotateBefore time.Duration) time.Time {
+		return time.Now().Add(-validity + rotateBefore/2)
+	}
+
+	It("generates a CA and a serving certificate for the webhook Service", func() {
+		p, c := newTestCertProvisioner()
+		Expect(p.Provision(ctx)).To(Succeed())
+
+		secret := getCertSecret(c, p)
+		caCert, _, err := parseKeyPair(secret.Data[WEBHOOK_CA_CERT_KEY], secret.Data[WEBHOOK_CA_KEY_KEY])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caCert.IsCA).To(BeTrue())
+		cert, _, err := parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.CheckSignatureFrom(caCert)).To(Succeed())
+		Expect(cert.DNSNames).To(ContainElement("proxy-config-operator-webhook-service.proxy-config-operator-system.svc"))
+		Expect(cert.ExtKeyUsage).To(ConsistOf(x509.ExtKeyUsageServerAuth))
+
+		Expect(secret.Data).NotTo(HaveKey(WEBHOOK_PREVIOUS_CA_CERT_KEY))
+		Expect(p.CertDir + "/" + corev1.TLSCertKey).To(BeAnExistingFile())
+		Expect(p.CertDir + "/" + corev1.TLSPrivateKeyKey).To(BeAnExistingFile())
+	})
+
+	It("keeps the certificates that aren't due for rotation", func() {
+		p, c := newTestCertProvisioner()
+		Expect(p.Provision(ctx)).To(Succeed())
+		provisioned := getCertSecret(c, p)
+
+		Expect(p.Provision(ctx)).To(Succeed())
+		Expect(getCertSecret(c, p).Data).To(Equal(provisioned.Data))
+	})
+
+	It("rotates the serving certificate before it expires, keeping the CA", func() {
+		p, _ := newTestCertProvisioner()
+		existing := newTestCertSecret(p, time.Now(), dueForRotation(WEBHOOK_CERT_VALIDITY, WEBHOOK_CERT_ROTATE_BEFORE))
+		p, c := newTestCertProvisioner(existing)
+		Expect(p.Provision(ctx)).To(Succeed())
+
+		secret := getCertSecret(c, p)
+		Expect(secret.Data[WEBHOOK_CA_CERT_KEY]).To(Equal(existing.Data[WEBHOOK_CA_CERT_KEY]))
+		Expect(secret.Data[corev1.TLSCertKey]).NotTo(Equal(existing.Data[corev1.TLSCertKey]))
+		Expect(secret.Data).NotTo(HaveKey(WEBHOOK_PREVIOUS_CA_CERT_KEY))
+	})
+
+	It("rotates the CA before it expires, keeping the previous one in the caBundles", func() {
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: MUTATING_WEBHOOK_CONFIGURATION_NAME},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mproxyinjection.kb.io"}},
+		}
+		p, _ := newTestCertProvisioner()
+		existing := newTestCertSecret(p, dueForRotation(WEBHOOK_CA_VALIDITY, WEBHOOK_CA_ROTATE_BEFORE), time.Now())
+		p, c := newTestCertProvisioner(existing, config)
+		Expect(p.Provision(ctx)).To(Succeed())
+
+		secret := getCertSecret(c, p)
+		Expect(secret.Data[WEBHOOK_CA_CERT_KEY]).NotTo(Equal(existing.Data[WEBHOOK_CA_CERT_KEY]))
+		Expect(secret.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY]).To(Equal(existing.Data[WEBHOOK_CA_CERT_KEY]))
+		Expect(secret.Data[corev1.TLSCertKey]).NotTo(Equal(existing.Data[corev1.TLSCertKey]))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(config), config)).To(Succeed())
+		caBundle := string(config.Webhooks[0].ClientConfig.CABundle)
+		Expect(caBundle).To(ContainSubstring(string(secret.Data[WEBHOOK_CA_CERT_KEY])))
+		Expect(caBundle).To(ContainSubstring(string(existing.Data[WEBHOOK_CA_CERT_KEY])))
+	})
+
+	It("drops the previous CA once it expired", func() {
+		p, _ := newTestCertProvisioner()
+		existing := newTestCertSecret(p, time.Now(), time.Now())
+		expired := newTestCertSecret(p, time.Now().Add(-WEBHOOK_CA_VALIDITY-time.Hour), time.Now())
+		existing.Data[WEBHOOK_PREVIOUS_CA_CERT_KEY] = expired.Data[WEBHOOK_CA_CERT_KEY]
+		p, c := newTestCertProvisioner(existing)
+		Expect(p.Provision(ctx)).To(Succeed())
+
+		secret := getCertSecret(c, p)
+		Expect(secret.Data).NotTo(HaveKey(WEBHOOK_PREVIOUS_CA_CERT_KEY))
+		Expect(secret.Data[WEBHOOK_CA_CERT_KEY]).To(Equal(existing.Data[WEBHOOK_CA_CERT_KEY]))
+	})
+
+	It("sets the caBundles and the failure policy of the webhooks", func() {
+		ignore := admissionregistrationv1.Ignore
+		mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: MUTATING_WEBHOOK_CONFIGURATION_NAME},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mproxyinjection.kb.io", FailurePolicy: &ignore}},
+		}
+		validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: VALIDATING_WEBHOOK_CONFIGURATION_NAME},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "vproxyconfig.kb.io"}, {Name: "vclusterproxyconfig.kb.io"}},
+		}
+		other := &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-mutating-webhook-configuration"},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "other.example.com"}},
+		}
+		crd := newTestConversionCRD("Webhook")
+		p, c := newTestCertProvisioner(mutating, validating, other, crd)
+		p.MutatingFailurePolicy = admissionregistrationv1.Fail
+		Expect(p.Provision(ctx)).To(Succeed())
+		caBundle := getCertSecret(c, p).Data[WEBHOOK_CA_CERT_KEY]
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(mutating), mutating)).To(Succeed())
+		Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(caBundle))
+		Expect(*mutating.Webhooks[0].FailurePolicy).To(Equal(admissionregistrationv1.Fail))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(validating), validating)).To(Succeed())
+		for _, webhook := range validating.Webhooks {
+			Expect(webhook.ClientConfig.CABundle).To(Equal(caBundle))
+		}
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(other), other)).To(Succeed())
+		Expect(other.Webhooks[0].ClientConfig.CABundle).To(BeEmpty())
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(crd), crd)).To(Succeed())
+		encoded, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+		Expect(encoded).To(Equal(base64.StdEncoding.EncodeToString(caBundle)))
+	})
+
+	It("leaves the CustomResourceDefinitions without a conversion webhook alone", func() {
+		crd := newTestConversionCRD("None")
+		p, c := newTestCertProvisioner(crd)
+		Expect(p.Provision(ctx)).To(Succeed())
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(crd), crd)).To(Succeed())
+		_, found, _ := unstructured.NestedFieldNoCopy(crd.Object, "spec", "conversion", "webhook")
+		Expect(found).To(BeFalse())
+	})
+})
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	ocpappsv1 "github.com/openshift/api/apps/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WorkloadAdapter gives the reconciler uniform access to the pod templates embedded in a workload kind
+type WorkloadAdapter interface {
+	// Kind returns the name of the workload kind, eg "Deployment"
+	Kind() string
+
+	// NewObject returns an empty object of the workload kind, used to set up watches and indexes
+	NewObject() client.Object
+
+	// List returns the workloads of this kind matching the list options
+	List(ctx context.Context, c client.Reader, opts ...client.ListOption) ([]client.Object, error)
+
+	// GetPodTemplates returns the pod templates embedded in a workload
+	GetPodTemplates(obj client.Object) ([]*corev1.PodTemplateSpec, error)
+
+	// SetPodTemplates writes the pod templates back into a workload, in the order GetPodTemplates returned them
+	SetPodTemplates(obj client.Object, templates []*corev1.PodTemplateSpec) error
+
+	// PodTemplatePaths returns the field paths of the pod templates in a workload, eg "spec.template"
+	PodTemplatePaths() []string
+}
+
+// WorkloadRegistry holds the workload kinds the operator injects into
+type WorkloadRegistry struct {
+	adapters []WorkloadAdapter
+}
+
+// NewWorkloadRegistry returns an empty WorkloadRegistry
+func NewWorkloadRegistry() *WorkloadRegistry {
+	return &WorkloadRegistry{}
+}
+
+// Register adds a workload kind to the registry, replacing any adapter registered for the same kind
+func (r *WorkloadRegistry) Register(adapter WorkloadAdapter) {
+	for i, a := range r.adapters {
+		if a.Kind() == adapter.Kind() {
+			r.adapters[i] = adapter
+			return
+		}
+	}
+	r.adapters = append(r.adapters, adapter)
+}
+
+// Adapters returns the registered adapters in registration order
+func (r *WorkloadRegistry) Adapters() []WorkloadAdapter {
+	return r.adapters
+}
+
+// Get returns the adapter registered for a kind
+func (r *WorkloadRegistry) Get(kind string) (WorkloadAdapter, bool) {
+	for _, a := range r.adapters {
+		if a.Kind() == kind {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// podTemplateAdapter is a WorkloadAdapter for typed workloads embedding a single pod template
+type podTemplateAdapter struct {
+	kind      string
+	path      string
+	newObject func() client.Object
+	newList   func() client.ObjectList
+	template  func(obj client.Object) *corev1.PodTemplateSpec
+}
+
+// NewPodTemplateAdapter returns a WorkloadAdapter for a typed workload kind embedding a single pod template at path.
+// template returns a pointer to the pod template inside the workload, or nil when it is not set.
+func NewPodTemplateAdapter(kind string, path string, newObject func() client.Object, newList func() client.ObjectList, template func(obj client.Object) *corev1.PodTemplateSpec) WorkloadAdapter {
+	return &podTemplateAdapter{kind: kind, path: path, newObject: newObject, newList: newList, template: template}
+}
+
+func (a *podTemplateAdapter) Kind() string {
+	return a.kind
+}
+
+func (a *podTemplateAdapter) NewObject() client.Object {
+	return a.newObject()
+}
+
+func (a *podTemplateAdapter) List(ctx context.Context, c client.Reader, opts ...client.ListOption) ([]client.Object, error) {
+	list := a.newList()
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []client.Object{}
+	for _, item := range items {
+		obj, ok := item.(client.Object)
+		if !ok {
+			return nil, fmt.Errorf("unexpected item of type %T in %s list", item, a.kind)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+func (a *podTemplateAdapter) GetPodTemplates(obj client.Object) ([]*corev1.PodTemplateSpec, error) {
+	template := a.template(obj)
+	if template == nil {
+		return []*corev1.PodTemplateSpec{}, nil
+	}
+	return []*corev1.PodTemplateSpec{template}, nil
+}
+
+func (a *podTemplateAdapter) SetPodTemplates(obj client.Object, templates []*corev1.PodTemplateSpec) error {
+	template := a.template(obj)
+	if len(templates) == 0 || template == nil {
+		return nil
+	}
+	if len(templates) != 1 {
+		return fmt.Errorf("%s embeds a single pod template, got %d", a.kind, len(templates))
+	}
+	*template = *templates[0]
+	return nil
+}
+
+func (a *podTemplateAdapter) PodTemplatePaths() []string {
+	return []string{a.path}
+}
+
+// The built-in workload kinds.
+// Jobs and Pods are not registered with the reconciler since their pod templates are immutable once created,
+// they are injected by the ProxyInjector admission webhook instead.
+var (
+	// DeploymentAdapter injects into apps/v1 Deployments
+	DeploymentAdapter = NewPodTemplateAdapter("Deployment", "spec.template",
+		func() client.Object { return &appsv1.Deployment{} },
+		func() client.ObjectList { return &appsv1.DeploymentList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.Deployment).Spec.Template })
+
+	// DeploymentConfigAdapter injects into apps.openshift.io/v1 DeploymentConfigs
+	DeploymentConfigAdapter = NewPodTemplateAdapter("DeploymentConfig", "spec.template",
+		func() client.Object { return &ocpappsv1.DeploymentConfig{} },
+		func() client.ObjectList { return &ocpappsv1.DeploymentConfigList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec {
+			return obj.(*ocpappsv1.DeploymentConfig).Spec.Template
+		})
+
+	// StatefulSetAdapter injects into apps/v1 StatefulSets
+	StatefulSetAdapter = NewPodTemplateAdapter("StatefulSet", "spec.template",
+		func() client.Object { return &appsv1.StatefulSet{} },
+		func() client.ObjectList { return &appsv1.StatefulSetList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.StatefulSet).Spec.Template })
+
+	// DaemonSetAdapter injects into apps/v1 DaemonSets
+	DaemonSetAdapter = NewPodTemplateAdapter("DaemonSet", "spec.template",
+		func() client.Object { return &appsv1.DaemonSet{} },
+		func() client.ObjectList { return &appsv1.DaemonSetList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.DaemonSet).Spec.Template })
+
+	// CronJobAdapter injects into batch/v1 CronJobs
+	CronJobAdapter = NewPodTemplateAdapter("CronJob", "spec.jobTemplate.spec.template",
+		func() client.Object { return &batchv1.CronJob{} },
+		func() client.ObjectList { return &batchv1.CronJobList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec {
+			return &obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+		})
+
+	// JobAdapter injects into batch/v1 Jobs, only at admission since their pod template is immutable
+	JobAdapter = NewPodTemplateAdapter("Job", "spec.template",
+		func() client.Object { return &batchv1.Job{} },
+		func() client.ObjectList { return &batchv1.JobList{} },
+		func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*batchv1.Job).Spec.Template })
+
+	// PodAdapter injects into bare v1 Pods, only at admission since the spec of a Pod is immutable
+	PodAdapter WorkloadAdapter = &podAdapter{}
+)
+
+// podAdapter is a WorkloadAdapter for Pods, presenting the Pod itself as its only pod template
+type podAdapter struct{}
+
+func (a *podAdapter) Kind() string {
+	return "Pod"
+}
+
+func (a *podAdapter) NewObject() client.Object {
+	return &corev1.Pod{}
+}
+
+func (a *podAdapter) List(ctx context.Context, c client.Reader, opts ...client.ListOption) ([]client.Object, error) {
+	list := &corev1.PodList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+
+	objects := []client.Object{}
+	for i := range list.Items {
+		objects = append(objects, &list.Items[i])
+	}
+	return objects, nil
+}
+
+func (a *podAdapter) GetPodTemplates(obj client.Object) ([]*corev1.PodTemplateSpec, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected a Pod, got %T", obj)
+	}
+	return []*corev1.PodTemplateSpec{{ObjectMeta: *pod.ObjectMeta.DeepCopy(), Spec: pod.Spec}}, nil
+}
+
+func (a *podAdapter) SetPodTemplates(obj client.Object, templates []*corev1.PodTemplateSpec) error {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return fmt.Errorf("expected a Pod, got %T", obj)
+	}
+	if len(templates) != 1 {
+		return fmt.Errorf("a Pod is its own single pod template, got %d", len(templates))
+	}
+	pod.Annotations = templates[0].Annotations
+	pod.Spec = templates[0].Spec
+	return nil
+}
+
+func (a *podAdapter) PodTemplatePaths() []string {
+	return []string{}
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"path/filepath"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -28,13 +31,18 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	proxyv1alpha1 "github.com/kenmoini/proxy-config-operator/api/v1alpha1"
+	proxyv1beta1 "github.com/kenmoini/proxy-config-operator/api/v1beta1"
 	"github.com/kenmoini/proxy-config-operator/controllers"
 	ocpappsv1 "github.com/openshift/api/apps/v1"
 	ocpconfigv1 "github.com/openshift/api/config/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -44,12 +52,16 @@ import (
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("proxy-config-operator-setup")
+
+	// webhookCertDir is the directory the webhook server reads its serving certificate from
+	webhookCertDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
 )
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(proxyv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(proxyv1beta1.AddToScheme(scheme))
 	utilruntime.Must(ocpappsv1.Install(scheme))
 	utilruntime.Must(appsv1.AddToScheme(scheme))
 	utilruntime.Must(batchv1.AddToScheme(scheme))
@@ -63,11 +75,30 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	var workloadConfigPath string
+	var webhookFailurePolicy string
+	var provisionWebhookCerts bool
+	var webhookNames webhookObjectNames
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The maximum number of ProxyConfigs that are reconciled in parallel.")
+	flag.StringVar(&workloadConfigPath, "workload-config", "",
+		"The path to a file listing additional custom resource kinds embedding pod templates to inject into.")
+	flag.StringVar(&webhookFailurePolicy, "webhook-failure-policy", "Ignore",
+		"Whether objects the proxy configuration could not be injected into at admission are admitted (Ignore) or rejected (Fail).")
+	flag.BoolVar(&provisionWebhookCerts, "provision-webhook-certs", true,
+		"Generate and rotate the webhook certificates, instead of relying on cert-manager to provide them.")
+	flag.StringVar(&webhookNames.service, "webhook-service-name", controllers.WEBHOOK_SERVICE_NAME,
+		"The name of the Service in front of the webhook server, the webhook certificates are issued for.")
+	flag.StringVar(&webhookNames.mutatingWebhookConfiguration, "mutating-webhook-configuration-name", controllers.MUTATING_WEBHOOK_CONFIGURATION_NAME,
+		"The name of the MutatingWebhookConfiguration to set the caBundle of.")
+	flag.StringVar(&webhookNames.validatingWebhookConfiguration, "validating-webhook-configuration-name", controllers.VALIDATING_WEBHOOK_CONFIGURATION_NAME,
+		"The name of the ValidatingWebhookConfiguration to set the caBundle of.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -77,12 +108,25 @@ func main() {
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
+		Scheme: scheme,
+		Metrics: metricsserver.Options{
+			BindAddress: metricsAddr,
+		},
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Port:    9443,
+			CertDir: webhookCertDir,
+		}),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "3d0cf4e9.k8s.kemo.dev",
+		// Serve the custom resources listed in the workload config from the cache as well, while Secrets and ConfigMaps
+		// are read from the API server, so the data of every Secret and ConfigMap in the cluster isn't cached
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				Unstructured: true,
+				DisableFor:   []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
+			},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -100,13 +144,72 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.ProxyConfigReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	// Register the workload kinds the proxy configuration is injected into
+	workloads := controllers.NewWorkloadRegistry()
+	workloads.Register(controllers.DeploymentAdapter)
+	workloads.Register(controllers.DeploymentConfigAdapter)
+	workloads.Register(controllers.StatefulSetAdapter)
+	workloads.Register(controllers.DaemonSetAdapter)
+	workloads.Register(controllers.CronJobAdapter)
+	if workloadConfigPath != "" {
+		workloadConfig, err := controllers.LoadWorkloadConfig(workloadConfigPath)
+		if err != nil {
+			setupLog.Error(err, "unable to load workload config")
+			os.Exit(1)
+		}
+		for _, w := range workloadConfig.Workloads {
+			workloads.Register(controllers.NewUnstructuredAdapter(w))
+		}
+	}
+
+	reconciler := &controllers.ProxyConfigReconciler{
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		APIReader:               mgr.GetAPIReader(),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		Workloads:               workloads,
+		Recorder:                mgr.GetEventRecorderFor("proxy-config-operator"),
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ProxyConfig")
 		os.Exit(1)
 	}
+	if err = (&controllers.ClusterProxyConfigReconciler{
+		ProxyConfigReconciler: reconciler,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterProxyConfig")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if webhookFailurePolicy != "Ignore" && webhookFailurePolicy != "Fail" {
+			setupLog.Error(nil, "invalid webhook failure policy, expected Ignore or Fail", "policy", webhookFailurePolicy)
+			os.Exit(1)
+		}
+		if provisionWebhookCerts {
+			provisionCerts(mgr, webhookNames, admissionregistrationv1.FailurePolicyType(webhookFailurePolicy))
+		}
+		if err = (&proxyv1beta1.ProxyConfig{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ProxyConfig")
+			os.Exit(1)
+		}
+		if err = (&proxyv1beta1.ClusterProxyConfig{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterProxyConfig")
+			os.Exit(1)
+		}
+		if err = (&controllers.WebhookNamespaceReconciler{
+			ProxyConfigReconciler: reconciler,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "WebhookNamespace")
+			os.Exit(1)
+		}
+		if err = (&controllers.ProxyInjector{
+			Reconciler: reconciler,
+			FailClosed: webhookFailurePolicy == "Fail",
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ProxyInjector")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -124,3 +227,40 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// webhookObjectNames are the names of the objects the webhook certificates are provisioned for
+type webhookObjectNames struct {
+	service                        string
+	mutatingWebhookConfiguration   string
+	validatingWebhookConfiguration string
+}
+
+// provisionCerts provides the webhook server with its certificates before the manager starts, and rotates them while it runs
+func provisionCerts(mgr ctrl.Manager, names webhookObjectNames, failurePolicy admissionregistrationv1.FailurePolicyType) {
+	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		setupLog.Error(err, "unable to determine the namespace of the manager")
+		os.Exit(1)
+	}
+
+	provisioner := &controllers.WebhookCertProvisioner{
+		Client:                          mgr.GetClient(),
+		Reader:                          mgr.GetAPIReader(),
+		Namespace:                       strings.TrimSpace(string(namespace)),
+		SecretName:                      controllers.WEBHOOK_CERT_SECRET_NAME,
+		ServiceName:                     names.service,
+		CertDir:                         webhookCertDir,
+		MutatingWebhookConfigurations:   []string{names.mutatingWebhookConfiguration},
+		ValidatingWebhookConfigurations: []string{names.validatingWebhookConfiguration},
+		CustomResourceDefinitions:       []string{controllers.PROXY_CONFIG_CRD_NAME},
+		MutatingFailurePolicy:           failurePolicy,
+	}
+	if err = provisioner.Provision(context.Background()); err != nil {
+		setupLog.Error(err, "unable to provision the webhook certificates")
+		os.Exit(1)
+	}
+	if err = mgr.Add(provisioner); err != nil {
+		setupLog.Error(err, "unable to set up webhook certificate rotation")
+		os.Exit(1)
+	}
+}